@@ -3,18 +3,22 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"net/http"
+	"net/url"
+	"os"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/longlodw/lazyiterate"
-	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/time/rate"
 )
 
@@ -30,13 +34,71 @@ type rpcBlock struct {
 	Number        string  `json:"number"`
 	GasUsed       string  `json:"gasUsed"`
 	BaseFeePerGas string  `json:"baseFeePerGas"`
+	Size          string  `json:"size"`
 	Timestamp     string  `json:"timestamp"`
 	Transactions  []rpcTx `json:"transactions"`
+
+	TransactionsRoot string `json:"transactionsRoot"`
+	StateRoot        string `json:"stateRoot"`
+	ReceiptsRoot     string `json:"receiptsRoot"`
+
+	// Difficulty is 0x0 after the merge. Newer clients omit
+	// totalDifficulty altogether.
+	Difficulty      string `json:"difficulty"`
+	TotalDifficulty string `json:"totalDifficulty"`
+
+	// Miner is the coinbase address, the fee recipient after the merge
+	Miner string `json:"miner"`
+}
+
+// rpcBlockHeader is a block fetched without transactions
+type rpcBlockHeader struct {
+	Number        string `json:"number"`
+	BaseFeePerGas string `json:"baseFeePerGas"`
+	Timestamp     string `json:"timestamp"`
 }
 
 type rpcTx struct {
 	GasPrice string `json:"gasPrice"`
 	Gas      string `json:"gas"`
+
+	// EIP-1559 fee caps, used when gasPrice is absent
+	MaxFeePerGas         string `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas string `json:"maxPriorityFeePerGas"`
+}
+
+// tipPerGas is the priority fee per gas the transaction pays at baseFee. A
+// type-2 transaction without gasPrice pays min(maxPriorityFee, maxFee - baseFee).
+func (tx rpcTx) tipPerGas(baseFee *big.Int) (*big.Int, error) {
+	if strings.TrimSpace(tx.GasPrice) != "" || tx.MaxFeePerGas == "" {
+		gasPrice, err := hexToBig(tx.GasPrice)
+		if err != nil {
+			return nil, err
+		}
+		return tipPerGas(gasPrice, baseFee), nil
+	}
+	maxFee, err := hexToBig(tx.MaxFeePerGas)
+	if err != nil {
+		return nil, err
+	}
+	maxPriorityFee, err := hexToBig(tx.MaxPriorityFeePerGas)
+	if err != nil {
+		return nil, err
+	}
+	tip := tipPerGas(maxFee, baseFee)
+	if maxPriorityFee.Cmp(tip) < 0 {
+		tip = maxPriorityFee
+	}
+	return tip, nil
+}
+
+// effectiveGasPrice is the price per gas the transaction pays at baseFee
+func (tx rpcTx) effectiveGasPrice(baseFee *big.Int) (*big.Int, error) {
+	tip, err := tx.tipPerGas(baseFee)
+	if err != nil {
+		return nil, err
+	}
+	return tip.Add(tip, baseFee), nil
 }
 
 type jsonRPCResponse[T any] struct {
@@ -51,15 +113,159 @@ type rpcErr struct {
 	Message string `json:"message"`
 }
 
+// rpcProvider is an RPC endpoint with its own rate limit
+type rpcProvider struct {
+	url     string
+	limiter *rate.Limiter
+}
+
 type Analyzer struct {
 	alchURL string
 	client  *http.Client
 	limiter *rate.Limiter
-	db      *sql.DB
+	// rateLimit and rateBurst configure limiter and each fallback's own
+	rateLimit rate.Limit
+	rateBurst int
+	// fallbacks are tried in order when a block fetch from alchURL fails
+	fallbacks    []*rpcProvider
+	fallbackURLs []string
+
+	db     *sql.DB
+	dbPath string
+
+	maxResponseBytes int64
+	// maxRetries is how many times a failed block fetch is retried
+	maxRetries int
+	// Blocks are fetched rpcBatchSize per JSON-RPC batch call, each
+	// taking rpcBatchTokens from the rate limiter
+	rpcBatchSize   int
+	rpcBatchTokens int
+
+	// rpcLatency times RPC round trips, excluding rate-limiter waits
+	rpcLatency *latencyHistogram
+	// batches times fetch batches, from cache lookup to flush
+	batches batchStats
+
+	vacuumMu sync.Mutex
+
+	headMu sync.Mutex
+	head   uint64
+	headAt time.Time
+
+	// missing maps blocks the provider reported as not found to when that
+	// stops being trusted; kept apart from block_cache, which only holds
+	// real blocks
+	missingMu sync.Mutex
+	missing   map[uint64]time.Time
+
+	// blockMethod and blockParams fetch a block with its transactions;
+	// blockParamsPlaceholder in blockParams is replaced by the block number
+	blockMethod string
+	blockParams []any
+
+	// writeBehind is nil when cache inserts are synchronous
+	writeBehind *writeBehind
+	// Cache rows inserted or changed, and rewrites skipped as identical
+	cacheWritten   atomic.Uint64
+	cacheUnchanged atomic.Uint64
+	// cacheErrors counts failed cache reads and writes, which jobs fall
+	// back to RPC for
+	cacheErrors atomic.Uint64
+
+	// deterministic disables rate limiting and retry backoff
+	deterministic bool
+}
+
+// AnalyzerOption customizes an Analyzer built by NewAnalyzer
+type AnalyzerOption func(*Analyzer)
+
+// WithProxy routes outbound RPC requests through proxyURL instead of the
+// HTTPS_PROXY/HTTP_PROXY environment variables.
+func WithProxy(proxyURL *url.URL) AnalyzerOption {
+	return func(a *Analyzer) {
+		a.client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+	}
+}
+
+// Default rate limit per provider, Alchemy's free tier
+const (
+	defaultRateLimit = rate.Limit(25) // requests per second
+	defaultRateBurst = 25
+)
+
+// WithRateLimit allows rps requests per second to each provider, with
+// bursts of up to burst requests
+func WithRateLimit(rps float64, burst int) AnalyzerOption {
+	return func(a *Analyzer) {
+		a.rateLimit = rate.Limit(rps)
+		a.rateBurst = burst
+	}
+}
+
+// WithRPCURL sends RPC requests to rpcURL instead of Alchemy's mainnet
+// endpoint for the API key
+func WithRPCURL(rpcURL string) AnalyzerOption {
+	return func(a *Analyzer) {
+		a.alchURL = rpcURL
+	}
+}
+
+// WithFallbackRPCURLs makes block fetches that fail against the primary
+// endpoint retry immediately against each of urls in turn, before backing
+// off. Each fallback has its own rate limit.
+func WithFallbackRPCURLs(urls ...string) AnalyzerOption {
+	return func(a *Analyzer) {
+		a.fallbackURLs = urls
+	}
+}
+
+// blockParamsPlaceholder marks where the hex block number goes in a block
+// params template
+const blockParamsPlaceholder = "{block}"
+
+// WithBlockMethod fetches blocks with a non-standard RPC method, passing
+// params with blockParamsPlaceholder replaced by the block number.
+func WithBlockMethod(method string, params []any) AnalyzerOption {
+	return func(a *Analyzer) {
+		a.blockMethod = method
+		a.blockParams = params
+	}
 }
 
-func NewAnalyzer(apiKey string, dbPath string) *Analyzer {
-	db, err := sql.Open("sqlite3", dbPath)
+// WithDeterministic makes RPC calls never wait on the rate limiter and
+// failed fetches retry immediately, so runs against a recorded fixture are
+// fast and repeatable. Not for use against a real provider.
+func WithDeterministic() AnalyzerOption {
+	return func(a *Analyzer) {
+		a.deterministic = true
+	}
+}
+
+// WithMaxRetries sets how many times a failed block fetch is retried before
+// the block is given up on
+func WithMaxRetries(n int) AnalyzerOption {
+	return func(a *Analyzer) {
+		a.maxRetries = n
+	}
+}
+
+// WithMaxResponseBytes caps the size of a single RPC response body
+func WithMaxResponseBytes(n int64) AnalyzerOption {
+	return func(a *Analyzer) {
+		a.maxResponseBytes = n
+	}
+}
+
+// defaultMaxResponseBytes leaves room for the largest mainnet blocks with full
+// transactions while stopping a misbehaving provider from exhausting memory.
+const defaultMaxResponseBytes = 16 << 20
+
+// defaultMaxRetries gives a flaky provider about a minute, with backoff,
+// before a block fails
+const defaultMaxRetries = 5
+
+func NewAnalyzer(apiKey string, dbPath string, opts ...AnalyzerOption) *Analyzer {
+	db, err := sql.Open(sqliteDriver, dbPath)
 	if err != nil {
 		panic(err)
 	}
@@ -69,44 +275,207 @@ func NewAnalyzer(apiKey string, dbPath string) *Analyzer {
 		block_num INTEGER PRIMARY KEY,
 		timestamp INTEGER,
 		gas_used TEXT,
-		total_tips TEXT
+		total_tips TEXT,
+		base_fee TEXT,
+		size INTEGER
+	);
+	`)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS tx_cache (
+		hash TEXT PRIMARY KEY,
+		block_num INTEGER,
+		gas_used TEXT,
+		effective_gas_price TEXT,
+		base_fee TEXT
 	);
 	`)
 	if err != nil {
 		panic(err)
 	}
-	return &Analyzer{
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS log_counts (
+		block_num INTEGER,
+		topic TEXT,
+		address TEXT,
+		count INTEGER,
+		PRIMARY KEY (block_num, topic, address)
+	);
+	`)
+	if err != nil {
+		panic(err)
+	}
+	// Gas used per transaction type, for gasByType jobs
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS gas_by_type (
+		block_num INTEGER PRIMARY KEY,
+		legacy TEXT,
+		eip1559 TEXT,
+		blob TEXT
+	);
+	`)
+	if err != nil {
+		panic(err)
+	}
+	// Rows of jobs submitted with results=true
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS job_results (
+		job_id TEXT,
+		block_num INTEGER,
+		timestamp INTEGER,
+		gas_used TEXT,
+		tips TEXT,
+		base_fee TEXT,
+		base_fee_delta TEXT,
+		size INTEGER,
+		tx_count INTEGER,
+		PRIMARY KEY (job_id, block_num)
+	);
+	`)
+	if err != nil {
+		panic(err)
+	}
+	// Counter for sequential job IDs
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS job_counter (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		n INTEGER NOT NULL
+	);
+	INSERT OR IGNORE INTO job_counter (id, n) VALUES (1, 0);
+	`)
+	if err != nil {
+		panic(err)
+	}
+	// Job records, so jobs survive a restart. record is the job's status
+	// JSON; the other columns are for querying.
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS jobs (
+		job_id TEXT PRIMARY KEY,
+		status TEXT NOT NULL,
+		start_block INTEGER NOT NULL,
+		end_block INTEGER NOT NULL,
+		last_written INTEGER NOT NULL,
+		file_path TEXT,
+		error TEXT,
+		next_block INTEGER NOT NULL,
+		flushed_bytes INTEGER NOT NULL,
+		record TEXT NOT NULL
+	);
+	`)
+	if err != nil {
+		panic(err)
+	}
+	// Caches created by older versions lack the newer columns
+	if err := addColumnIfMissing(db, "block_cache", "base_fee", "TEXT"); err != nil {
+		panic(err)
+	}
+	if err := addColumnIfMissing(db, "block_cache", "size", "INTEGER"); err != nil {
+		panic(err)
+	}
+	if err := addColumnIfMissing(db, "block_cache", "tx_count", "INTEGER"); err != nil {
+		panic(err)
+	}
+	// Roots and difficulty are optional: rows without them are only
+	// refetched for jobs that export them. Rows without a miner are left
+	// out of /cache/miners.
+	for _, column := range []string{"transactions_root", "state_root", "receipts_root", "difficulty", "total_difficulty", "miner"} {
+		if err := addColumnIfMissing(db, "block_cache", column, "TEXT"); err != nil {
+			panic(err)
+		}
+	}
+	// Honors HTTPS_PROXY/HTTP_PROXY/NO_PROXY unless WithProxy overrides it
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	a := &Analyzer{
 		alchURL: fmt.Sprintf("https://eth-mainnet.g.alchemy.com/v2/%s", apiKey),
-		client:  &http.Client{Timeout: 15 * time.Second},
-		limiter: rate.NewLimiter(rate.Limit(25), 25), // 25 req/sec
+		client:  &http.Client{Timeout: 15 * time.Second, Transport: transport},
 		db:      db,
+		dbPath:  dbPath,
+
+		rateLimit: defaultRateLimit,
+		rateBurst: defaultRateBurst,
+
+		maxResponseBytes: defaultMaxResponseBytes,
+		maxRetries:       defaultMaxRetries,
+		rpcBatchSize:     defaultRPCBatchSize,
+		rpcBatchTokens:   1,
+		blockMethod:      "eth_getBlockByNumber",
+		blockParams:      []any{blockParamsPlaceholder, true}, // full txs
+		rpcLatency:       newLatencyHistogram(),
+		missing:          make(map[uint64]time.Time),
+	}
+	for _, opt := range opts {
+		opt(a)
 	}
+	a.limiter = rate.NewLimiter(a.rateLimit, a.rateBurst)
+	if a.deterministic {
+		a.limiter = rate.NewLimiter(rate.Inf, 0)
+	}
+	for _, u := range a.fallbackURLs {
+		limiter := rate.NewLimiter(a.rateLimit, a.rateBurst)
+		if a.deterministic {
+			limiter = rate.NewLimiter(rate.Inf, 0)
+		}
+		a.fallbacks = append(a.fallbacks, &rpcProvider{url: u, limiter: limiter})
+	}
+	// Surface a malformed proxy setting at startup rather than on every fetch
+	probe, err := http.NewRequest(http.MethodPost, a.alchURL, nil)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := transport.Proxy(probe); err != nil {
+		panic(fmt.Sprintf("invalid proxy configuration: %v", err))
+	}
+	if a.writeBehind != nil {
+		go a.runWriteBehind()
+	}
+	return a
 }
 
-func (a *Analyzer) getBlockWithTxs(ctx context.Context, blockNum uint64) (*rpcBlock, error) {
-	if err := a.limiter.Wait(ctx); err != nil {
+// rpcCall performs a single JSON-RPC call against the primary provider and
+// decodes its result as T.
+func rpcCall[T any](ctx context.Context, a *Analyzer, method string, params ...any) (*T, error) {
+	return rpcCallTo[T](ctx, a, &rpcProvider{url: a.alchURL, limiter: a.limiter}, method, params...)
+}
+
+// rpcCallTo performs a single JSON-RPC call against p
+func rpcCallTo[T any](ctx context.Context, a *Analyzer, p *rpcProvider, method string, params ...any) (*T, error) {
+	if err := p.limiter.Wait(ctx); err != nil {
 		return nil, err
 	}
-	hexNum := fmt.Sprintf("0x%x", blockNum)
+	if timeout, ok := ctx.Value(rpcTimeoutKey{}).(time.Duration); ok && timeout < a.client.Timeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 	reqObj := jsonRPCRequest{
 		JSONRPC: "2.0",
 		ID:      time.Now().UnixNano(),
-		Method:  "eth_getBlockByNumber",
-		Params:  []any{hexNum, true}, // full txs
+		Method:  method,
+		Params:  params,
 	}
 	reqBody, _ := json.Marshal(reqObj)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.alchURL, strings.NewReader(string(reqBody)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, strings.NewReader(string(reqBody)))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	began := time.Now()
+	defer func() { a.rpcLatency.Observe(time.Since(began)) }()
 	resp, err := a.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	var rpcRes jsonRPCResponse[rpcBlock]
-	if err := json.NewDecoder(resp.Body).Decode(&rpcRes); err != nil {
+	body := &io.LimitedReader{R: resp.Body, N: a.maxResponseBytes + 1}
+	var rpcRes jsonRPCResponse[T]
+	err = json.NewDecoder(body).Decode(&rpcRes)
+	if body.N <= 0 {
+		return nil, fmt.Errorf("RPC response exceeds %d bytes", a.maxResponseBytes)
+	}
+	if err != nil {
 		return nil, err
 	}
 	if rpcRes.Error != nil {
@@ -115,19 +484,139 @@ func (a *Analyzer) getBlockWithTxs(ctx context.Context, blockNum uint64) (*rpcBl
 	return &rpcRes.Result, nil
 }
 
-func (a *Analyzer) calculateTotalTips(block *rpcBlock) *big.Int {
-	baseFee := hexToBig(block.BaseFeePerGas)
+type rpcTimeoutKey struct{}
+
+// WithRPCTimeout returns a context whose RPC calls each time out after d
+// instead of the client's fixed timeout, when d is shorter. Unlike a deadline
+// on ctx itself, it applies afresh to every attempt.
+func WithRPCTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, rpcTimeoutKey{}, d)
+}
+
+// errBlockNotFound is returned for blocks the provider doesn't have (yet),
+// which it reports as a null result
+var errBlockNotFound = errors.New("block not found")
+
+// blockTagParams returns the params fetching the block given by tag, a hex
+// number or a tag such as "pending", with blockMethod
+func (a *Analyzer) blockTagParams(tag string) []any {
+	params := slices.Clone(a.blockParams)
+	for i, p := range params {
+		if p == blockParamsPlaceholder {
+			params[i] = tag
+		}
+	}
+	return params
+}
+
+func (a *Analyzer) getBlockWithTxs(ctx context.Context, blockNum uint64) (*rpcBlock, error) {
+	params := a.blockTagParams(fmt.Sprintf("0x%x", blockNum))
+	block, err := rpcCall[*rpcBlock](ctx, a, a.blockMethod, params...)
+	for i := 0; err != nil && err != errBlockNotFound && ctx.Err() == nil && i < len(a.fallbacks); i++ {
+		// Don't log provider URLs, they usually embed an API key
+		fmt.Printf("Error fetching block %d, trying fallback provider %d: %s\n", blockNum, i+1, truncateError(err.Error()))
+		block, err = rpcCallTo[*rpcBlock](ctx, a, a.fallbacks[i], a.blockMethod, params...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if *block == nil {
+		return nil, errBlockNotFound
+	}
+	return *block, nil
+}
+
+// missingTTL is how long a not-found block is answered from memory before
+// asking the provider again, about one slot so it's fetched soon after it
+// is mined
+const missingTTL = 12 * time.Second
+
+// gapWait is how long a job waits at a strict gap for a missing block
+// before asking again: missingTTL, or nothing in deterministic mode
+func (a *Analyzer) gapWait() time.Duration {
+	if a.deterministic {
+		return 0
+	}
+	return missingTTL
+}
+
+// knownMissing reports whether blockNum was not found within missingTTL
+func (a *Analyzer) knownMissing(blockNum uint64) bool {
+	a.missingMu.Lock()
+	defer a.missingMu.Unlock()
+	expires, ok := a.missing[blockNum]
+	if ok && time.Now().After(expires) {
+		delete(a.missing, blockNum)
+		return false
+	}
+	return ok
+}
+
+// markMissing records that the provider doesn't have blockNum yet
+func (a *Analyzer) markMissing(blockNum uint64) {
+	a.missingMu.Lock()
+	defer a.missingMu.Unlock()
+	now := time.Now()
+	if len(a.missing) >= 1024 {
+		// Drop expired entries so polling far ahead of the head can't grow
+		// the map without bound
+		for bn, expires := range a.missing {
+			if now.After(expires) {
+				delete(a.missing, bn)
+			}
+		}
+	}
+	a.missing[blockNum] = now.Add(missingTTL)
+}
+
+// headTTL is how long a fetched chain head is reused, about one slot
+const headTTL = 12 * time.Second
+
+// HeadBlock returns the latest block number, cached for headTTL
+func (a *Analyzer) HeadBlock(ctx context.Context) (uint64, error) {
+	return a.HeadBlockWithin(ctx, headTTL)
+}
+
+// HeadBlockWithin returns the latest block number, fetched at most maxAge ago
+func (a *Analyzer) HeadBlockWithin(ctx context.Context, maxAge time.Duration) (uint64, error) {
+	a.headMu.Lock()
+	defer a.headMu.Unlock()
+	if !a.headAt.IsZero() && time.Since(a.headAt) < maxAge {
+		return a.head, nil
+	}
+	res, err := rpcCall[string](ctx, a, "eth_blockNumber")
+	if err != nil {
+		return 0, err
+	}
+	head, err := hexToUint64(*res)
+	if err != nil {
+		return 0, err
+	}
+	a.head, a.headAt = head, time.Now()
+	return head, nil
+}
+
+func (a *Analyzer) calculateTotalTips(block *rpcBlock) (*big.Int, error) {
+	baseFee, err := hexToBig(block.BaseFeePerGas)
+	if err != nil {
+		return nil, err
+	}
+	var txErr error
 	totalTips := lazyiterate.Reduce(
 		lazyiterate.Map(
 			slices.Values(block.Transactions),
 			func(tx rpcTx) *big.Int {
-				gasPrice := hexToBig(tx.GasPrice)
-				gasUsed := hexToBig(tx.Gas)
-				tip := new(big.Int).Sub(gasPrice, baseFee)
-				if tip.Sign() < 0 {
-					tip.SetInt64(0) // Ensure no negative tips
+				tip, err := tx.tipPerGas(baseFee)
+				if err != nil {
+					txErr = err
+					return new(big.Int)
+				}
+				gasUsed, err := hexToBig(tx.Gas)
+				if err != nil {
+					txErr = err
+					return new(big.Int)
 				}
-				return new(big.Int).Mul(tip, gasUsed) // Total tip for this tx
+				return tip.Mul(tip, gasUsed) // Total tip for this tx
 			},
 		),
 		func(acc, v *big.Int) *big.Int {
@@ -135,77 +624,380 @@ func (a *Analyzer) calculateTotalTips(block *rpcBlock) *big.Int {
 		},
 		big.NewInt(0),
 	)
-	return totalTips
+	if txErr != nil {
+		return nil, txErr
+	}
+	return totalTips, nil
 }
 
-func (a *Analyzer) getBlockGasUsed(block *rpcBlock) *big.Int {
+// tipPerGas is the priority fee per gas paid above the base fee, never negative
+func tipPerGas(gasPrice, baseFee *big.Int) *big.Int {
+	tip := new(big.Int).Sub(gasPrice, baseFee)
+	if tip.Sign() < 0 {
+		tip.SetInt64(0) // Ensure no negative tips
+	}
+	return tip
+}
+
+func (a *Analyzer) getBlockGasUsed(block *rpcBlock) (*big.Int, error) {
 	return hexToBig(block.GasUsed)
 }
 
-func (a *Analyzer) GetBlockGasAndTips(ctx context.Context, blockNum uint64) (timestamp time.Time, gasUsed *big.Int, totalTips *big.Int) {
+// cacheColumns are the block_cache columns read into a cachedBlock
+const cacheColumns = "timestamp, gas_used, total_tips, base_fee, size, tx_count, transactions_root, state_root, receipts_root, difficulty, total_difficulty, miner"
+
+// cacheError logs a failed cache read or write and counts it, so jobs can
+// give up on a broken database instead of quietly fetching everything
+func (a *Analyzer) cacheError(what string, err error) {
+	fmt.Printf("%s: %v\n", what, err)
+	a.cacheErrors.Add(1)
+}
+
+// errStaleCacheRow marks rows cached by an older version that lack newer
+// columns; they are refetched to fill them in.
+var errStaleCacheRow = errors.New("stale cache row")
+
+// cachedBlock holds the raw cacheColumns of a block_cache row
+type cachedBlock struct {
+	ts        int64
+	gasUsed   string
+	totalTips string
+	baseFee   sql.NullString
+	size      sql.NullInt64
+	txCount   sql.NullInt64
+	roots     [3]sql.NullString
+	// totalDifficulty is empty when the provider didn't report it
+	difficulty      sql.NullString
+	totalDifficulty sql.NullString
+	miner           sql.NullString
+}
+
+func (c *cachedBlock) dest() []any {
+	return []any{&c.ts, &c.gasUsed, &c.totalTips, &c.baseFee, &c.size, &c.txCount, &c.roots[0], &c.roots[1], &c.roots[2],
+		&c.difficulty, &c.totalDifficulty, &c.miner}
+}
+
+func (c *cachedBlock) result(blockNum uint64) (*BlockResult, error) {
+	if !c.baseFee.Valid || !c.size.Valid || !c.txCount.Valid {
+		return nil, errStaleCacheRow
+	}
+	result := &BlockResult{BlockNum: blockNum, TimeStamp: time.Unix(c.ts, 0), Size: uint64(c.size.Int64), TxCount: uint64(c.txCount.Int64), Miner: c.miner.String}
+	if c.roots[0].Valid && c.roots[1].Valid && c.roots[2].Valid {
+		result.Roots = &blockRoots{c.roots[0].String, c.roots[1].String, c.roots[2].String}
+	}
+	var err error
+	if result.GasUsed, err = hexToBig(c.gasUsed); err != nil {
+		return nil, err
+	}
+	if result.Tips, err = hexToBig(c.totalTips); err != nil {
+		return nil, err
+	}
+	if result.BaseFee, err = hexToBig(c.baseFee.String); err != nil {
+		return nil, err
+	}
+	if c.difficulty.Valid {
+		if result.Difficulty, err = hexToBig(c.difficulty.String); err != nil {
+			return nil, err
+		}
+		if c.totalDifficulty.String != "" {
+			if result.TotalDifficulty, err = hexToBig(c.totalDifficulty.String); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// getCachedBlocks reads the cached blocks in [start, end] with a single
+// query. Blocks missing from the result must be fetched.
+func (a *Analyzer) getCachedBlocks(ctx context.Context, start, end uint64) (map[uint64]*BlockResult, error) {
+	return a.getCachedSamples(ctx, start, end, 1)
+}
+
+// getCachedSamples is getCachedBlocks for every step-th block from start
+func (a *Analyzer) getCachedSamples(ctx context.Context, start, end, step uint64) (map[uint64]*BlockResult, error) {
+	rows, err := a.db.QueryContext(ctx, "SELECT block_num, "+cacheColumns+" FROM block_cache WHERE block_num BETWEEN ? AND ? AND (block_num - ?) % ? = 0", start, end, start, step)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cached := make(map[uint64]*BlockResult)
+	for rows.Next() {
+		var blockNum uint64
+		var c cachedBlock
+		if err := rows.Scan(append([]any{&blockNum}, c.dest()...)...); err != nil {
+			return nil, err
+		}
+		result, err := c.result(blockNum)
+		if err != nil {
+			if err != errStaleCacheRow {
+				a.cacheError("Cache error", err)
+			}
+			continue
+		}
+		cached[blockNum] = result
+	}
+	return cached, rows.Err()
+}
+
+// GetBlockGasAndTips returns a single block, from the cache if it is there.
+// Ranges should read the cache with getCachedBlocks instead, in one query.
+func (a *Analyzer) GetBlockGasAndTips(ctx context.Context, blockNum uint64) (*BlockResult, error) {
 	// Try cache first (cancellable)
-	row := a.db.QueryRowContext(ctx, "SELECT timestamp, gas_used, total_tips FROM block_cache WHERE block_num = ?", blockNum)
-	var gasUsedStr, totalTipsStr string
-	var tsInt int64
-	err := row.Scan(&tsInt, &gasUsedStr, &totalTipsStr)
-	if err == nil {
-		gasUsed = hexToBig(gasUsedStr)
-		totalTips = hexToBig(totalTipsStr)
-		timestamp = time.Unix(tsInt, 0)
-		return timestamp, gasUsed, totalTips
-	}
-	if err != sql.ErrNoRows {
+	cached, err := a.getCachedBlocks(ctx, blockNum, blockNum)
+	if err != nil {
 		// If context cancelled or other error
 		if ctx.Err() != nil {
-			return time.Time{}, nil, nil
+			return nil, ctx.Err()
 		}
-		fmt.Printf("Cache error: %v\n", err)
+		a.cacheError("Cache error", err)
+	}
+	if result, ok := cached[blockNum]; ok {
+		return result, nil
+	}
+	// Don't spend a rate-limiter slot on a caller that has given up
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.fetchBlock(ctx, blockNum)
+}
+
+// fetchBlock fetches a block over RPC, retrying until it succeeds or ctx is
+// done, and caches the result. A block that can't be parsed fails for good.
+func (a *Analyzer) fetchBlock(ctx context.Context, blockNum uint64) (*BlockResult, error) {
+	if a.knownMissing(blockNum) {
+		return nil, errBlockNotFound
 	}
 	numRetried := 0
 	for {
 		block, err := a.getBlockWithTxs(ctx, blockNum)
 		if err != nil && ctx.Err() != nil {
-			return time.Time{}, nil, nil // Context cancelled
+			return nil, ctx.Err() // Context cancelled
+		}
+		if err == errBlockNotFound {
+			// Retrying won't help until the provider has it; the caller
+			// treats the block as missing
+			a.markMissing(blockNum)
+			return nil, err
 		}
 		if err != nil {
-			fmt.Printf("Error fetching block %d: %v\n", blockNum, err)
-			time.Sleep(time.Second * time.Duration(2<<numRetried)) // Exponential backoff
+			fmt.Printf("Error fetching block %d: %s\n", blockNum, truncateError(err.Error()))
+			if numRetried >= a.maxRetries {
+				return nil, fmt.Errorf("%w after %d retries: %w", errRetriesExhausted, numRetried, err)
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(a.retryBackoff(numRetried)):
+			}
+			numRetried++
 			continue
 		}
 
-		gasUsed = a.getBlockGasUsed(block)
-		totalTips = a.calculateTotalTips(block)
-		tsInt, err = strconv.ParseInt(strings.TrimPrefix(block.Timestamp, "0x"), 16, 64)
-		if err != nil {
-			panic(err)
+		return a.storeBlock(blockNum, block)
+	}
+}
+
+// storeBlock parses a fetched block and caches it
+func (a *Analyzer) storeBlock(blockNum uint64, block *rpcBlock) (*BlockResult, error) {
+	result, err := a.parseBlock(block)
+	if err != nil {
+		// The provider would send the same malformed block again
+		return nil, fmt.Errorf("malformed block: %w", err)
+	}
+	result.BlockNum = blockNum
+
+	a.cacheBlock(result)
+	return result, nil
+}
+
+// errRetriesExhausted is returned for a block whose fetch kept failing, as
+// opposed to ctx.Err() when the caller gave up first
+var errRetriesExhausted = errors.New("giving up")
+
+// maxRetryBackoff caps the exponential backoff between fetch retries
+const maxRetryBackoff = 30 * time.Second
+
+// retryBackoff is the exponential delay before retrying a failed fetch:
+// 2s, 4s, 8s and so on up to maxRetryBackoff
+func (a *Analyzer) retryBackoff(numRetried int) time.Duration {
+	if a.deterministic {
+		return 0
+	}
+	if numRetried >= 4 {
+		return maxRetryBackoff
+	}
+	return time.Second * time.Duration(2<<numRetried)
+}
+
+// parseBlock computes a block's metrics from its RPC representation
+func (a *Analyzer) parseBlock(block *rpcBlock) (*BlockResult, error) {
+	result := &BlockResult{TxCount: uint64(len(block.Transactions))}
+	var err error
+	if result.GasUsed, err = a.getBlockGasUsed(block); err != nil {
+		return nil, err
+	}
+	if result.Tips, err = a.calculateTotalTips(block); err != nil {
+		return nil, err
+	}
+	if result.BaseFee, err = hexToBig(block.BaseFeePerGas); err != nil {
+		return nil, err
+	}
+	if result.Size, err = hexToUint64(block.Size); err != nil {
+		return nil, err
+	}
+	tsInt, err := strconv.ParseInt(strings.TrimPrefix(block.Timestamp, "0x"), 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %q", block.Timestamp)
+	}
+	result.TimeStamp = time.Unix(tsInt, 0)
+	result.GasPrices = make([]*big.Int, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		if result.GasPrices[i], err = tx.effectiveGasPrice(result.BaseFee); err != nil {
+			return nil, err
 		}
-		timestamp = time.Unix(tsInt, 0)
+	}
+	result.Roots = &blockRoots{block.TransactionsRoot, block.StateRoot, block.ReceiptsRoot}
+	result.Miner = strings.ToLower(block.Miner)
+	if result.Difficulty, err = hexToBig(block.Difficulty); err != nil {
+		return nil, err
+	}
+	if block.TotalDifficulty != "" {
+		if result.TotalDifficulty, err = hexToBig(block.TotalDifficulty); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
 
-		// Save to cache
-		_, err = a.db.Exec("INSERT OR REPLACE INTO block_cache (block_num, timestamp, gas_used, total_tips) VALUES (?, ?, ?, ?)",
-			blockNum, tsInt, block.GasUsed, fmt.Sprintf("0x%x", totalTips))
-		if err != nil {
-			fmt.Printf("Cache insert error: %v\n", err)
+// PendingBlock computes the provisional metrics of the pending block. It
+// changes from one call to the next, so it is never cached.
+func (a *Analyzer) PendingBlock(ctx context.Context) (*BlockResult, error) {
+	block, err := rpcCall[*rpcBlock](ctx, a, a.blockMethod, a.blockTagParams("pending")...)
+	if err != nil {
+		return nil, err
+	}
+	if *block == nil {
+		return nil, errBlockNotFound
+	}
+	result, err := a.parseBlock(*block)
+	if err != nil {
+		return nil, err
+	}
+	if result.BlockNum, err = hexToUint64((*block).Number); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// errVacuumRunning is returned by Vacuum when another vacuum is in progress
+var errVacuumRunning = errors.New("vacuum already running")
+
+// Vacuum compacts the cache database, checkpointing the WAL first when WAL
+// mode is on, and reports the on-disk size before and after. VACUUM needs an
+// exclusive lock, so it fails with a busy error rather than waiting while
+// fetches hold the database.
+func (a *Analyzer) Vacuum(ctx context.Context) (before, after int64, err error) {
+	if !a.vacuumMu.TryLock() {
+		return 0, 0, errVacuumRunning
+	}
+	defer a.vacuumMu.Unlock()
+
+	before = a.dbSize()
+	var mode string
+	if err := a.db.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&mode); err != nil {
+		return 0, 0, err
+	}
+	if strings.EqualFold(mode, "wal") {
+		if _, err := a.db.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+			return 0, 0, err
 		}
-		return timestamp, gasUsed, totalTips
 	}
+	if _, err := a.db.ExecContext(ctx, "VACUUM"); err != nil {
+		return 0, 0, err
+	}
+	return before, a.dbSize(), nil
 }
 
-func hexToBig(h string) *big.Int {
-	h = strings.TrimPrefix(h, "0x")
+// dbSize is the size of the cache database including its WAL, if any
+func (a *Analyzer) dbSize() int64 {
+	var size int64
+	for _, path := range []string{a.dbPath, a.dbPath + "-wal"} {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// hexToBig parses a JSON-RPC quantity such as "0x1a" into a big.Int.
+// Surrounding whitespace and the 0x/0X prefix are optional, odd-length
+// digits are accepted as-is, and an empty quantity is treated as zero.
+func hexToBig(h string) (*big.Int, error) {
+	h = strings.TrimSpace(h)
+	if len(h) >= 2 && h[0] == '0' && (h[1] == 'x' || h[1] == 'X') {
+		h = h[2:]
+	}
 	if h == "" {
-		return big.NewInt(0)
+		return big.NewInt(0), nil
+	}
+	// SetString would also take a sign
+	if strings.IndexFunc(h, func(c rune) bool { return !isHexDigit(c) }) >= 0 {
+		return nil, fmt.Errorf("invalid hex string: %q", h)
+	}
+	n, ok := new(big.Int).SetString(h, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid hex string: %q", h)
 	}
-	b, err := hex.DecodeString(padOdd(h))
+	return n, nil
+}
+
+func isHexDigit(c rune) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// hexToUint64 parses a JSON-RPC quantity that fits in 64 bits
+func hexToUint64(h string) (uint64, error) {
+	n, err := hexToBig(h)
 	if err != nil {
-		panic(fmt.Sprintf("invalid hex string: %s", h))
+		return 0, err
 	}
-	return new(big.Int).SetBytes(b)
+	if !n.IsUint64() {
+		return 0, fmt.Errorf("hex quantity out of range: %q", h)
+	}
+	return n.Uint64(), nil
 }
 
-func padOdd(s string) string {
-	if len(s)%2 == 1 {
-		return "0" + s
+// addColumnIfMissing adds column to table unless it already exists, so the
+// cache schema can grow without breaking databases from earlier versions.
+func addColumnIfMissing(db *sql.DB, table, column, colType string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
-	return s
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, colType))
+	return err
+}
+
+// NextJobID atomically increments the persisted job counter and returns its
+// new value, so sequential IDs survive restarts.
+func (a *Analyzer) NextJobID(ctx context.Context) (uint64, error) {
+	var n uint64
+	err := a.db.QueryRowContext(ctx, "UPDATE job_counter SET n = n + 1 WHERE id = 1 RETURNING n").Scan(&n)
+	return n, err
 }
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHexToBig(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "0x1a", want: "26"},
+		{in: "0X1A", want: "26"},
+		{in: "1a", want: "26"},
+		{in: "0x1", want: "1"},
+		{in: "0xabc", want: "2748"}, // odd length
+		{in: "  0x10\n", want: "16"},
+		{in: "", want: "0"},
+		{in: "0x", want: "0"},
+		{in: "0x00ff", want: "255"},
+		{in: "0xffffffffffffffffffff", want: "1208925819614629174706175"},
+		{in: "0xg1", wantErr: true},
+		{in: "0x-1", wantErr: true},
+		{in: "0x+1f", wantErr: true},
+		{in: "-0x1", wantErr: true},
+		{in: "0x0x1", wantErr: true},
+		{in: "0x1_0", wantErr: true},
+		{in: "0x 1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := hexToBig(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("hexToBig(%q) = %s, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("hexToBig(%q): %v", tt.in, err)
+		} else if got.String() != tt.want {
+			t.Errorf("hexToBig(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHexToUint64(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint64
+		wantErr bool
+	}{
+		{in: "0x0", want: 0},
+		{in: "0x112a880", want: 18000000},
+		{in: "0xffffffffffffffff", want: math.MaxUint64},
+		{in: "0x10000000000000000", wantErr: true},
+		{in: "0x-1", wantErr: true},
+		{in: "0xz", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := hexToUint64(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("hexToUint64(%q) = %d, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("hexToUint64(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestWithProxy(t *testing.T) {
+	stub := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		return testBlock(blockParam(params)), nil
+	})
+	// The proxy answers the calls itself, recording who they were meant for
+	var target string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target = r.URL.Host
+		stub.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	a := newTestAnalyzer(t, "http://rpc.invalid/v2/key", WithProxy(proxyURL))
+
+	result, err := a.GetBlockGasAndTips(t.Context(), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.BlockNum != 7 || result.GasUsed.Int64() != 21000 {
+		t.Errorf("got block %d with gas %s", result.BlockNum, result.GasUsed)
+	}
+	if target != "rpc.invalid" {
+		t.Errorf("proxy saw a request for %q, want rpc.invalid", target)
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	// A block whose response is a bit over 10 KB
+	block := testBlock(7)
+	for range 100 {
+		block.Transactions = append(block.Transactions, block.Transactions[0])
+	}
+	stub := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		return block, nil
+	})
+	tests := []struct {
+		max     int64
+		wantErr bool
+	}{
+		{max: 1 << 10, wantErr: true},
+		{max: 1 << 20},
+	}
+	for _, tt := range tests {
+		a := newTestAnalyzer(t, stub.URL, WithMaxResponseBytes(tt.max))
+		got, err := a.getBlockWithTxs(t.Context(), 7)
+		if tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "exceeds") {
+				t.Errorf("max %d: error %v, want the response to be refused", tt.max, err)
+			}
+			continue
+		}
+		if err != nil || len(got.Transactions) != 101 {
+			t.Errorf("max %d: got %d transactions (%v), want 101", tt.max, len(got.Transactions), err)
+		}
+	}
+}
+
+func TestBlockSizeCache(t *testing.T) {
+	a, calls := newFixtureAnalyzer(t, testBlocks(1, 2))
+	// Block 2 was cached before sizes were recorded
+	_, err := a.db.Exec("INSERT INTO block_cache (block_num, timestamp, gas_used, total_tips, base_fee) VALUES (2, 0, '0x0', '0x0', '0x1')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		for n := uint64(1); n <= 2; n++ {
+			result, err := a.GetBlockGasAndTips(t.Context(), n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Size != 500+n {
+				t.Errorf("block %d: size %d, want %d", n, result.Size, 500+n)
+			}
+		}
+	}
+	if calls.Load() != 2 {
+		t.Errorf("made %d block calls, want 2", calls.Load())
+	}
+}
+
+func TestTxTipPerGas(t *testing.T) {
+	baseFee := big.NewInt(100)
+	tests := []struct {
+		name    string
+		tx      rpcTx
+		want    int64
+		wantErr bool
+	}{
+		{name: "legacy", tx: rpcTx{GasPrice: "0x96"}, want: 50},
+		{name: "legacy below base fee", tx: rpcTx{GasPrice: "0x32"}, want: 0},
+		{name: "gasPrice wins over fee caps", tx: rpcTx{GasPrice: "0x96", MaxFeePerGas: "0x1f4", MaxPriorityFeePerGas: "0x5"}, want: 50},
+		{name: "capped by priority fee", tx: rpcTx{MaxFeePerGas: "0x1f4", MaxPriorityFeePerGas: "0x5"}, want: 5},
+		{name: "capped by max fee", tx: rpcTx{MaxFeePerGas: "0x6e", MaxPriorityFeePerGas: "0x14"}, want: 10},
+		{name: "max fee below base fee", tx: rpcTx{MaxFeePerGas: "0x32", MaxPriorityFeePerGas: "0x14"}, want: 0},
+		{name: "blank gasPrice", tx: rpcTx{GasPrice: " ", MaxFeePerGas: "0x1f4", MaxPriorityFeePerGas: "0x5"}, want: 5},
+		{name: "bad priority fee", tx: rpcTx{MaxFeePerGas: "0x1f4", MaxPriorityFeePerGas: "0xzz"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := tt.tx.tipPerGas(baseFee)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: tipPerGas = %s, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got.Int64() != tt.want {
+			t.Errorf("%s: tipPerGas = %s, %v; want %d", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestNullBlockIsMissing(t *testing.T) {
+	// Block 5 comes back as a null result
+	a, calls := newFixtureAnalyzer(t, testBlocks(4, 6, 5))
+	r, err := a.GetBlockGasAndTips(t.Context(), 5)
+	if !errors.Is(err, errBlockNotFound) {
+		t.Fatalf("GetBlockGasAndTips = %+v, %v; want %v", r, err, errBlockNotFound)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("made %d calls, want 1 without retries", calls.Load())
+	}
+	cached, err := a.getCachedBlocks(t.Context(), 5, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != 0 {
+		t.Errorf("null block was cached: %+v", cached[5])
+	}
+}
+
+func TestGetBlockGasAndTipsCancelled(t *testing.T) {
+	tests := []struct {
+		name   string
+		cached bool
+	}{
+		{name: "cache miss"},
+		{name: "cached", cached: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int64
+			srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+				calls.Add(1)
+				return testBlock(blockParam(params)), nil
+			})
+			a := newTestAnalyzer(t, srv.URL)
+			if tt.cached {
+				seedCache(t, a, testBlocks(3, 3))
+			}
+			ctx, cancel := context.WithCancel(t.Context())
+			cancel()
+			began := time.Now()
+			_, err := a.GetBlockGasAndTips(ctx, 3)
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("error = %v, want %v", err, context.Canceled)
+			}
+			if d := time.Since(began); d > time.Second {
+				t.Errorf("took %v to return", d)
+			}
+			if n := calls.Load(); n != 0 {
+				t.Errorf("made %d RPC calls after cancellation", n)
+			}
+		})
+	}
+}
+
+func TestBlockMethod(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        []AnalyzerOption
+		wantMethod  string
+		wantParams  string // fetching block 7
+		wantPending string // fetching the pending block
+	}{
+		{
+			name:        "default",
+			wantMethod:  "eth_getBlockByNumber",
+			wantParams:  `["0x7",true]`,
+			wantPending: `["pending",true]`,
+		},
+		{
+			name:        "custom",
+			opts:        []AnalyzerOption{WithBlockMethod("l2_getBlock", []any{"full", blockParamsPlaceholder})},
+			wantMethod:  "l2_getBlock",
+			wantParams:  `["full","0x7"]`,
+			wantPending: `["full","pending"]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotMethod, gotParams string
+			srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+				gotMethod = method
+				b, _ := json.Marshal(params)
+				gotParams = string(b)
+				return testBlock(7), nil
+			})
+			a := newTestAnalyzer(t, srv.URL, tt.opts...)
+			if _, err := a.getBlockWithTxs(t.Context(), 7); err != nil {
+				t.Fatal(err)
+			}
+			if gotMethod != tt.wantMethod || gotParams != tt.wantParams {
+				t.Errorf("block 7: called %s %s, want %s %s", gotMethod, gotParams, tt.wantMethod, tt.wantParams)
+			}
+			block, err := a.PendingBlock(t.Context())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block.BlockNum != 7 {
+				t.Errorf("BlockNum = %d, want 7", block.BlockNum)
+			}
+			if gotMethod != tt.wantMethod || gotParams != tt.wantPending {
+				t.Errorf("pending: called %s %s, want %s %s", gotMethod, gotParams, tt.wantMethod, tt.wantPending)
+			}
+		})
+	}
+}
+
+func TestDeterministicRunsWithoutWaiting(t *testing.T) {
+	// Every block fails twice before it is served
+	var mu sync.Mutex
+	attempts := map[uint64]int{}
+	srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		n := blockParam(params)
+		mu.Lock()
+		defer mu.Unlock()
+		if attempts[n]++; attempts[n] <= 2 {
+			return nil, errors.New("flaky provider")
+		}
+		return testBlock(n), nil
+	})
+	a := newTestAnalyzer(t, srv.URL)
+	began := time.Now()
+	for n := uint64(1); n <= 40; n++ {
+		r, err := a.fetchBlock(t.Context(), n)
+		if err != nil || r.BlockNum != n {
+			t.Fatalf("fetchBlock(%d) = %+v, %v", n, r, err)
+		}
+	}
+	if d := time.Since(began); d > 2*time.Second {
+		t.Errorf("took %v, want no real waits", d)
+	}
+	if a.retryBackoff(3) != 0 {
+		t.Errorf("retryBackoff(3) = %v, want 0", a.retryBackoff(3))
+	}
+	if d := (&Analyzer{}).retryBackoff(3); d != 16*time.Second {
+		t.Errorf("retryBackoff(3) without deterministic mode = %v, want 16s", d)
+	}
+}
+
+func TestMissingBlockTTL(t *testing.T) {
+	var mined atomic.Bool
+	var calls atomic.Int64
+	srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		calls.Add(1)
+		if !mined.Load() {
+			return nil, nil
+		}
+		return testBlock(blockParam(params)), nil
+	})
+	a := newTestAnalyzer(t, srv.URL)
+	for range 3 {
+		if _, err := a.fetchBlock(t.Context(), 9); !errors.Is(err, errBlockNotFound) {
+			t.Fatalf("fetchBlock = %v, want %v", err, errBlockNotFound)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("made %d calls for a block known to be missing, want 1", n)
+	}
+
+	// Once the TTL is up the provider is asked again
+	mined.Store(true)
+	a.missingMu.Lock()
+	a.missing[9] = time.Now().Add(-time.Second)
+	a.missingMu.Unlock()
+	r, err := a.fetchBlock(t.Context(), 9)
+	if err != nil || r.BlockNum != 9 {
+		t.Fatalf("fetchBlock after the TTL = %+v, %v", r, err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("made %d calls, want 2", n)
+	}
+}
+
+func TestFallbackProviders(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	// stub serves blocks, failing those in fail; a nil fail fails every
+	// block. It records which blocks it was asked for.
+	stub := func(fail map[uint64]bool, null uint64) (*httptest.Server, func() []uint64) {
+		var mu sync.Mutex
+		var asked []uint64
+		srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+			n := blockParam(params)
+			mu.Lock()
+			asked = append(asked, n)
+			mu.Unlock()
+			switch {
+			case fail == nil || fail[n]:
+				return nil, errors.New("upstream unavailable")
+			case n == null:
+				return nil, nil
+			}
+			return testBlock(n), nil
+		})
+		return srv, func() []uint64 {
+			mu.Lock()
+			defer mu.Unlock()
+			return slices.Sorted(slices.Values(asked))
+		}
+	}
+	primary, primaryAsked := stub(map[uint64]bool{3: true, 4: true}, 9)
+	down, downAsked := stub(nil, 0)
+	backup, backupAsked := stub(map[uint64]bool{}, 0)
+	a := newTestAnalyzer(t, primary.URL, WithFallbackRPCURLs(down.URL, backup.URL))
+	setAnalyzer(t, a)
+
+	job := waitJob(t, submitJob(t, "start=1&end=6"))
+	if job.Status != "done" || job.RowsWritten != 6 {
+		t.Fatalf("status %s (%s), rowsWritten %d", job.Status, job.Error, job.RowsWritten)
+	}
+	tips := column(t, readCSV(t, job.FilePath), "tips")
+	if want := strconv.Itoa(21000 * testTip); tips[2] != want || tips[3] != "0" {
+		t.Errorf("blocks 3 and 4 have tips %s and %s, want %s and 0", tips[2], tips[3], want)
+	}
+	// Each fallback is tried in order, and only for the failed blocks
+	if got := downAsked(); !slices.Equal(got, []uint64{3, 4}) {
+		t.Errorf("first fallback asked for %v, want [3 4]", got)
+	}
+	if got := backupAsked(); !slices.Equal(got, []uint64{3, 4}) {
+		t.Errorf("second fallback asked for %v, want [3 4]", got)
+	}
+
+	// A block the primary doesn't have yet isn't looked up elsewhere
+	if _, err := a.GetBlockGasAndTips(t.Context(), 9); !errors.Is(err, errBlockNotFound) {
+		t.Errorf("block 9: error %v, want %v", err, errBlockNotFound)
+	}
+	if got := primaryAsked(); !slices.Contains(got, 9) {
+		t.Errorf("primary asked for %v, want block 9 among them", got)
+	}
+	if got := backupAsked(); slices.Contains(got, 9) {
+		t.Errorf("fallback asked for block 9 after the primary reported it missing")
+	}
+}
+
+func TestRPCTimeout(t *testing.T) {
+	// The first call hangs until the client gives up on it
+	var calls atomic.Int64
+	srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		if calls.Add(1) == 1 {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return testBlock(blockParam(params)), nil
+	})
+	a := newTestAnalyzer(t, srv.URL)
+
+	began := time.Now()
+	if _, err := a.GetBlockGasAndTips(WithRPCTimeout(t.Context(), 50*time.Millisecond), 3); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(began); took > 5*time.Second || calls.Load() != 2 {
+		t.Errorf("took %v over %d calls, want the first to time out and be retried", took, calls.Load())
+	}
+
+	// A timeout longer than the client's has no effect
+	ctx := WithRPCTimeout(t.Context(), time.Hour)
+	if _, err := a.GetBlockGasAndTips(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkGetBlockGasAndTips compares reading a warm 5000-block cache one
+// block at a time against one batched query, as parallelFetcher does
+func BenchmarkGetBlockGasAndTips(b *testing.B) {
+	const from, to = 1, 5000
+	a := newTestAnalyzer(b, "http://127.0.0.1:0", WithMaxRetries(0))
+	seedCache(b, a, testBlocks(from, to))
+	ctx := context.Background()
+
+	b.Run("per-block", func(b *testing.B) {
+		for b.Loop() {
+			for n := uint64(from); n <= to; n++ {
+				if _, err := a.GetBlockGasAndTips(ctx, n); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for b.Loop() {
+			cached, err := a.getCachedBlocks(ctx, from, to)
+			if err != nil || len(cached) != to-from+1 {
+				b.Fatalf("got %d blocks, %v", len(cached), err)
+			}
+		}
+	})
+}
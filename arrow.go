@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// Arrow IPC streaming format, encoded by hand like the protobuf output. See
+// https://arrow.apache.org/docs/format/Columnar.html#serialization-and-interprocess-communication-ipc
+// and Schema.fbs / Message.fbs for the FlatBuffers tables used here.
+
+// arrowColumn is an Arrow output column: non-nullable int64, or utf8 when
+// str is set
+type arrowColumn struct {
+	name  string
+	int64 func(row *exportRow) int64
+	str   func(row *exportRow) string
+}
+
+// arrowColumns returns the columns of a job's Arrow stream, the same as its
+// protobuf fields. Big integers are decimal strings, since Arrow has no
+// unbounded integer type.
+func arrowColumns(opts fetchOptions) []arrowColumn {
+	cols := []arrowColumn{
+		{name: "block_number", int64: func(row *exportRow) int64 { return int64(row.BlockNum) }},
+		{name: "timestamp", int64: func(row *exportRow) int64 { return row.TimeStamp.Unix() }},
+		{name: "gas_used", str: func(row *exportRow) string { return row.GasUsed.String() }},
+		{name: "tips", str: func(row *exportRow) string { return row.Tips.String() }},
+		{name: "base_fee", str: func(row *exportRow) string { return row.BaseFee.String() }},
+		{name: "size_bytes", int64: func(row *exportRow) int64 { return int64(row.Size) }},
+		{name: "tx_count", int64: func(row *exportRow) int64 { return int64(row.TxCount) }},
+	}
+	if opts.Roots {
+		cols = append(cols,
+			arrowColumn{name: "transactions_root", str: func(row *exportRow) string { return row.roots().Transactions }},
+			arrowColumn{name: "state_root", str: func(row *exportRow) string { return row.roots().State }},
+			arrowColumn{name: "receipts_root", str: func(row *exportRow) string { return row.roots().Receipts }},
+		)
+	}
+	if opts.Logs != nil {
+		cols = append(cols, arrowColumn{name: "log_count", int64: func(row *exportRow) int64 { return int64(row.LogCount) }})
+	}
+	if opts.Difficulty {
+		cols = append(cols,
+			arrowColumn{name: "difficulty", str: func(row *exportRow) string { return optionalBig(row.Difficulty) }},
+			arrowColumn{name: "total_difficulty", str: func(row *exportRow) string { return optionalBig(row.TotalDifficulty) }},
+		)
+	}
+	return cols
+}
+
+func arrowColumnNames(opts fetchOptions) []string {
+	cols := arrowColumns(opts)
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.name
+	}
+	return names
+}
+
+// arrowRowWriter emits an Arrow IPC stream: a schema message when the file
+// is created, then one record batch per flush, so memory stays bounded by a
+// batch. It writes no end-of-stream marker; readers stop at end of file, and
+// a resumed job can simply append more record batches.
+type arrowRowWriter struct {
+	w       *bufio.Writer
+	columns []arrowColumn
+	rows    []*exportRow
+	err     error
+}
+
+func newArrowRowWriter(w io.Writer, header bool, opts fetchOptions) rowWriter {
+	a := &arrowRowWriter{w: bufio.NewWriter(w), columns: arrowColumns(opts)}
+	if header {
+		a.writeMessage(a.schemaMessage(), nil)
+	}
+	return a
+}
+
+func (a *arrowRowWriter) Write(row *exportRow) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.rows = append(a.rows, row)
+	return nil
+}
+
+func (a *arrowRowWriter) Flush() error {
+	if a.err == nil && len(a.rows) > 0 {
+		meta, body := a.recordBatch()
+		a.writeMessage(meta, body)
+		a.rows = a.rows[:0]
+	}
+	if a.err != nil {
+		return a.err
+	}
+	return a.w.Flush()
+}
+
+func (a *arrowRowWriter) Close() error { return a.Flush() }
+
+// Arrow metadata constants
+const (
+	arrowMetadataV5         = 4
+	arrowHeaderSchema       = 1
+	arrowHeaderRecordBatch  = 3
+	arrowTypeInt            = 2
+	arrowTypeUtf8           = 5
+	arrowContinuationMarker = 0xFFFFFFFF
+)
+
+// writeMessage writes an encapsulated IPC message: the continuation marker,
+// the metadata length, the metadata padded to 8 bytes, then the body.
+func (a *arrowRowWriter) writeMessage(meta, body []byte) {
+	if a.err != nil {
+		return
+	}
+	meta = padTo8(meta)
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[:4], arrowContinuationMarker)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(meta)))
+	for _, b := range [][]byte{prefix[:], meta, body} {
+		if _, a.err = a.w.Write(b); a.err != nil {
+			return
+		}
+	}
+}
+
+// schemaMessage encodes the Message wrapping the stream's Schema
+func (a *arrowRowWriter) schemaMessage() []byte {
+	b := newFBBuilder()
+	msg := b.table(0, fbInt16(arrowMetadataV5), fbUint8(arrowHeaderSchema), fbRef(), fbInt64(0))
+	schema := b.table(msg[2], fbInt16(0), fbRef()) // little-endian
+	fields := b.offsetVector(schema[1], len(a.columns))
+	for i, col := range a.columns {
+		typeType, typeFields := uint8(arrowTypeInt), []fbField{fbInt32(64), fbUint8(1)} // signed
+		if col.str != nil {
+			typeType, typeFields = arrowTypeUtf8, nil
+		}
+		// name, nullable, type_type, type, dictionary, children
+		field := b.table(fields[i], fbRef(), fbUint8(0), fbUint8(typeType), fbRef(), fbField{}, fbRef())
+		b.string(field[0], col.name)
+		b.table(field[3], typeFields...)
+		b.offsetVector(field[5], 0) // readers require children, even if empty
+	}
+	return b.buf
+}
+
+// recordBatch encodes the buffered rows as a RecordBatch message and its
+// body. Every column is non-null, so validity buffers are empty.
+func (a *arrowRowWriter) recordBatch() (meta, body []byte) {
+	n := len(a.rows)
+	var buffers []byte // Buffer structs: offset, length
+	addBuffer := func(data []byte) {
+		buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(body)))
+		buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(data)))
+		body = padTo8(append(body, data...))
+	}
+	var nodes []byte // FieldNode structs: length, null_count
+	for _, col := range a.columns {
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(n))
+		nodes = binary.LittleEndian.AppendUint64(nodes, 0)
+		addBuffer(nil) // validity
+		if col.str == nil {
+			values := make([]byte, 0, 8*n)
+			for _, row := range a.rows {
+				values = binary.LittleEndian.AppendUint64(values, uint64(col.int64(row)))
+			}
+			addBuffer(values)
+			continue
+		}
+		offsets := make([]byte, 4, 4*(n+1))
+		var data []byte
+		for _, row := range a.rows {
+			data = append(data, col.str(row)...)
+			offsets = binary.LittleEndian.AppendUint32(offsets, uint32(len(data)))
+		}
+		addBuffer(offsets)
+		addBuffer(data)
+	}
+
+	b := newFBBuilder()
+	msg := b.table(0, fbInt16(arrowMetadataV5), fbUint8(arrowHeaderRecordBatch), fbRef(), fbInt64(int64(len(body))))
+	batch := b.table(msg[2], fbInt64(int64(n)), fbRef(), fbRef())
+	b.structVector(batch[1], 16, nodes)
+	b.structVector(batch[2], 16, buffers)
+	return b.buf, body
+}
+
+func padTo8(b []byte) []byte {
+	for len(b)%8 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// fbBuilder lays out a FlatBuffer front to back: each object is written
+// before the objects it points at, so every offset points forward as the
+// format requires. Slots returned for references are patched when the
+// referenced object is written.
+type fbBuilder struct {
+	buf []byte
+}
+
+// newFBBuilder starts a buffer with a slot for the root table offset, 0
+func newFBBuilder() *fbBuilder {
+	return &fbBuilder{buf: make([]byte, 4, 256)}
+}
+
+// fbField is a table field: a little-endian scalar, a reference, or absent
+type fbField struct {
+	scalar []byte
+	ref    bool
+}
+
+func fbUint8(v uint8) fbField { return fbField{scalar: []byte{v}} }
+func fbInt16(v int16) fbField {
+	return fbField{scalar: binary.LittleEndian.AppendUint16(nil, uint16(v))}
+}
+func fbInt32(v int32) fbField {
+	return fbField{scalar: binary.LittleEndian.AppendUint32(nil, uint32(v))}
+}
+func fbInt64(v int64) fbField {
+	return fbField{scalar: binary.LittleEndian.AppendUint64(nil, uint64(v))}
+}
+func fbRef() fbField { return fbField{ref: true} }
+
+func (f fbField) size() int {
+	if f.ref {
+		return 4
+	}
+	return len(f.scalar)
+}
+
+func alignUp(n, align int) int {
+	return (n + align - 1) / align * align
+}
+
+// pad aligns the end of the buffer to align
+func (b *fbBuilder) pad(align int) {
+	for len(b.buf)%align != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+// patch points the offset slot at the end of the buffer
+func (b *fbBuilder) patch(slot int) {
+	binary.LittleEndian.PutUint32(b.buf[slot:], uint32(len(b.buf)-slot))
+}
+
+// table writes a vtable followed by its table, pointing slot at the table.
+// It returns the position of each field, where reference fields are slots.
+func (b *fbBuilder) table(slot int, fields ...fbField) []int {
+	b.pad(2)
+	vtable := len(b.buf)
+	start := alignUp(vtable+4+2*len(fields), 4)
+	pos := make([]int, len(fields))
+	end := start + 4 // past the vtable offset
+	for i, f := range fields {
+		if size := f.size(); size > 0 {
+			end = alignUp(end, size)
+			pos[i] = end
+			end += size
+		}
+	}
+
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(4+2*len(fields)))
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(end-start))
+	for _, p := range pos {
+		if p > 0 {
+			p -= start
+		}
+		b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(p))
+	}
+	b.pad(4)
+	b.patch(slot)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(start-vtable))
+	b.buf = append(b.buf, make([]byte, end-len(b.buf))...)
+	for i, f := range fields {
+		copy(b.buf[pos[i]:], f.scalar)
+	}
+	return pos
+}
+
+// string writes a length-prefixed, NUL-terminated string for slot
+func (b *fbBuilder) string(slot int, s string) {
+	b.pad(4)
+	b.patch(slot)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(s)))
+	b.buf = append(append(b.buf, s...), 0)
+}
+
+// offsetVector writes a vector of n offsets for slot and returns their slots
+func (b *fbBuilder) offsetVector(slot, n int) []int {
+	b.pad(4)
+	b.patch(slot)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(n))
+	slots := make([]int, n)
+	for i := range slots {
+		slots[i] = len(b.buf)
+		b.buf = append(b.buf, 0, 0, 0, 0)
+	}
+	return slots
+}
+
+// structVector writes a vector of 8-byte aligned structs of the given size,
+// already encoded back to back in data, for slot
+func (b *fbBuilder) structVector(slot, size int, data []byte) {
+	// The elements, not the length prefix, must be 8-byte aligned
+	for (len(b.buf)+4)%8 != 0 {
+		b.buf = append(b.buf, 0)
+	}
+	b.patch(slot)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(data)/size))
+	b.buf = append(b.buf, data...)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+)
+
+// fbFieldPos returns the position of field i of the FlatBuffers table at pos,
+// or 0 if the field is absent
+func fbFieldPos(buf []byte, pos, i int) int {
+	vtable := pos - int(int32(binary.LittleEndian.Uint32(buf[pos:])))
+	if 4+2*i >= int(binary.LittleEndian.Uint16(buf[vtable:])) {
+		return 0
+	}
+	off := int(binary.LittleEndian.Uint16(buf[vtable+4+2*i:]))
+	if off == 0 {
+		return 0
+	}
+	return pos + off
+}
+
+// arrowBatch is a record batch read back from an Arrow IPC stream
+type arrowBatch struct {
+	length int64
+	blocks []uint64 // the block_number column
+}
+
+// readArrowStream splits an Arrow IPC stream into its messages, checking
+// that it starts with a schema, and returns its record batches
+func readArrowStream(t *testing.T, data []byte) []arrowBatch {
+	t.Helper()
+	var batches []arrowBatch
+	for i := 0; len(data) > 0; i++ {
+		if len(data) < 8 || binary.LittleEndian.Uint32(data) != arrowContinuationMarker {
+			t.Fatalf("message %d: no continuation marker", i)
+		}
+		metaLen := int(binary.LittleEndian.Uint32(data[4:]))
+		meta := data[8 : 8+metaLen]
+		msg := int(binary.LittleEndian.Uint32(meta))
+		headerType := meta[fbFieldPos(meta, msg, 1)]
+		var bodyLen int
+		if p := fbFieldPos(meta, msg, 3); p != 0 {
+			bodyLen = int(binary.LittleEndian.Uint64(meta[p:]))
+		}
+		body := data[8+metaLen : 8+metaLen+bodyLen]
+		data = data[8+metaLen+bodyLen:]
+
+		if (i == 0) != (headerType == arrowHeaderSchema) {
+			t.Fatalf("message %d has header type %d", i, headerType)
+		}
+		if headerType != arrowHeaderRecordBatch {
+			continue
+		}
+		p := fbFieldPos(meta, msg, 2)
+		batch := p + int(binary.LittleEndian.Uint32(meta[p:]))
+		b := arrowBatch{length: int64(binary.LittleEndian.Uint64(meta[fbFieldPos(meta, batch, 0):]))}
+		// block_number comes first, so its values open the body
+		for j := range b.length {
+			b.blocks = append(b.blocks, binary.LittleEndian.Uint64(body[8*j:]))
+		}
+		batches = append(batches, b)
+	}
+	return batches
+}
+
+func TestArrowExport(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(0, 600))
+	setAnalyzer(t, a)
+
+	job := waitJob(t, submitJob(t, "start=1&end=600&format=arrow"))
+	if job.Status != "done" || job.RowsWritten != 600 {
+		t.Fatalf("status %s (%s), rowsWritten %d", job.Status, job.Error, job.RowsWritten)
+	}
+	data, err := os.ReadFile(job.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last report comes after the writer is closed, so it covers the
+	// trailing batch
+	if job.FlushedBytes != int64(len(data)) {
+		t.Errorf("flushedBytes %d, file has %d", job.FlushedBytes, len(data))
+	}
+	batches := readArrowStream(t, data)
+	var blocks, want []uint64
+	for _, b := range batches {
+		blocks = append(blocks, b.blocks...)
+	}
+	for n := uint64(1); n <= 600; n++ {
+		want = append(want, n)
+	}
+	if len(batches) != 2 || batches[0].length != 500 || batches[1].length != 100 {
+		t.Errorf("got %d record batches %v, want 500 and 100 rows", len(batches), batches)
+	}
+	if !slices.Equal(blocks, want) {
+		t.Errorf("record batches hold blocks %v, want 1 to 600", blocks)
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestArrowCloseError(t *testing.T) {
+	// The schema and row sit in the buffer until Close writes them
+	w := newArrowRowWriter(failingWriter{}, true, fetchOptions{Format: formatArrow})
+	if err := w.Write(placeholderRow(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Close succeeded writing to a failing writer")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// parseTimestamp parses a time given as Unix seconds or RFC3339
+func parseTimestamp(v string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// blockHeader is the part of an eth_getBlockByNumber result used to find
+// blocks by time
+type blockHeader struct {
+	Timestamp string `json:"timestamp"`
+}
+
+// blockTime returns a block's timestamp, fetching it without transactions
+func (a *Analyzer) blockTime(ctx context.Context, blockNum uint64) (time.Time, error) {
+	header, err := rpcCall[*blockHeader](ctx, a, "eth_getBlockByNumber", fmt.Sprintf("0x%x", blockNum), false)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if *header == nil {
+		return time.Time{}, errBlockNotFound
+	}
+	ts, err := hexToUint64((*header).Timestamp)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(ts), 0), nil
+}
+
+// FirstBlockAt returns the first block with a timestamp at or after t,
+// binary searching the chain up to the head: about 25 header fetches on
+// mainnet. When even the head is older than t, ok is false and blockNum is
+// the head plus one.
+func (a *Analyzer) FirstBlockAt(ctx context.Context, t time.Time) (blockNum uint64, ok bool, err error) {
+	head, err := a.HeadBlock(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	// The answer is in [lo, hi], where head+1 means there is none
+	lo, hi := uint64(0), head+1
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		ts, err := a.blockTime(ctx, mid)
+		if err != nil {
+			return 0, false, fmt.Errorf("block %d: %w", mid, err)
+		}
+		if ts.Before(t) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, lo <= head, nil
+}
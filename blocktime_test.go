@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Unix(1700000120, 0)
+	for _, v := range []string{"1700000120", "2023-11-14T22:15:20Z", "2023-11-14T23:15:20+01:00"} {
+		if got, err := parseTimestamp(v); err != nil || !got.Equal(want) {
+			t.Errorf("parseTimestamp(%q) = %v, %v; want %v", v, got, err, want)
+		}
+	}
+	for _, v := range []string{"", "2023-11-14", "1.5"} {
+		if _, err := parseTimestamp(v); err == nil {
+			t.Errorf("parseTimestamp(%q) succeeded", v)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// blockRange is an inclusive range of block numbers
+type blockRange struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// cacheStats describes how contiguous block_cache is
+type cacheStats struct {
+	TotalBlocks  uint64      `json:"totalBlocks"`
+	Ranges       uint64      `json:"ranges"`
+	Gaps         uint64      `json:"gaps"`
+	LargestRange *blockRange `json:"largestRange,omitempty"`
+	ComputedAt   time.Time   `json:"computedAt"`
+}
+
+// cacheIslandsQuery groups cached blocks into contiguous ranges: within a
+// run of consecutive blocks, block_num minus its rank is constant.
+const cacheIslandsQuery = `
+WITH islands AS (
+	SELECT MIN(block_num) AS first, MAX(block_num) AS last, COUNT(*) AS n
+	FROM (SELECT block_num, block_num - ROW_NUMBER() OVER (ORDER BY block_num) AS grp FROM block_cache)
+	GROUP BY grp
+)
+SELECT (SELECT SUM(n) FROM islands), (SELECT COUNT(*) FROM islands), first, last
+FROM islands ORDER BY last - first DESC, first LIMIT 1`
+
+// CacheStats reports the number of cached blocks, the gaps between them and
+// the largest contiguous cached range.
+func (a *Analyzer) CacheStats(ctx context.Context) (*cacheStats, error) {
+	stats := &cacheStats{ComputedAt: time.Now()}
+	var largest blockRange
+	err := a.db.QueryRowContext(ctx, cacheIslandsQuery).Scan(&stats.TotalBlocks, &stats.Ranges, &largest.Start, &largest.End)
+	if err == sql.ErrNoRows {
+		return stats, nil // empty cache
+	}
+	if err != nil {
+		return nil, err
+	}
+	stats.Gaps = stats.Ranges - 1
+	stats.LargestRange = &largest
+	return stats, nil
+}
+
+// cacheRange gives the bounds of block_cache; Contiguous is set when every
+// block between them is cached
+type cacheRange struct {
+	Min        *uint64 `json:"min,omitempty"`
+	Max        *uint64 `json:"max,omitempty"`
+	Blocks     uint64  `json:"blocks"`
+	Contiguous bool    `json:"contiguous"`
+}
+
+// CacheRange reports the lowest and highest cached blocks, comparing the
+// row count against the span between them to tell whether it has gaps.
+// Unlike CacheStats it needs no window function, so it is cheap to poll.
+func (a *Analyzer) CacheRange(ctx context.Context) (*cacheRange, error) {
+	var lo, hi sql.NullInt64
+	res := &cacheRange{}
+	err := a.db.QueryRowContext(ctx, `SELECT MIN(block_num), MAX(block_num), COUNT(*) FROM block_cache`).Scan(&lo, &hi, &res.Blocks)
+	if err != nil {
+		return nil, err
+	}
+	if !lo.Valid {
+		return res, nil // empty cache
+	}
+	minBlock, maxBlock := uint64(lo.Int64), uint64(hi.Int64)
+	res.Min, res.Max = &minBlock, &maxBlock
+	res.Contiguous = res.Blocks == maxBlock-minBlock+1
+	return res, nil
+}
+
+// cacheReport holds the latest periodic cache stats
+var cacheReport struct {
+	sync.Mutex
+	stats *cacheStats
+}
+
+// reportCacheStats recomputes the cache stats every interval, logging them
+// and keeping the latest for /cache/stats.
+func reportCacheStats(analyzer *Analyzer, interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		stats, err := analyzer.CacheStats(context.Background())
+		if err != nil {
+			log.Printf("Cache stats failed: %v", err)
+			continue
+		}
+		if stats.LargestRange != nil {
+			log.Printf("Cache: %d blocks in %d ranges (%d gaps), largest %d-%d",
+				stats.TotalBlocks, stats.Ranges, stats.Gaps, stats.LargestRange.Start, stats.LargestRange.End)
+		} else {
+			log.Printf("Cache: empty")
+		}
+		cacheReport.Lock()
+		cacheReport.stats = stats
+		cacheReport.Unlock()
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleCacheStats(t *testing.T) {
+	a := newTestAnalyzer(t, "")
+	setAnalyzer(t, a)
+	get := func() cacheStats {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleCacheStats(rec, httptest.NewRequest("GET", "/cache/stats", nil))
+		var stats cacheStats
+		if err := json.Unmarshal(rec.Body.Bytes(), &stats); rec.Code != 200 || err != nil {
+			t.Fatalf("GET /cache/stats = %d %s", rec.Code, rec.Body)
+		}
+		return stats
+	}
+
+	if stats := get(); stats.TotalBlocks != 0 || stats.Ranges != 0 || stats.LargestRange != nil {
+		t.Errorf("empty cache stats = %+v", stats)
+	}
+
+	// Ranges 10-12, 20-29 and 40
+	seedCache(t, a, testBlocks(10, 12))
+	seedCache(t, a, testBlocks(20, 29))
+	seedCache(t, a, testBlocks(40, 40))
+	stats := get()
+	if stats.TotalBlocks != 14 || stats.Ranges != 3 || stats.Gaps != 2 || stats.LargestRange == nil || *stats.LargestRange != (blockRange{20, 29}) {
+		t.Errorf("stats = %+v, largest %v; want 14 blocks in 3 ranges, largest 20-29", stats, stats.LargestRange)
+	}
+
+	// A periodic report is served as is
+	cacheReport.Lock()
+	cacheReport.stats = &cacheStats{TotalBlocks: 1}
+	cacheReport.Unlock()
+	defer func() {
+		cacheReport.Lock()
+		cacheReport.stats = nil
+		cacheReport.Unlock()
+	}()
+	if stats := get(); stats.TotalBlocks != 1 {
+		t.Errorf("stats = %+v, want the periodic report", stats)
+	}
+}
+
+func TestHandleCacheRange(t *testing.T) {
+	a := newTestAnalyzer(t, "")
+	setAnalyzer(t, a)
+	get := func() string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleCacheRange(rec, httptest.NewRequest("GET", "/cache/range", nil))
+		if rec.Code != 200 {
+			t.Fatalf("GET /cache/range = %d %s", rec.Code, rec.Body)
+		}
+		return strings.TrimSpace(rec.Body.String())
+	}
+	tests := []struct {
+		seed []*rpcBlock
+		want string
+	}{
+		{want: `{"blocks":0,"contiguous":false}`},
+		{seed: testBlocks(10, 12), want: `{"min":10,"max":12,"blocks":3,"contiguous":true}`},
+		{seed: testBlocks(20, 21), want: `{"min":10,"max":21,"blocks":5,"contiguous":false}`},
+		{seed: testBlocks(13, 19), want: `{"min":10,"max":21,"blocks":12,"contiguous":true}`},
+	}
+	for _, tt := range tests {
+		seedCache(t, a, tt.seed)
+		if got := get(); got != tt.want {
+			t.Errorf("GET /cache/range = %s, want %s", got, tt.want)
+		}
+	}
+}
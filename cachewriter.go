@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// writeBehindBatch caps how many queued blocks go into one transaction
+const writeBehindBatch = 500
+
+// writeBehind queues fetched blocks for a background goroutine that writes
+// them to the cache in batches, taking inserts off the fetch path.
+type writeBehind struct {
+	queue  chan *BlockResult
+	mu     sync.RWMutex // held for writing only while closing queue
+	closed bool
+	done   chan struct{}
+}
+
+// WithWriteBehind buffers up to size cache inserts and writes them in the
+// background. Call Close to flush the buffer before exiting.
+func WithWriteBehind(size int) AnalyzerOption {
+	return func(a *Analyzer) {
+		a.writeBehind = &writeBehind{
+			queue: make(chan *BlockResult, size),
+			done:  make(chan struct{}),
+		}
+	}
+}
+
+// cacheBlock saves a fetched block, through the write-behind buffer if one is
+// configured and still open.
+func (a *Analyzer) cacheBlock(result *BlockResult) {
+	if wb := a.writeBehind; wb != nil {
+		wb.mu.RLock()
+		if !wb.closed {
+			wb.queue <- result
+			wb.mu.RUnlock()
+			return
+		}
+		wb.mu.RUnlock()
+	}
+	a.insertCacheRows([]*BlockResult{result})
+}
+
+func (a *Analyzer) runWriteBehind() {
+	wb := a.writeBehind
+	defer close(wb.done)
+	batch := make([]*BlockResult, 0, writeBehindBatch)
+	for result := range wb.queue {
+		batch = append(batch[:0], result)
+		// Take whatever else is already queued
+	drain:
+		for len(batch) < writeBehindBatch {
+			select {
+			case result, ok := <-wb.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, result)
+			default:
+				break drain
+			}
+		}
+		a.insertCacheRows(batch)
+	}
+}
+
+// upsertCacheRow inserts a block_cache row, or updates it only if a value
+// differs, so revalidating a block that hasn't changed writes nothing.
+const upsertCacheRow = `
+INSERT INTO block_cache (block_num, timestamp, gas_used, total_tips, base_fee, size, tx_count, transactions_root, state_root, receipts_root, difficulty, total_difficulty, miner)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (block_num) DO UPDATE SET
+	timestamp = excluded.timestamp, gas_used = excluded.gas_used, total_tips = excluded.total_tips,
+	base_fee = excluded.base_fee, size = excluded.size, tx_count = excluded.tx_count,
+	transactions_root = excluded.transactions_root, state_root = excluded.state_root, receipts_root = excluded.receipts_root,
+	difficulty = excluded.difficulty, total_difficulty = excluded.total_difficulty, miner = excluded.miner
+WHERE (timestamp, gas_used, total_tips, base_fee, size, tx_count, transactions_root, state_root, receipts_root, difficulty, total_difficulty, miner)
+	IS NOT (excluded.timestamp, excluded.gas_used, excluded.total_tips, excluded.base_fee, excluded.size, excluded.tx_count,
+	excluded.transactions_root, excluded.state_root, excluded.receipts_root, excluded.difficulty, excluded.total_difficulty, excluded.miner)`
+
+// insertCacheRows writes results to block_cache in a single transaction,
+// counting rows written and rows confirmed unchanged
+func (a *Analyzer) insertCacheRows(results []*BlockResult) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		a.cacheError("Cache insert error", err)
+		return
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(upsertCacheRow)
+	if err != nil {
+		a.cacheError("Cache insert error", err)
+		return
+	}
+	defer stmt.Close()
+	var written, unchanged uint64
+	for _, r := range results {
+		roots := (&exportRow{BlockResult: r}).roots()
+		var difficulty, totalDifficulty sql.NullString
+		if r.Difficulty != nil {
+			difficulty = sql.NullString{String: fmt.Sprintf("0x%x", r.Difficulty), Valid: true}
+			totalDifficulty.Valid = true // empty when the provider omitted it
+			if r.TotalDifficulty != nil {
+				totalDifficulty.String = fmt.Sprintf("0x%x", r.TotalDifficulty)
+			}
+		}
+		res, err := stmt.Exec(r.BlockNum, r.TimeStamp.Unix(), fmt.Sprintf("0x%x", r.GasUsed), fmt.Sprintf("0x%x", r.Tips), fmt.Sprintf("0x%x", r.BaseFee), int64(r.Size), int64(r.TxCount),
+			roots.Transactions, roots.State, roots.Receipts, difficulty, totalDifficulty, sql.NullString{String: r.Miner, Valid: r.Miner != ""})
+		if err != nil {
+			a.cacheError("Cache insert error", err)
+			return
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			unchanged++
+		} else {
+			written++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		a.cacheError("Cache insert error", err)
+		return
+	}
+	a.cacheWritten.Add(written)
+	a.cacheUnchanged.Add(unchanged)
+}
+
+// Close flushes any buffered cache writes and closes the cache database.
+// Blocks fetched afterwards are no longer cached.
+func (a *Analyzer) Close() error {
+	if wb := a.writeBehind; wb != nil {
+		wb.mu.Lock()
+		if !wb.closed {
+			wb.closed = true
+			close(wb.queue)
+		}
+		wb.mu.Unlock()
+		<-wb.done
+	}
+	return a.db.Close()
+}
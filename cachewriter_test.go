@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestWriteBehind(t *testing.T) {
+	fixture, _ := newFixtureAnalyzer(t, testBlocks(1, 50))
+	dbPath := "file:" + filepath.Join(t.TempDir(), "cache.db") + "?_sync=OFF"
+	a := NewAnalyzer("", dbPath, WithWriteBehind(4))
+	a.alchURL = fixture.alchURL
+	a.limiter = rate.NewLimiter(rate.Inf, 0)
+
+	// More blocks than the buffer holds, so fetches wait on the writer
+	var wg sync.WaitGroup
+	for n := uint64(1); n <= 50; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := a.fetchBlock(t.Context(), n); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything buffered was flushed by Close
+	reopened := NewAnalyzer("", dbPath)
+	defer reopened.db.Close()
+	cached, err := reopened.getCachedBlocks(t.Context(), 1, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != 50 {
+		t.Fatalf("cached %d blocks, want 50", len(cached))
+	}
+	for n, r := range cached {
+		want, _ := fixture.fetchBlock(t.Context(), n)
+		if r.Tips.Cmp(want.Tips) != 0 || r.GasUsed.Cmp(want.GasUsed) != 0 || r.BaseFee.Cmp(want.BaseFee) != 0 ||
+			r.Size != want.Size || !r.TimeStamp.Equal(want.TimeStamp) || r.Roots == nil || *r.Roots != *want.Roots {
+			t.Errorf("cached block %d = %+v, want %+v", n, r, want)
+		}
+	}
+}
+
+func TestCacheUnchangedRows(t *testing.T) {
+	a, _ := newFixtureAnalyzer(t, nil)
+	setAnalyzer(t, a)
+	results := make([]*BlockResult, 0, 4)
+	for i, block := range testBlocks(1, 4) {
+		r, err := a.parseBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.BlockNum = uint64(i + 1)
+		results = append(results, r)
+	}
+	metrics := func() (written, unchanged uint64) {
+		rec := httptest.NewRecorder()
+		handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+		var res struct {
+			CacheWrites struct{ Written, Unchanged uint64 }
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res.CacheWrites.Written, res.CacheWrites.Unchanged
+	}
+
+	a.insertCacheRows(results)
+	if w, u := metrics(); w != 4 || u != 0 {
+		t.Errorf("first insert: %d written, %d unchanged; want 4, 0", w, u)
+	}
+	// Refetching the same blocks rewrites nothing, and a changed block
+	// replaces its row
+	results[2].Tips = big.NewInt(7)
+	a.insertCacheRows(results)
+	if w, u := metrics(); w != 5 || u != 3 {
+		t.Errorf("second insert: %d written, %d unchanged; want 5, 3", w, u)
+	}
+	cached, err := a.getCachedBlocks(t.Context(), 3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := cached[3]; !ok || r.Tips.Int64() != 7 {
+		t.Errorf("block 3 cached as %+v, want the changed tips", r)
+	}
+}
@@ -0,0 +1,809 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	_ "embed"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//go:embed block_metrics.proto
+var blockMetricsProto []byte
+
+// exportRow is a block on the ordered write path together with the values
+// derived from its predecessors. Derived values are nil unless opted in.
+type exportRow struct {
+	*BlockResult
+	BaseFeeDelta *big.Int
+	LogCount     uint64 // only with a log filter
+	// GasByType is only set with gasByType, and nil for placeholder rows
+	GasByType *gasByType
+	// TipsMovingAvg is the mean tips of the window ending at this block;
+	// nil without a window and for placeholder rows
+	TipsMovingAvg *big.Rat
+	// GasUsedChange is the percent change in gas used from the previous
+	// block; nil when there is none or it used no gas
+	GasUsedChange *big.Rat
+	// CumulativeGasUsed is the gas used of the rows written so far,
+	// including this one; only set with cumulativeGas
+	CumulativeGasUsed *big.Int
+}
+
+// pctChange is the percent change from prev to cur, or nil if prev is nil
+// or zero
+func pctChange(prev, cur *big.Int) *big.Rat {
+	if prev == nil || prev.Sign() == 0 {
+		return nil
+	}
+	change := new(big.Rat).SetFrac(new(big.Int).Sub(cur, prev), prev)
+	return change.Mul(change, big.NewRat(100, 1))
+}
+
+// maxGweiBounds bounds the boundaries given in gasPriceBuckets or
+// priorityFeeBuckets
+const maxGweiBounds = 20
+
+// parseGweiBounds parses ascending gwei boundaries such as "10,50,100" into
+// wei. Fractions of a gwei are allowed down to the wei.
+func parseGweiBounds(v string) ([]*big.Int, error) {
+	parts := strings.Split(v, ",")
+	if len(parts) > maxGweiBounds {
+		return nil, fmt.Errorf("at most %d boundaries", maxGweiBounds)
+	}
+	bounds := make([]*big.Int, len(parts))
+	for i, part := range parts {
+		gwei, ok := new(big.Rat).SetString(strings.TrimSpace(part))
+		if !ok || gwei.Sign() <= 0 || strings.ContainsAny(part, "/eE") {
+			return nil, fmt.Errorf("invalid boundary %q", part)
+		}
+		wei := gwei.Mul(gwei, new(big.Rat).SetInt(weiPerGwei))
+		if !wei.IsInt() {
+			return nil, fmt.Errorf("boundary %q is finer than a wei", part)
+		}
+		bounds[i] = new(big.Int).Set(wei.Num())
+		if i > 0 && bounds[i].Cmp(bounds[i-1]) <= 0 {
+			return nil, fmt.Errorf("boundaries must be ascending")
+		}
+	}
+	return bounds, nil
+}
+
+// gweiBucketLabels names the buckets between the wei bounds, plus the one
+// below the first and the one from the last, e.g. lt_10, 10_50, ge_50.
+// Buckets include their lower bound.
+func gweiBucketLabels(bounds []*big.Int) []string {
+	labels := make([]string, len(bounds)+1)
+	for i := range labels {
+		switch {
+		case i == 0:
+			labels[i] = "lt_" + formatGwei(bounds[0])
+		case i == len(bounds):
+			labels[i] = "ge_" + formatGwei(bounds[i-1])
+		default:
+			labels[i] = formatGwei(bounds[i-1]) + "_" + formatGwei(bounds[i])
+		}
+	}
+	return labels
+}
+
+// gweiBucketCounts counts the wei values in each bucket of the bounds, after
+// subtracting offset when it is set
+func gweiBucketCounts(bounds, values []*big.Int, offset *big.Int) []uint64 {
+	counts := make([]uint64, len(bounds)+1)
+	v := new(big.Int)
+	for _, value := range values {
+		v.Set(value)
+		if offset != nil {
+			v.Sub(v, offset)
+		}
+		// The bucket is the number of bounds at or below v
+		counts[sort.Search(len(bounds), func(i int) bool { return bounds[i].Cmp(v) > 0 })]++
+	}
+	return counts
+}
+
+// gasPriceBucketColumns returns a column per gas price bucket, named like
+// txs_10_50_gwei, counting the block's transactions whose effective gas
+// price falls in it.
+func gasPriceBucketColumns(bounds []*big.Int) []csvColumn {
+	if len(bounds) == 0 {
+		return nil
+	}
+	cols := make([]csvColumn, 0, len(bounds)+1)
+	for i, label := range gweiBucketLabels(bounds) {
+		cols = append(cols, csvColumn{"txs_" + label + "_gwei", func(row *exportRow) string {
+			return strconv.FormatUint(gweiBucketCounts(bounds, row.GasPrices, nil)[i], 10)
+		}})
+	}
+	return cols
+}
+
+// formatGwei renders wei in gwei without trailing zeros, e.g. 0.5 or 10
+func formatGwei(wei *big.Int) string {
+	s := new(big.Rat).SetFrac(wei, weiPerGwei).FloatString(9)
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+// maxMovingAvgWindow bounds movingAvgWindow, which is held in memory
+const maxMovingAvgWindow = 10000
+
+// movingAverage is a sliding window over the tips of the last n blocks
+type movingAverage struct {
+	window []*big.Int
+	next   int
+	sum    *big.Int
+}
+
+func newMovingAverage(n int) *movingAverage {
+	return &movingAverage{window: make([]*big.Int, 0, n), sum: new(big.Int)}
+}
+
+// Add slides v into the window and returns the new average. Until the
+// window is full it averages the blocks seen so far.
+func (m *movingAverage) Add(v *big.Int) *big.Rat {
+	if len(m.window) < cap(m.window) {
+		m.window = append(m.window, v)
+	} else {
+		m.sum.Sub(m.sum, m.window[m.next])
+		m.window[m.next] = v
+		m.next = (m.next + 1) % len(m.window)
+	}
+	m.sum.Add(m.sum, v)
+	return new(big.Rat).SetFrac(m.sum, big.NewInt(int64(len(m.window))))
+}
+
+// roots returns the row's header roots, empty for placeholder rows
+func (row *exportRow) roots() blockRoots {
+	if row.Roots == nil {
+		return blockRoots{}
+	}
+	return *row.Roots
+}
+
+// gzipRowWriter compresses another row writer's output, flushing the gzip
+// stream along with it so every flush ends on a complete row.
+type gzipRowWriter struct {
+	rowWriter
+	gz *gzip.Writer
+}
+
+func (g *gzipRowWriter) Flush() error {
+	if err := g.rowWriter.Flush(); err != nil {
+		return err
+	}
+	return g.gz.Flush()
+}
+
+// Close ends the gzip stream after the rows held back by the wrapped writer
+func (g *gzipRowWriter) Close() error {
+	if err := g.rowWriter.Close(); err != nil {
+		return err
+	}
+	return g.gz.Close()
+}
+
+// rowWriter encodes export rows in one output format. Implementations write
+// any header on construction, unless appending, and buffer until Flush.
+// Close writes anything held back for later rows, then flushes.
+type rowWriter interface {
+	Write(row *exportRow) error
+	Flush() error
+	Close() error
+}
+
+type outputFormat struct {
+	ext         string
+	contentType string
+	columns     func(opts fetchOptions) []string
+	newWriter   func(w io.Writer, header bool, opts fetchOptions) rowWriter
+}
+
+const (
+	formatCSV      = "csv"
+	formatProtobuf = "protobuf"
+	formatArrow    = "arrow"
+	formatNDJSON   = "ndjson"
+)
+
+var outputFormats = map[string]outputFormat{
+	formatCSV: {
+		ext:         "csv",
+		contentType: "text/csv",
+		columns:     csvColumnNames,
+		newWriter:   newCSVRowWriter,
+	},
+	formatProtobuf: {
+		ext:         "pb",
+		contentType: "application/x-protobuf; delimited=true",
+		columns:     protobufColumns,
+		newWriter:   newProtobufRowWriter,
+	},
+	formatArrow: {
+		ext:         "arrows",
+		contentType: "application/vnd.apache.arrow.stream",
+		columns:     arrowColumnNames,
+		newWriter:   newArrowRowWriter,
+	},
+	formatNDJSON: {
+		ext:         "ndjson",
+		contentType: "application/x-ndjson",
+		columns:     ndjsonColumnNames,
+		newWriter:   newNDJSONRowWriter,
+	},
+}
+
+// csvColumn is an output column and how to render it for a row
+type csvColumn struct {
+	name  string
+	value func(row *exportRow) string
+}
+
+var defaultCSVColumns = []csvColumn{
+	{"block_number", func(row *exportRow) string { return strconv.FormatUint(row.BlockNum, 10) }},
+	{"timestamp", func(row *exportRow) string { return strconv.FormatInt(row.TimeStamp.Unix(), 10) }},
+	{"gas_used", func(row *exportRow) string { return row.GasUsed.String() }},
+	{"tips", func(row *exportRow) string { return row.Tips.String() }},
+}
+
+// csvColumnsFor returns the columns of a job's CSV: its selected fields in
+// the order given, or every available column.
+func csvColumnsFor(opts fetchOptions) []csvColumn {
+	cols := availableCSVColumns(opts)
+	if opts.Fields == nil {
+		return cols
+	}
+	selected := make([]csvColumn, 0, len(opts.Fields))
+	for _, name := range opts.Fields {
+		if i := slices.IndexFunc(cols, func(col csvColumn) bool { return col.name == name }); i >= 0 {
+			selected = append(selected, cols[i])
+		}
+	}
+	return selected
+}
+
+// validateFields checks that opts.Fields names only columns available with
+// opts, each at most once.
+func validateFields(opts fetchOptions) error {
+	cols := availableCSVColumns(opts)
+	seen := make(map[string]bool, len(opts.Fields))
+	for _, name := range opts.Fields {
+		if seen[name] {
+			return fmt.Errorf("duplicate field %q", name)
+		}
+		seen[name] = true
+		if !slices.ContainsFunc(cols, func(col csvColumn) bool { return col.name == name }) {
+			return fmt.Errorf("field %q is unknown or not enabled", name)
+		}
+	}
+	return nil
+}
+
+// availableCSVColumns returns every column a job with opts can emit, in the
+// canonical order: the defaults followed by any opt-in columns.
+func availableCSVColumns(opts fetchOptions) []csvColumn {
+	cols := slices.Clone(defaultCSVColumns)
+	if opts.Units == unitsEther {
+		i := slices.IndexFunc(cols, func(col csvColumn) bool { return col.name == "tips" })
+		cols[i] = csvColumn{"tips_eth", func(row *exportRow) string { return weiToEther(row.Tips) }}
+	}
+	if opts.BaseFeeDelta {
+		cols = append(cols, csvColumn{"base_fee_delta", func(row *exportRow) string {
+			if row.BaseFeeDelta == nil {
+				return "" // the block before it failed
+			}
+			return row.BaseFeeDelta.String()
+		}})
+	}
+	if opts.BlockSize {
+		cols = append(cols, csvColumn{"block_size_bytes", func(row *exportRow) string { return strconv.FormatUint(row.Size, 10) }})
+	}
+	if opts.AvgTipPerGas {
+		cols = append(cols, csvColumn{"avg_tip_per_gas_gwei", func(row *exportRow) string { return avgTipPerGasGwei(row.Tips, row.GasUsed) }})
+	}
+	if opts.TxCount {
+		cols = append(cols, csvColumn{"tx_count", func(row *exportRow) string { return strconv.FormatUint(row.TxCount, 10) }})
+	}
+	if opts.GasUsedPctChange {
+		cols = append(cols, csvColumn{"gas_used_pct_change", func(row *exportRow) string {
+			if row.GasUsedChange == nil {
+				return ""
+			}
+			return row.GasUsedChange.FloatString(2)
+		}})
+	}
+	if opts.BaseFee {
+		cols = append(cols, csvColumn{"base_fee", func(row *exportRow) string { return optionalBig(row.BaseFee) }})
+	}
+	if opts.TimestampFormat == timestampRFC3339 {
+		i := slices.IndexFunc(cols, func(col csvColumn) bool { return col.name == "timestamp" })
+		cols[i] = csvColumn{"timestamp", func(row *exportRow) string { return row.TimeStamp.UTC().Format(time.RFC3339) }}
+	}
+	if opts.USDPrice != nil {
+		price, _ := new(big.Rat).SetString(opts.USDPrice.Price)
+		cols = append(cols, csvColumn{"tips_usd", func(row *exportRow) string { return tipsUSD(row.Tips, price) }})
+	}
+	if opts.TimeBuckets {
+		cols = append(cols,
+			csvColumn{"utc_date", func(row *exportRow) string { return row.TimeStamp.UTC().Format(time.DateOnly) }},
+			csvColumn{"utc_hour", func(row *exportRow) string { return strconv.Itoa(row.TimeStamp.UTC().Hour()) }},
+			csvColumn{"utc_iso_week", func(row *exportRow) string { return isoWeek(row.TimeStamp) }},
+		)
+	}
+	if opts.MovingAvgWindow > 0 {
+		if opts.Units == unitsEther {
+			cols = append(cols, csvColumn{"tips_moving_avg_eth", func(row *exportRow) string {
+				if row.TipsMovingAvg == nil {
+					return ""
+				}
+				return new(big.Rat).Quo(row.TipsMovingAvg, new(big.Rat).SetInt(weiPerEther)).FloatString(18)
+			}})
+		} else {
+			cols = append(cols, csvColumn{"tips_moving_avg", func(row *exportRow) string {
+				if row.TipsMovingAvg == nil {
+					return ""
+				}
+				return row.TipsMovingAvg.FloatString(0)
+			}})
+		}
+	}
+	if opts.CumulativeGas {
+		cols = append(cols, csvColumn{"cumulative_gas_used", func(row *exportRow) string { return optionalBig(row.CumulativeGasUsed) }})
+	}
+	cols = append(cols, gasPriceBucketColumns(opts.GasPriceBuckets)...)
+	if opts.GasByType {
+		split := func(row *exportRow) gasByType {
+			if row.GasByType == nil {
+				return gasByType{}
+			}
+			return *row.GasByType
+		}
+		cols = append(cols,
+			csvColumn{"gas_used_legacy", func(row *exportRow) string { return optionalBig(split(row).Legacy) }},
+			csvColumn{"gas_used_1559", func(row *exportRow) string { return optionalBig(split(row).EIP1559) }},
+			csvColumn{"gas_used_blob", func(row *exportRow) string { return optionalBig(split(row).Blob) }},
+		)
+	}
+	if opts.Logs != nil {
+		cols = append(cols, csvColumn{"log_count", func(row *exportRow) string { return strconv.FormatUint(row.LogCount, 10) }})
+	}
+	if opts.Roots {
+		cols = append(cols,
+			csvColumn{"transactions_root", func(row *exportRow) string { return row.roots().Transactions }},
+			csvColumn{"state_root", func(row *exportRow) string { return row.roots().State }},
+			csvColumn{"receipts_root", func(row *exportRow) string { return row.roots().Receipts }},
+		)
+	}
+	if opts.Difficulty {
+		cols = append(cols,
+			csvColumn{"difficulty", func(row *exportRow) string { return optionalBig(row.Difficulty) }},
+			csvColumn{"total_difficulty", func(row *exportRow) string { return optionalBig(row.TotalDifficulty) }},
+		)
+	}
+	return cols
+}
+
+// isoWeek formats the ISO 8601 week of t in UTC, e.g. 2025-W07
+func isoWeek(t time.Time) string {
+	year, week := t.UTC().ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week)
+}
+
+func csvColumnNames(opts fetchOptions) []string {
+	if opts.Rollup != "" {
+		return rollupColumns
+	}
+	cols := csvColumnsFor(opts)
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.name
+	}
+	return names
+}
+
+// CSV line endings; csv.Writer defaults to LF
+const (
+	lineEndingLF   = "lf"
+	lineEndingCRLF = "crlf"
+)
+
+// newCSVWriter returns a csv.Writer ending lines as opts asks
+func newCSVWriter(w io.Writer, opts fetchOptions) *csv.Writer {
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = opts.LineEnding == lineEndingCRLF
+	return cw
+}
+
+type csvRowWriter struct {
+	w       *csv.Writer
+	columns []csvColumn
+	record  []string
+}
+
+func newCSVRowWriter(w io.Writer, header bool, opts fetchOptions) rowWriter {
+	if opts.Rollup != "" {
+		return newRollupRowWriter(w, header, opts)
+	}
+	c := &csvRowWriter{w: newCSVWriter(w, opts), columns: csvColumnsFor(opts)}
+	c.record = make([]string, len(c.columns))
+	if header {
+		c.w.Write(csvColumnNames(opts))
+	}
+	return c
+}
+
+func (c *csvRowWriter) Write(row *exportRow) error {
+	for i, col := range c.columns {
+		c.record[i] = col.value(row)
+	}
+	return c.w.Write(c.record)
+}
+
+var weiPerGwei = big.NewInt(1_000_000_000)
+
+// avgTipPerGasGwei is the gas-weighted average priority fee of a block in
+// gwei, exact to the wei. Empty blocks report 0.
+func avgTipPerGasGwei(tips, gasUsed *big.Int) string {
+	if gasUsed.Sign() == 0 {
+		return "0"
+	}
+	avg := new(big.Rat).SetFrac(tips, new(big.Int).Mul(gasUsed, weiPerGwei))
+	return avg.FloatString(9)
+}
+
+// optionalBig renders n in decimal, or empty if it is nil
+func optionalBig(n *big.Int) string {
+	if n == nil {
+		return ""
+	}
+	return n.String()
+}
+
+var weiPerEther = new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+
+// weiToEther renders a wei amount as an exact decimal ETH string with all 18
+// decimals, so every value has the same scale.
+func weiToEther(wei *big.Int) string {
+	return new(big.Rat).SetFrac(wei, weiPerEther).FloatString(18)
+}
+
+// tipsUSD converts tips in wei to US dollars at price USD per ETH, rounded to
+// cents.
+func tipsUSD(tips *big.Int, price *big.Rat) string {
+	usd := new(big.Rat).SetFrac(tips, weiPerEther)
+	return usd.Mul(usd, price).FloatString(2)
+}
+
+func (c *csvRowWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvRowWriter) Close() error { return c.Flush() }
+
+// protobufRowWriter emits varint length-delimited BlockMetrics messages as
+// described by block_metrics.proto.
+type protobufRowWriter struct {
+	w          *bufio.Writer
+	roots      bool
+	logs       bool
+	difficulty bool
+	buf        []byte
+	err        error
+}
+
+// protobufColumns are the BlockMetrics fields set for opts
+func protobufColumns(opts fetchOptions) []string {
+	cols := []string{"block_number", "timestamp", "gas_used", "tips", "base_fee", "size_bytes", "tx_count"}
+	if opts.Roots {
+		cols = append(cols, "transactions_root", "state_root", "receipts_root")
+	}
+	if opts.Logs != nil {
+		cols = append(cols, "log_count")
+	}
+	if opts.Difficulty {
+		cols = append(cols, "difficulty", "total_difficulty")
+	}
+	return cols
+}
+
+func newProtobufRowWriter(w io.Writer, _ bool, opts fetchOptions) rowWriter {
+	return &protobufRowWriter{w: bufio.NewWriter(w), roots: opts.Roots, logs: opts.Logs != nil, difficulty: opts.Difficulty}
+}
+
+func (p *protobufRowWriter) Write(row *exportRow) error {
+	if p.err != nil {
+		return p.err
+	}
+	msg := p.buf[:0]
+	msg = appendVarintField(msg, 1, row.BlockNum)
+	msg = appendVarintField(msg, 2, uint64(row.TimeStamp.Unix()))
+	msg = appendBytesField(msg, 3, row.GasUsed.Bytes())
+	msg = appendBytesField(msg, 4, row.Tips.Bytes())
+	msg = appendBytesField(msg, 5, row.BaseFee.Bytes())
+	msg = appendVarintField(msg, 6, row.Size)
+	if p.roots {
+		roots := row.roots()
+		msg = appendBytesField(msg, 7, hashBytes(roots.Transactions))
+		msg = appendBytesField(msg, 8, hashBytes(roots.State))
+		msg = appendBytesField(msg, 9, hashBytes(roots.Receipts))
+	}
+	if p.logs {
+		msg = appendVarintField(msg, 10, row.LogCount)
+	}
+	msg = appendVarintField(msg, 11, row.TxCount)
+	if p.difficulty {
+		if row.Difficulty != nil {
+			msg = appendBytesField(msg, 12, row.Difficulty.Bytes())
+		}
+		if row.TotalDifficulty != nil {
+			msg = appendBytesField(msg, 13, row.TotalDifficulty.Bytes())
+		}
+	}
+	p.buf = msg
+
+	_, p.err = p.w.Write(binary.AppendUvarint(nil, uint64(len(msg))))
+	if p.err == nil {
+		_, p.err = p.w.Write(msg)
+	}
+	return p.err
+}
+
+func (p *protobufRowWriter) Flush() error {
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
+
+func (p *protobufRowWriter) Close() error { return p.Flush() }
+
+// hashBytes decodes a 0x-prefixed hex hash, or returns nil if it isn't one
+func hashBytes(h string) []byte {
+	b, err := hex.DecodeString(strings.TrimPrefix(h, "0x"))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// Protobuf wire types
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b // proto3 omits default values
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// blockRecord is the JSON shape of a single block's metrics. Big integers are
+// kept as decimal strings since gas and tips routinely exceed 64 bits.
+type blockRecord struct {
+	BlockNumber uint64 `json:"block_number"`
+	Timestamp   int64  `json:"timestamp"`
+	GasUsed     string `json:"gas_used"`
+	Tips        string `json:"tips"`
+	BaseFee     string `json:"base_fee"`
+	Size        uint64 `json:"block_size_bytes"`
+	TxCount     uint64 `json:"tx_count"`
+}
+
+func newBlockRecord(r *BlockResult) blockRecord {
+	return blockRecord{
+		BlockNumber: r.BlockNum,
+		Timestamp:   r.TimeStamp.Unix(),
+		GasUsed:     r.GasUsed.String(),
+		Tips:        r.Tips.String(),
+		BaseFee:     r.BaseFee.String(),
+		Size:        r.Size,
+		TxCount:     r.TxCount,
+	}
+}
+
+// writeArchive streams the metrics of blocks [start, end] as zstd-compressed
+// NDJSON. Blocks are served from the cache where possible and fetched
+// otherwise; only the encoder window is held in memory.
+func writeArchive(ctx context.Context, analyzer *Analyzer, start, end uint64, w io.Writer) error {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(zw)
+	for bn := start; bn <= end; bn++ {
+		result, err := analyzer.GetBlockGasAndTips(ctx, bn)
+		if err != nil {
+			zw.Close()
+			return fmt.Errorf("block %d: %w", bn, err)
+		}
+		if err := enc.Encode(newBlockRecord(result)); err != nil {
+			zw.Close()
+			return err
+		}
+		if bn == end {
+			break // avoid wraparound at the uint64 maximum
+		}
+	}
+	return zw.Close()
+}
+
+// lastCumulativeGasUsed reads the running gas total from the last complete
+// row of a job's CSV at or before lastWritten, so a resumed job carries it
+// on. It is 0 if there is no such row or it doesn't have the column.
+func lastCumulativeGasUsed(path string, lastWritten uint64) (*big.Int, error) {
+	rows, err := previewRows(path, lastWritten, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 || rows[0]["cumulative_gas_used"] == "" {
+		return new(big.Int), nil
+	}
+	total, ok := new(big.Int).SetString(rows[0]["cumulative_gas_used"], 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid cumulative_gas_used %q", rows[0]["cumulative_gas_used"])
+	}
+	return total, nil
+}
+
+// previewRows returns up to limit of the last rows of a job's CSV whose block
+// number is at most lastWritten, keyed by the header's column names. Rows past
+// lastWritten may still be mid-flush and are ignored.
+func previewRows(path string, lastWritten uint64, limit int) ([]map[string]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []map[string]string{}, nil // job hasn't created its file yet
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err == io.EOF {
+			return []map[string]string{}, nil // nothing flushed yet
+		}
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	}
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return []map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	reader.FieldsPerRecord = len(header)
+	bnCol := slices.Index(header, "block_number") // absent if not a selected field
+
+	// Keep a ring of the last limit complete rows
+	ring := make([][]string, 0, limit)
+	next := 0
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			// EOF, or a torn final line from a concurrent write
+			break
+		}
+		if bnCol >= 0 {
+			bn, err := strconv.ParseUint(record[bnCol], 10, 64)
+			if err != nil || bn > lastWritten {
+				break
+			}
+		}
+		if len(ring) < limit {
+			ring = append(ring, record)
+		} else {
+			ring[next] = record
+			next = (next + 1) % limit
+		}
+	}
+
+	rows := make([]map[string]string, 0, len(ring))
+	for i := range ring {
+		record := ring[(next+i)%len(ring)]
+		row := make(map[string]string, len(header))
+		for j, col := range header {
+			row[col] = record[j]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+var errNoBlockColumn = errors.New("output has no block_number column")
+
+// filterCSVRange copies the header and the rows of a job's CSV whose block
+// number is within [from, to] from src to w, gzipping the output like the
+// source when gzipped is set, or for a gzip Content-Encoding when encode is.
+// Rows are in block order, so it stops at the first row past to. It returns
+// errNoBlockColumn before writing anything if the job didn't select
+// block_number.
+func filterCSVRange(w io.Writer, src io.Reader, gzipped, encode bool, opts fetchOptions, from, to uint64) error {
+	if gzipped {
+		gz, err := gzip.NewReader(src)
+		if err == io.EOF {
+			return nil // nothing flushed yet
+		}
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		src = gz
+	}
+	reader := csv.NewReader(src)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	reader.FieldsPerRecord = len(header)
+	bnCol := slices.Index(header, "block_number")
+	if bnCol < 0 {
+		return errNoBlockColumn
+	}
+
+	var zw *gzip.Writer
+	if gzipped || encode {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+	cw := newCSVWriter(w, opts)
+	cw.Write(header)
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			// EOF, or a torn final line of a partial file
+			break
+		}
+		bn, err := strconv.ParseUint(record[bnCol], 10, 64)
+		if err != nil || bn > to {
+			break
+		}
+		if bn >= from {
+			cw.Write(record)
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	if zw != nil {
+		return zw.Close()
+	}
+	return nil
+}
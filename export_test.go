@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestHandleArchive(t *testing.T) {
+	a, calls := newFixtureAnalyzer(t, testBlocks(10, 20))
+	setAnalyzer(t, a)
+	// Block 13 is cached beforehand, the rest is fetched
+	result, err := a.GetBlockGasAndTips(t.Context(), 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := newBlockRecord(result)
+	calls.Store(0)
+
+	rec := httptest.NewRecorder()
+	handleArchive(rec, httptest.NewRequest("GET", "/archive?start=10&end=20", nil))
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/zstd" {
+		t.Fatalf("status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	zr, err := zstd.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var records []blockRecord
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		var r blockRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 11 {
+		t.Fatalf("got %d records, want 11", len(records))
+	}
+	for i, r := range records {
+		if r.BlockNumber != uint64(10+i) || r.Timestamp != testGenesisTime+12*int64(10+i) {
+			t.Errorf("record %d = %+v", i, r)
+		}
+	}
+	if records[3] != cached || records[3].Tips != "42000000000000" || records[3].GasUsed != "21000" {
+		t.Errorf("block 13 = %+v, want %+v", records[3], cached)
+	}
+	if n := calls.Load(); n != 10 {
+		t.Errorf("made %d block calls, want 10", n)
+	}
+
+	// Everything archived is now cached too
+	var n int
+	if err := a.db.QueryRow("SELECT COUNT(*) FROM block_cache WHERE block_num BETWEEN 10 AND 20").Scan(&n); err != nil || n != 11 {
+		t.Errorf("cached %d blocks (%v), want 11", n, err)
+	}
+
+	rec = httptest.NewRecorder()
+	handleArchive(rec, httptest.NewRequest("GET", "/archive?start=20&end=10", nil))
+	if rec.Code != 400 {
+		t.Errorf("reversed range: status %d, want 400", rec.Code)
+	}
+}
+
+// readDelimited splits a varint length-delimited stream into its messages,
+// each decoded into its fields by number. Varints are stored as big-endian
+// bytes, the way bytes fields are.
+func readDelimited(t *testing.T, r io.ByteReader) []map[uint64][]byte {
+	t.Helper()
+	var msgs []map[uint64][]byte
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return msgs
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, size)
+		for i := range msg {
+			if msg[i], err = r.ReadByte(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fields := make(map[uint64][]byte)
+		for len(msg) > 0 {
+			key, n := binary.Uvarint(msg)
+			msg = msg[n:]
+			v, n := binary.Uvarint(msg)
+			msg = msg[n:]
+			switch key & 7 {
+			case wireVarint:
+				fields[key>>3] = new(big.Int).SetUint64(v).Bytes()
+			case wireBytes:
+				fields[key>>3], msg = msg[:v], msg[v:]
+			default:
+				t.Fatalf("field %d has wire type %d", key>>3, key&7)
+			}
+		}
+		msgs = append(msgs, fields)
+	}
+}
+
+func TestProtobufExport(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(10, 13))
+	setAnalyzer(t, a)
+
+	jobID := submitJob(t, "start=10&end=13&format=protobuf&roots=true")
+	if job := waitJob(t, jobID); job.Status != "done" {
+		t.Fatalf("status %s (%s), want done", job.Status, job.Error)
+	}
+	rec := httptest.NewRecorder()
+	handleDownload(rec, httptest.NewRequest("GET", "/download/"+jobID, nil))
+	if ct := rec.Header().Get("Content-Type"); rec.Code != 200 || ct != "application/x-protobuf; delimited=true" {
+		t.Fatalf("status %d, Content-Type %q", rec.Code, ct)
+	}
+	msgs := readDelimited(t, bytes.NewReader(rec.Body.Bytes()))
+	if len(msgs) != 4 {
+		t.Fatalf("got %d messages, want 4", len(msgs))
+	}
+	for i, msg := range msgs {
+		n := uint64(10 + i)
+		want, err := a.GetBlockGasAndTips(t.Context(), n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := func(field uint64) *big.Int { return new(big.Int).SetBytes(msg[field]) }
+		if got(1).Uint64() != n || got(2).Int64() != want.TimeStamp.Unix() ||
+			got(3).Cmp(want.GasUsed) != 0 || got(4).Cmp(want.Tips) != 0 || got(5).Cmp(want.BaseFee) != 0 ||
+			got(6).Uint64() != want.Size || got(11).Uint64() != want.TxCount {
+			t.Errorf("message %d = %v, want block %d", i, msg, n)
+		}
+		for field, root := range []string{7: want.Roots.Transactions, 8: want.Roots.State, 9: want.Roots.Receipts} {
+			if field >= 7 && "0x"+hex.EncodeToString(msg[uint64(field)]) != root {
+				t.Errorf("message %d field %d = %x, want %s", i, field, msg[uint64(field)], root)
+			}
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("POST", "/request?start=10&end=13&format=xml", nil))
+	if rec.Code != 400 {
+		t.Errorf("format=xml: status %d, want 400", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handleSchema(rec, httptest.NewRequest("GET", "/schema/block_metrics.proto", nil))
+	if !bytes.Equal(rec.Body.Bytes(), blockMetricsProto) {
+		t.Errorf("/schema/block_metrics.proto = %q", rec.Body)
+	}
+}
+
+func TestAvgTipPerGasGwei(t *testing.T) {
+	tests := []struct {
+		tips, gasUsed int64
+		want          string
+	}{
+		{tips: 42_000_000_000_000, gasUsed: 21000, want: "2.000000000"},
+		{tips: 1, gasUsed: 1, want: "0.000000001"},
+		{tips: 1, gasUsed: 3, want: "0.000000000"},
+		{tips: 5_000_000_000, gasUsed: 2, want: "2.500000000"},
+		{tips: 0, gasUsed: 0, want: "0"},
+	}
+	for _, tt := range tests {
+		if got := avgTipPerGasGwei(big.NewInt(tt.tips), big.NewInt(tt.gasUsed)); got != tt.want {
+			t.Errorf("avgTipPerGasGwei(%d, %d) = %s, want %s", tt.tips, tt.gasUsed, got, tt.want)
+		}
+	}
+}
+
+func TestPctChange(t *testing.T) {
+	tests := []struct {
+		prev *big.Int
+		cur  int64
+		want string // empty for nil
+	}{
+		{prev: big.NewInt(21000), cur: 42000, want: "100.00"},
+		{prev: big.NewInt(80000), cur: 70000, want: "-12.50"},
+		{prev: big.NewInt(3), cur: 4, want: "33.33"},
+		{prev: big.NewInt(21000), cur: 0, want: "-100.00"},
+		{prev: big.NewInt(0), cur: 21000},
+		{prev: nil, cur: 21000},
+	}
+	for _, tt := range tests {
+		got := ""
+		if change := pctChange(tt.prev, big.NewInt(tt.cur)); change != nil {
+			got = change.FloatString(2)
+		}
+		if got != tt.want {
+			t.Errorf("pctChange(%v, %d) = %q, want %q", tt.prev, tt.cur, got, tt.want)
+		}
+	}
+}
+
+func TestParseGweiBounds(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string // column names
+		wantErr bool
+	}{
+		{in: "10,50,100", want: []string{"txs_lt_10_gwei", "txs_10_50_gwei", "txs_50_100_gwei", "txs_ge_100_gwei"}},
+		{in: "0.5, 2", want: []string{"txs_lt_0.5_gwei", "txs_0.5_2_gwei", "txs_ge_2_gwei"}},
+		{in: "0.000000001", want: []string{"txs_lt_0.000000001_gwei", "txs_ge_0.000000001_gwei"}},
+		{in: "0.0000000001", wantErr: true},
+		{in: "50,10", wantErr: true},
+		{in: "10,10", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "-5", wantErr: true},
+		{in: "1/2", wantErr: true},
+		{in: "1e3", wantErr: true},
+		{in: "ten", wantErr: true},
+		{in: "1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,21", wantErr: true},
+	}
+	for _, tt := range tests {
+		bounds, err := parseGweiBounds(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseGweiBounds(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, col := range gasPriceBucketColumns(bounds) {
+			got = append(got, col.name)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseGweiBounds(%q) columns %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// fixtureTransport answers JSON-RPC requests, single or batched, from a
+// directory of recorded blocks instead of the network, so the whole pipeline
+// runs offline. The directory holds one file per block, named by its decimal number:
+//
+//	18000000.json           the eth_getBlockByNumber result, with full txs
+//	18000000.receipts.json  the eth_getBlockReceipts result, if needed
+//
+// eth_blockNumber answers the highest recorded block. Blocks without a file
+// are null, as a provider reports blocks it doesn't have; other methods fail.
+// A job with baseFeeDelta also reads the block before its start.
+type fixtureTransport struct {
+	dir string
+}
+
+// WithFixtureDir replays RPC responses from the fixture directory dir
+// instead of calling a provider. See fixtureTransport for the layout.
+func WithFixtureDir(dir string) AnalyzerOption {
+	return func(a *Analyzer) {
+		a.client.Transport = fixtureTransport{dir}
+	}
+}
+
+func (t fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	defer req.Body.Close()
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '[' {
+		// A batch gets an array of responses
+		var calls []jsonRPCRequest
+		if err := json.Unmarshal(data, &calls); err != nil {
+			return nil, fmt.Errorf("fixture: invalid request: %w", err)
+		}
+		responses := make([]jsonRPCResponse[json.RawMessage], len(calls))
+		for i, call := range calls {
+			responses[i] = t.respond(call)
+		}
+		body, err = json.Marshal(responses)
+	} else {
+		var call jsonRPCRequest
+		if err := json.Unmarshal(data, &call); err != nil {
+			return nil, fmt.Errorf("fixture: invalid request: %w", err)
+		}
+		body, err = json.Marshal(t.respond(call))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// respond answers a single JSON-RPC call
+func (t fixtureTransport) respond(call jsonRPCRequest) jsonRPCResponse[json.RawMessage] {
+	res := jsonRPCResponse[json.RawMessage]{JSONRPC: "2.0", ID: call.ID}
+	params, _ := call.Params.([]any)
+	result, err := t.call(call.Method, params)
+	if err != nil {
+		res.Error = &rpcErr{Code: -32601, Message: err.Error()}
+	} else {
+		res.Result = result
+	}
+	return res
+}
+
+func (t fixtureTransport) call(method string, params []any) (json.RawMessage, error) {
+	switch method {
+	case "eth_blockNumber":
+		head, err := t.head()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(fmt.Sprintf("0x%x", head))
+	case "eth_getBlockByNumber", "eth_getBlockReceipts":
+		if len(params) == 0 {
+			return nil, fmt.Errorf("fixture: %s needs a block number", method)
+		}
+		tag, ok := params[0].(string)
+		if !ok || tag == "" {
+			return nil, fmt.Errorf("fixture: %s needs a block number", method)
+		}
+		var blockNum uint64
+		switch tag {
+		case "pending":
+			return json.RawMessage("null"), nil
+		case "latest", "safe", "finalized":
+			head, err := t.head()
+			if err != nil {
+				return nil, err
+			}
+			blockNum = head
+		default:
+			n, err := hexToUint64(tag)
+			if err != nil {
+				return nil, fmt.Errorf("fixture: invalid block number %q", tag)
+			}
+			blockNum = n
+		}
+		name := strconv.FormatUint(blockNum, 10) + ".json"
+		if method == "eth_getBlockReceipts" {
+			name = strconv.FormatUint(blockNum, 10) + ".receipts.json"
+		}
+		data, err := os.ReadFile(filepath.Join(t.dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			return json.RawMessage("null"), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !json.Valid(data) {
+			return nil, fmt.Errorf("fixture: %s is not valid JSON", name)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("fixture: method %s is not recorded", method)
+}
+
+// head returns the highest block recorded in the fixture
+func (t fixtureTransport) head() (uint64, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return 0, err
+	}
+	var head uint64
+	found := false
+	for _, e := range entries {
+		n, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), ".json"), 10, 64)
+		if err != nil {
+			continue // receipts and unrelated files
+		}
+		head, found = max(head, n), true
+	}
+	if !found {
+		return 0, fmt.Errorf("fixture: no blocks in %s", t.dir)
+	}
+	return head, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestFixtureTransport(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, testBlocks(40, 44, 42)...)
+	tr := fixtureTransport{dir}
+	tests := []struct {
+		method     string
+		params     []any
+		wantNumber string // of the returned block, or the head
+		wantNull   bool
+		wantErr    bool
+	}{
+		{method: "eth_blockNumber", wantNumber: "0x2c"},
+		{method: "eth_getBlockByNumber", params: []any{"0x29", true}, wantNumber: "0x29"},
+		{method: "eth_getBlockByNumber", params: []any{"latest", true}, wantNumber: "0x2c"},
+		{method: "eth_getBlockByNumber", params: []any{"0x2a", true}, wantNull: true},
+		{method: "eth_getBlockByNumber", params: []any{"pending", true}, wantNull: true},
+		{method: "eth_getBlockReceipts", params: []any{"0x29"}, wantNull: true},
+		{method: "eth_getBlockByNumber", params: []any{"0xzz", true}, wantErr: true},
+		{method: "eth_getBlockByNumber", wantErr: true},
+		{method: "eth_getLogs", params: []any{map[string]any{}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		result, err := tr.call(tt.method, tt.params)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s %v = %s, want an error", tt.method, tt.params, result)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %v: %v", tt.method, tt.params, err)
+			continue
+		}
+		if tt.wantNull {
+			if string(result) != "null" {
+				t.Errorf("%s %v = %s, want null", tt.method, tt.params, result)
+			}
+			continue
+		}
+		var got string
+		if tt.method == "eth_blockNumber" {
+			err = json.Unmarshal(result, &got)
+		} else {
+			var block rpcBlock
+			err = json.Unmarshal(result, &block)
+			got = block.Number
+		}
+		if err != nil || got != tt.wantNumber {
+			t.Errorf("%s %v = %s, want block %s", tt.method, tt.params, result, tt.wantNumber)
+		}
+	}
+}
+
+func TestFixtureJob(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	tests := []struct {
+		name       string
+		start, end uint64
+		rows       int
+	}{
+		{name: "one batch", start: 1, end: 20, rows: 20},
+		{name: "several batches", start: 1, end: 1200, rows: 1200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The fixture transport never opens a connection
+			dir := t.TempDir()
+			writeFixture(t, dir, testBlocks(tt.start, tt.end)...)
+			setAnalyzer(t, newTestAnalyzer(t, "http://fixture.invalid", WithFixtureDir(dir)))
+			job := waitJob(t, submitJob(t, fmt.Sprintf("start=%d&end=%d", tt.start, tt.end)))
+			if job.Status != "done" {
+				t.Fatalf("status %s (%s), want done", job.Status, job.Error)
+			}
+			if job.RowsWritten != uint64(tt.rows) || job.LastWritten != tt.end {
+				t.Errorf("rowsWritten %d, lastWritten %d; want %d, %d", job.RowsWritten, job.LastWritten, tt.rows, tt.end)
+			}
+			records := readCSV(t, job.FilePath)
+			blocks, tips := column(t, records, "block_number"), column(t, records, "tips")
+			if len(blocks) != tt.rows {
+				t.Fatalf("got %d rows, want %d", len(blocks), tt.rows)
+			}
+			for i, v := range blocks {
+				n := tt.start + uint64(i)
+				want := "0"
+				if n%2 == 1 {
+					want = strconv.Itoa(21000 * testTip)
+				}
+				if v != strconv.FormatUint(n, 10) || tips[i] != want {
+					t.Errorf("row %d = block %s with tips %s, want block %d with tips %s", i, v, tips[i], n, want)
+				}
+			}
+		})
+	}
+}
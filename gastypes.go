@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+// gasByType splits a block's gas used by transaction type, summing receipt
+// gasUsed. Types 0 and 1, and any unknown or missing type, count as legacy;
+// types 2 and 4 pay EIP-1559 fees; type 3 carries blobs.
+type gasByType struct {
+	Legacy  *big.Int
+	EIP1559 *big.Int
+	Blob    *big.Int
+}
+
+type rpcTypedReceipt struct {
+	Type    string `json:"type"`
+	GasUsed string `json:"gasUsed"`
+}
+
+// receiptsConcurrency bounds the eth_getBlockReceipts calls in flight for
+// one batch, on top of the rate limiter
+const receiptsConcurrency = 8
+
+// GasByType returns the gas split of each of blockNums. Splits are cached per
+// block; uncached blocks are fetched with one eth_getBlockReceipts call each.
+func (a *Analyzer) GasByType(ctx context.Context, blockNums []uint64) (map[uint64]*gasByType, error) {
+	splits := make(map[uint64]*gasByType, len(blockNums))
+	if len(blockNums) == 0 {
+		return splits, nil
+	}
+	rows, err := a.db.QueryContext(ctx, "SELECT block_num, legacy, eip1559, blob FROM gas_by_type WHERE block_num BETWEEN ? AND ?",
+		blockNums[0], blockNums[len(blockNums)-1])
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var blockNum uint64
+		var legacy, eip1559, blob string
+		if err := rows.Scan(&blockNum, &legacy, &eip1559, &blob); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		split, err := parseGasByType(legacy, eip1559, blob)
+		if err != nil {
+			a.cacheError(fmt.Sprintf("Cache error: block %d", blockNum), err)
+			continue // refetched below
+		}
+		splits[blockNum] = split
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var fetchErr error
+	sem := make(chan struct{}, receiptsConcurrency)
+	for _, bn := range blockNums {
+		if _, ok := splits[bn]; ok {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(blockNum uint64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			split, err := a.fetchGasByType(ctx, blockNum)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if fetchErr == nil {
+					fetchErr = fmt.Errorf("receipts of block %d: %w", blockNum, err)
+				}
+				return
+			}
+			splits[blockNum] = split
+		}(bn)
+	}
+	wg.Wait()
+	return splits, fetchErr
+}
+
+// fetchGasByType sums a block's receipts by transaction type and caches the
+// result
+func (a *Analyzer) fetchGasByType(ctx context.Context, blockNum uint64) (*gasByType, error) {
+	receipts, err := rpcCall[[]rpcTypedReceipt](ctx, a, "eth_getBlockReceipts", fmt.Sprintf("0x%x", blockNum))
+	if err != nil {
+		return nil, err
+	}
+	if *receipts == nil {
+		return nil, errBlockNotFound // null, unlike an empty block's []
+	}
+	split := &gasByType{Legacy: new(big.Int), EIP1559: new(big.Int), Blob: new(big.Int)}
+	for _, receipt := range *receipts {
+		gasUsed, err := hexToBig(receipt.GasUsed)
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToLower(strings.TrimSpace(receipt.Type)) {
+		case "0x2", "0x4":
+			split.EIP1559.Add(split.EIP1559, gasUsed)
+		case "0x3":
+			split.Blob.Add(split.Blob, gasUsed)
+		default:
+			split.Legacy.Add(split.Legacy, gasUsed)
+		}
+	}
+	_, err = a.db.Exec("INSERT OR REPLACE INTO gas_by_type (block_num, legacy, eip1559, blob) VALUES (?, ?, ?, ?)",
+		blockNum, split.Legacy.String(), split.EIP1559.String(), split.Blob.String())
+	if err != nil {
+		a.cacheError("Cache insert error", err)
+	}
+	return split, nil
+}
+
+func parseGasByType(legacy, eip1559, blob string) (*gasByType, error) {
+	split := &gasByType{}
+	for _, f := range []struct {
+		dst **big.Int
+		s   string
+	}{{&split.Legacy, legacy}, {&split.EIP1559, eip1559}, {&split.Blob, blob}} {
+		n, ok := new(big.Int).SetString(f.s, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid gas %q", f.s)
+		}
+		*f.dst = n
+	}
+	return split, nil
+}
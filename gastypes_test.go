@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// receiptsStub serves testBlock blocks and the same receipts for every
+// block except missing, which it answers null, counting receipt calls
+func receiptsStub(t *testing.T, missing uint64) (*Analyzer, *atomic.Int64) {
+	t.Helper()
+	var calls atomic.Int64
+	srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		if method != "eth_getBlockReceipts" {
+			return testBlock(blockParam(params)), nil
+		}
+		calls.Add(1)
+		if blockParam(params) == missing {
+			return nil, nil
+		}
+		return []rpcTypedReceipt{
+			{Type: "0x0", GasUsed: "0x64"},  // 100
+			{Type: "0x1", GasUsed: "0xa"},   // 10
+			{Type: "0x2", GasUsed: "0xc8"},  // 200
+			{Type: "0x4", GasUsed: "0x32"},  // 50
+			{Type: "0x3", GasUsed: "0x12c"}, // 300
+			{Type: "0x7e", GasUsed: "0x1"},  // unknown, so legacy
+			{GasUsed: "0x2"},                // missing, so legacy
+		}, nil
+	})
+	return newTestAnalyzer(t, srv.URL), &calls
+}
+
+func TestGasByType(t *testing.T) {
+	a, calls := receiptsStub(t, 3)
+	splits, err := a.GasByType(t.Context(), []uint64{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bn := range []uint64{1, 2} {
+		s := splits[bn]
+		if s == nil || s.Legacy.Int64() != 113 || s.EIP1559.Int64() != 250 || s.Blob.Int64() != 300 {
+			t.Errorf("block %d: split %+v, want legacy 113, 1559 250, blob 300", bn, s)
+		}
+	}
+	// Cached splits aren't fetched again
+	if _, err := a.GasByType(t.Context(), []uint64{1, 2}); err != nil || calls.Load() != 2 {
+		t.Errorf("made %d receipt calls (%v), want the 2 of the first lookup", calls.Load(), err)
+	}
+	if _, err := a.GasByType(t.Context(), []uint64{2, 3}); err == nil || !strings.Contains(err.Error(), "block 3") {
+		t.Errorf("null receipts: error %v, want one naming block 3", err)
+	}
+}
+
+func TestRequestGasByType(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := receiptsStub(t, 0)
+	setAnalyzer(t, a)
+
+	job := waitJob(t, submitJob(t, "start=1&end=3&gasByType=true"))
+	if job.Status != "done" {
+		t.Fatalf("status %s (%s), want done", job.Status, job.Error)
+	}
+	records := readCSV(t, job.FilePath)
+	for name, want := range map[string]string{"gas_used_legacy": "113", "gas_used_1559": "250", "gas_used_blob": "300"} {
+		for i, v := range column(t, records, name) {
+			if v != want {
+				t.Errorf("block %d: %s = %s, want %s", i+1, name, v, want)
+			}
+		}
+	}
+
+	for _, query := range []string{"start=1&end=3&gasByType=true&format=protobuf", "start=1&end=3&gasByType=true&rollup=hour"} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
@@ -4,6 +4,7 @@ go 1.24.4
 
 require (
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.18.0
 	github.com/longlodw/lazyiterate v0.0.0-20250810231102-bfdbe1c491d3
 	github.com/mattn/go-sqlite3 v1.14.30
 	golang.org/x/time v0.12.0
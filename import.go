@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// importRow is a block_cache row read from an uploaded dataset. BaseFee, Size
+// and TxCount are optional; rows without them are refetched when next read.
+type importRow struct {
+	BlockNum  uint64
+	Timestamp int64
+	GasUsed   *big.Int
+	Tips      *big.Int
+	BaseFee   *big.Int
+	Size      *uint64
+	TxCount   *uint64
+}
+
+// importRecord is the NDJSON shape accepted by ImportCache. It matches the
+// export record with the cache's base_fee, size and tx_count columns added.
+type importRecord struct {
+	BlockNumber *uint64         `json:"block_number"`
+	Timestamp   json.RawMessage `json:"timestamp"`
+	GasUsed     string          `json:"gas_used"`
+	Tips        string          `json:"tips"`
+	BaseFee     string          `json:"base_fee"`
+	Size        *uint64         `json:"block_size_bytes"`
+	TxCount     *uint64         `json:"tx_count"`
+}
+
+// importCacheRow upserts an imported block. Only the imported columns are
+// set, so a block already cached keeps the optional columns a dataset lacks.
+const importCacheRow = `
+INSERT INTO block_cache (block_num, timestamp, gas_used, total_tips, base_fee, size, tx_count)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (block_num) DO UPDATE SET
+	timestamp = excluded.timestamp, gas_used = excluded.gas_used, total_tips = excluded.total_tips,
+	base_fee = COALESCE(excluded.base_fee, block_cache.base_fee),
+	size = COALESCE(excluded.size, block_cache.size),
+	tx_count = COALESCE(excluded.tx_count, block_cache.tx_count)`
+
+var errImportHeader = errors.New("CSV header must include block_number, timestamp, gas_used and tips")
+
+// ImportCache bulk-loads block metrics from a CSV or NDJSON stream into the
+// cache within a single transaction. Malformed rows are skipped and counted.
+func (a *Analyzer) ImportCache(ctx context.Context, r io.Reader, format string) (imported, skipped int, err error) {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, importCacheRow)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmt.Close()
+
+	insert := func(row *importRow) error {
+		var baseFee, size, txCount any
+		if row.BaseFee != nil {
+			baseFee = fmt.Sprintf("0x%x", row.BaseFee)
+		}
+		if row.Size != nil {
+			size = int64(*row.Size)
+		}
+		if row.TxCount != nil {
+			txCount = int64(*row.TxCount)
+		}
+		_, err := stmt.ExecContext(ctx, row.BlockNum, row.Timestamp,
+			fmt.Sprintf("0x%x", row.GasUsed), fmt.Sprintf("0x%x", row.Tips), baseFee, size, txCount)
+		if err == nil {
+			imported++
+		}
+		return err
+	}
+	onSkip := func() { skipped++ }
+
+	if format == "ndjson" {
+		err = readImportNDJSON(r, insert, onSkip)
+	} else {
+		err = readImportCSV(r, insert, onSkip)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return imported, skipped, nil
+}
+
+func readImportCSV(r io.Reader, insert func(*importRow) error, onSkip func()) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1 // validated per row so bad rows can be skipped
+	header, err := reader.Read()
+	if err != nil {
+		return errImportHeader
+	}
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		cols[name] = i
+	}
+	for _, name := range []string{"block_number", "timestamp", "gas_used", "tips"} {
+		if _, ok := cols[name]; !ok {
+			return errImportHeader
+		}
+	}
+	field := func(record []string, name string) (string, bool) {
+		i, ok := cols[name]
+		if !ok || i >= len(record) {
+			return "", false
+		}
+		return record[i], true
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				onSkip()
+				continue
+			}
+			return err
+		}
+		if len(record) != len(header) {
+			onSkip()
+			continue
+		}
+		bn, _ := field(record, "block_number")
+		ts, _ := field(record, "timestamp")
+		gas, _ := field(record, "gas_used")
+		tips, _ := field(record, "tips")
+		baseFee, _ := field(record, "base_fee")
+		size, _ := field(record, "block_size_bytes")
+		txCount, _ := field(record, "tx_count")
+		row, ok := parseImportRow(bn, ts, gas, tips, baseFee, size, txCount)
+		if !ok {
+			onSkip()
+			continue
+		}
+		if err := insert(row); err != nil {
+			return err
+		}
+	}
+}
+
+func readImportNDJSON(r io.Reader, insert func(*importRow) error, onSkip func()) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var rec importRecord
+		if err := json.Unmarshal(line, &rec); err != nil || rec.BlockNumber == nil {
+			onSkip()
+			continue
+		}
+		var ts string
+		if err := json.Unmarshal(rec.Timestamp, &ts); err != nil {
+			ts = string(rec.Timestamp) // bare number
+		}
+		size := ""
+		if rec.Size != nil {
+			size = strconv.FormatUint(*rec.Size, 10)
+		}
+		txCount := ""
+		if rec.TxCount != nil {
+			txCount = strconv.FormatUint(*rec.TxCount, 10)
+		}
+		row, ok := parseImportRow(strconv.FormatUint(*rec.BlockNumber, 10), ts, rec.GasUsed, rec.Tips, rec.BaseFee, size, txCount)
+		if !ok {
+			onSkip()
+			continue
+		}
+		if err := insert(row); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// parseImportRow validates the textual fields of an imported row. Timestamps
+// may be Unix seconds or RFC3339; big integers are decimal wei.
+func parseImportRow(bn, ts, gas, tips, baseFee, size, txCount string) (*importRow, bool) {
+	row := &importRow{}
+	var err error
+	if row.BlockNum, err = strconv.ParseUint(bn, 10, 64); err != nil {
+		return nil, false
+	}
+	if row.Timestamp, err = strconv.ParseInt(ts, 10, 64); err != nil {
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return nil, false
+		}
+		row.Timestamp = t.Unix()
+	}
+	var ok bool
+	if row.GasUsed, ok = parseWei(gas); !ok {
+		return nil, false
+	}
+	if row.Tips, ok = parseWei(tips); !ok {
+		return nil, false
+	}
+	if baseFee != "" {
+		if row.BaseFee, ok = parseWei(baseFee); !ok {
+			return nil, false
+		}
+	}
+	if size != "" {
+		n, err := strconv.ParseUint(size, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		row.Size = &n
+	}
+	if txCount != "" {
+		n, err := strconv.ParseUint(txCount, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		row.TxCount = &n
+	}
+	return row, true
+}
+
+// parseWei parses a non-negative decimal integer
+func parseWei(s string) (*big.Int, bool) {
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() < 0 {
+		return nil, false
+	}
+	return n, true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImportKeepsCachedColumns(t *testing.T) {
+	a, calls := newFixtureAnalyzer(t, testBlocks(10, 11))
+	before, err := a.GetBlockGasAndTips(t.Context(), 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-import block 11 with new tips but without the optional columns
+	csv := "block_number,timestamp,gas_used,tips\n11,1700000132,21000,5\n"
+	imported, skipped, err := a.ImportCache(t.Context(), strings.NewReader(csv), "csv")
+	if err != nil || imported != 1 || skipped != 0 {
+		t.Fatalf("ImportCache = %d, %d, %v", imported, skipped, err)
+	}
+	calls.Store(0)
+	after, err := a.GetBlockGasAndTips(t.Context(), 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 0 {
+		t.Error("block 11 is no longer served from the cache")
+	}
+	if after.Tips.String() != "5" {
+		t.Errorf("tips %s, want the imported 5", after.Tips)
+	}
+	if after.BaseFee.Cmp(before.BaseFee) != 0 || after.Size != before.Size || after.TxCount != before.TxCount {
+		t.Errorf("base fee, size, tx count = %s, %d, %d; want %s, %d, %d kept", after.BaseFee, after.Size, after.TxCount, before.BaseFee, before.Size, before.TxCount)
+	}
+}
+
+func TestHandleImport(t *testing.T) {
+	a, calls := newFixtureAnalyzer(t, nil)
+	setAnalyzer(t, a)
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "secret"
+
+	post := func(query, contentType, encoding, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/import"+query, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Content-Encoding", encoding)
+		rec := httptest.NewRecorder()
+		handleImport(rec, req)
+		return rec
+	}
+	gzipped := func(s string) string {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.String()
+	}
+	tests := []struct {
+		name, query, contentType, body string
+		encoding                       string
+		wantStatus                     int
+		wantImported, wantSkipped      int
+	}{
+		{
+			name:        "csv",
+			contentType: "text/csv",
+			body: "block_number,timestamp,gas_used,tips,base_fee,block_size_bytes,tx_count\n" +
+				"100,1700001200,21000,42,7,600,0\n" +
+				"101,2023-11-14T22:33:32Z,0,0,8,601,1\n" +
+				"102,yesterday,0,0,9,602,0\n" +
+				"103,1700001236,-1,0,9,603,0\n" +
+				"104,1700001248,0\n",
+			wantStatus: 200, wantImported: 2, wantSkipped: 3,
+		},
+		{
+			name:        "ndjson by content type",
+			contentType: "application/x-ndjson",
+			body: `{"block_number":200,"timestamp":1700002400,"gas_used":"21000","tips":"42","base_fee":"7","block_size_bytes":700,"tx_count":0}` + "\n" +
+				`{"block_number":201,"timestamp":"2023-11-14T22:53:32Z","gas_used":"0","tips":"0","base_fee":"8","block_size_bytes":701,"tx_count":1}` + "\n" +
+				`{"timestamp":1700002424}` + "\n" +
+				"not json\n",
+			wantStatus: 200, wantImported: 2, wantSkipped: 2,
+		},
+		{
+			name:        "gzip",
+			contentType: "text/csv",
+			encoding:    "gzip",
+			body: gzipped("block_number,timestamp,gas_used,tips,base_fee,block_size_bytes,tx_count\n" +
+				"300,1700003600,21000,42,7,800,0\n"),
+			wantStatus: 200, wantImported: 1,
+		},
+		{name: "corrupt gzip", contentType: "text/csv", encoding: "gzip", body: "block_number\n", wantStatus: 400},
+		{name: "unsupported encoding", contentType: "text/csv", encoding: "br", body: "", wantStatus: 415},
+		{name: "missing columns", contentType: "text/csv", body: "block_number,tips\n1,2\n", wantStatus: 400},
+		{name: "unknown format", query: "?format=parquet", contentType: "text/csv", body: "", wantStatus: 400},
+	}
+	for _, tt := range tests {
+		rec := post(tt.query, tt.contentType, tt.encoding, tt.body)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.wantStatus, rec.Body)
+			continue
+		}
+		if tt.wantStatus != 200 {
+			continue
+		}
+		var got map[string]int
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got["imported"] != tt.wantImported || got["skipped"] != tt.wantSkipped {
+			t.Errorf("%s: %s, want %d imported and %d skipped", tt.name, rec.Body, tt.wantImported, tt.wantSkipped)
+		}
+	}
+
+	// Imported blocks are served without calling the RPC
+	for _, n := range []uint64{100, 101, 200, 201, 300} {
+		result, err := a.GetBlockGasAndTips(t.Context(), n)
+		if err != nil {
+			t.Fatalf("block %d: %v", n, err)
+		}
+		if want := testGenesisTime + 12*int64(n); result.TimeStamp.Unix() != want || result.Size != 500+n || result.TxCount != n%2 {
+			t.Errorf("block %d: timestamp %d, size %d, tx count %d; want %d, %d, %d", n, result.TimeStamp.Unix(), result.Size, result.TxCount, want, 500+n, n%2)
+		}
+	}
+	if calls.Load() != 0 {
+		t.Errorf("made %d block calls, want 0", calls.Load())
+	}
+
+	req := httptest.NewRequest("POST", "/admin/import", strings.NewReader(""))
+	rec := httptest.NewRecorder()
+	handleImport(rec, req)
+	if rec.Code != 401 {
+		t.Errorf("without a token: status %d, want 401", rec.Code)
+	}
+}
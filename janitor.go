@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// jobsDiskBudget caps the total size of jobsDir in bytes; 0 disables the cap
+var jobsDiskBudget int64
+
+var errOverDiskBudget = errors.New("job outputs exceed the disk budget")
+
+// dirSize sums the sizes of the regular files directly under dir. A missing
+// dir is empty.
+func dirSize(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // removed since listing
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
+
+// ensureDiskBudget makes room under jobsDiskBudget before a new job starts,
+// reaping the outputs of the oldest completed jobs first. It returns
+// errOverDiskBudget when enough space can't be freed.
+func ensureDiskBudget() error {
+	if jobsDiskBudget <= 0 {
+		return nil
+	}
+	size, err := dirSize(jobsDir)
+	if err != nil {
+		return err
+	}
+	if size < jobsDiskBudget {
+		return nil
+	}
+
+	type candidate struct {
+		job *JobStatus
+		id  string
+	}
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	var candidates []candidate
+	for id, job := range jobs {
+		// Failed and stopped jobs keep their files so they can still be
+		// retried or resumed
+		if job.Status == "done" && job.FilePath != "" && job.FinishedAt != nil {
+			candidates = append(candidates, candidate{job, id})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].job.FinishedAt.Before(*candidates[j].job.FinishedAt)
+	})
+	for _, c := range candidates {
+		if size < jobsDiskBudget {
+			break
+		}
+		size -= reapJobFiles(c.job)
+		saveJob(c.id, c.job)
+		log.Printf("Reaped output of job %s to stay under the disk budget", c.id)
+	}
+	if size >= jobsDiskBudget {
+		return errOverDiskBudget
+	}
+	return nil
+}
+
+// reapJobFiles deletes a finished job's output file and manifest, returning
+// the bytes freed. The job record stays, without a file to download.
+// Callers must hold jobsMu.
+func reapJobFiles(job *JobStatus) int64 {
+	var freed int64
+	for _, path := range []string{job.FilePath, manifestPath(job.FilePath)} {
+		if filepath.Dir(path) != jobsDir {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove %s: %v", path, err)
+			continue
+		}
+		freed += info.Size()
+	}
+	job.FilePath = ""
+	return freed
+}
+
+// maxJobRecords caps how many job records are kept; 0 disables the cap.
+// evictJobFiles also deletes the outputs of evicted jobs.
+var (
+	maxJobRecords int
+	evictJobFiles bool
+)
+
+// evictJobs forgets the longest-finished terminal jobs while there are more
+// than maxJobRecords, never touching running ones, and returns the IDs and
+// analyzers of those whose job_results rows should go too. Callers must hold
+// jobsMu.
+func evictJobs() (purge map[string]*Analyzer) {
+	if maxJobRecords <= 0 || len(jobs) <= maxJobRecords {
+		return nil
+	}
+	type candidate struct {
+		job *JobStatus
+		id  string
+	}
+	var candidates []candidate
+	for id, job := range jobs {
+		if job.Status != "pending" && job.FinishedAt != nil {
+			candidates = append(candidates, candidate{job, id})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].job.FinishedAt.Before(*candidates[j].job.FinishedAt)
+	})
+	for _, c := range candidates {
+		if len(jobs) <= maxJobRecords {
+			break
+		}
+		delete(jobs, c.id)
+		c.job.notify() // ends event streams
+		forgetJob(c.id)
+		if evictJobFiles {
+			reapJobFiles(c.job)
+			if c.job.Options.Results {
+				if analyzer := jobAnalyzer(c.job); analyzer == nil {
+					log.Printf("Can't delete results of evicted job %s: %v", c.id, errNetworkGone)
+				} else {
+					if purge == nil {
+						purge = make(map[string]*Analyzer)
+					}
+					purge[c.id] = analyzer
+				}
+			}
+		}
+		log.Printf("Evicted job %s to stay under %d job records", c.id, maxJobRecords)
+	}
+	return purge
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnsureDiskBudget(t *testing.T) {
+	dir := setJobsDir(t)
+	defer func(b int64) { jobsDiskBudget = b }(jobsDiskBudget)
+	a, _ := newFixtureAnalyzer(t, testBlocks(0, 10))
+	setAnalyzer(t, a)
+
+	// Finished jobs with 100-byte files, oldest first, and a running one
+	base := time.Now()
+	job := func(status string, age int) *JobStatus {
+		path := filepath.Join(dir, status+".csv")
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", 100)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		finishedAt := base.Add(-time.Duration(age) * time.Hour)
+		return &JobStatus{Status: status, FilePath: path, FinishedAt: &finishedAt}
+	}
+	setJobs(t, map[string]*JobStatus{
+		"done":    job("done", 3),
+		"stopped": job("stopped", 2),
+		"error":   job("error", 1),
+		"pending": {Status: "pending", FilePath: filepath.Join(dir, "pending.csv")},
+	})
+
+	jobsDiskBudget = 250
+	if err := ensureDiskBudget(); err != nil {
+		t.Fatal(err)
+	}
+	// Only done jobs are reaped; stopped ones can still be resumed
+	for id, wantFile := range map[string]bool{"done": false, "stopped": true, "error": true} {
+		_, err := os.Stat(filepath.Join(dir, id+".csv"))
+		if jobs[id].FilePath != "" != wantFile || (err == nil) != wantFile {
+			t.Errorf("job %s has file %q (%v), want kept %v", id, jobs[id].FilePath, err, wantFile)
+		}
+	}
+
+	// Stopped and failed jobs keep their files, so nothing more can go
+	jobsDiskBudget = 100
+	if err := ensureDiskBudget(); err != errOverDiskBudget {
+		t.Fatalf("err = %v, want %v", err, errOverDiskBudget)
+	}
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("POST", "/request?start=1&end=10", nil))
+	if rec.Code != 507 {
+		t.Errorf("/request over budget = %d, want 507", rec.Code)
+	}
+
+	jobsDiskBudget = 0
+	if job := waitJob(t, submitJob(t, "start=1&end=10")); job.Status != "done" {
+		t.Errorf("job under no budget = %s, want done", job.Status)
+	}
+}
+
+func TestEvictJobs(t *testing.T) {
+	defer func(n int, files bool) { maxJobRecords, evictJobFiles = n, files }(maxJobRecords, evictJobFiles)
+	maxJobRecords, evictJobFiles = 2, true
+	a := newTestAnalyzer(t, "")
+	networks["test"] = a
+	defer delete(networks, "test")
+
+	finished := func(minutesAgo int, opts fetchOptions) *JobStatus {
+		at := time.Now().Add(-time.Duration(minutesAgo) * time.Minute)
+		return &JobStatus{Status: "done", FinishedAt: &at, Options: opts}
+	}
+	setJobs(t, map[string]*JobStatus{
+		"running": {Status: "pending"},
+		"oldest":  finished(30, fetchOptions{Network: "gone", Results: true}),
+		"older":   finished(20, fetchOptions{Network: "test", Results: true}),
+		"newer":   finished(10, fetchOptions{}),
+		"newest":  finished(5, fetchOptions{Network: "test", Results: true}),
+	})
+	jobsMu.Lock()
+	purge := evictJobs()
+	jobsMu.Unlock()
+
+	for _, id := range []string{"running", "newest"} {
+		if _, ok := jobs[id]; !ok {
+			t.Errorf("job %s was evicted", id)
+		}
+	}
+	if len(jobs) != 2 {
+		t.Errorf("%d jobs left, want 2", len(jobs))
+	}
+	// The job on the unconfigured network has no analyzer to purge with
+	if len(purge) != 1 || purge["older"] != a {
+		t.Errorf("purge = %v, want only older", purge)
+	}
+}
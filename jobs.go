@@ -0,0 +1,324 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxJobEvents bounds the event history kept per job
+const maxJobEvents = 256
+
+// jobEvent is a snapshot of a job's progress, kept in its event history
+type jobEvent struct {
+	Seq         uint64    `json:"seq"`
+	Status      string    `json:"status"`
+	LastWritten uint64    `json:"lastWritten"`
+	RowsWritten uint64    `json:"rowsWritten"`
+	Error       string    `json:"error,omitempty"`
+	At          time.Time `json:"at"`
+}
+
+// recordEvent appends the job's current progress to its event history and
+// wakes anyone waiting on it. Callers must hold jobsMu.
+func (job *JobStatus) recordEvent() {
+	job.eventSeq++
+	job.events = append(job.events, jobEvent{
+		Seq:         job.eventSeq,
+		Status:      job.Status,
+		LastWritten: job.LastWritten,
+		RowsWritten: job.RowsWritten,
+		Error:       job.Error,
+		At:          time.Now(),
+	})
+	if len(job.events) > maxJobEvents {
+		job.events = slices.Delete(job.events, 0, len(job.events)-maxJobEvents)
+	}
+	job.notify()
+}
+
+// notify wakes anyone waiting on the job's next event. Callers must hold
+// jobsMu.
+func (job *JobStatus) notify() {
+	if job.changed != nil {
+		close(job.changed)
+	}
+	job.changed = make(chan struct{})
+}
+
+// eventsSince returns the recorded events after seq and a channel closed on
+// the next one. Callers must hold jobsMu.
+func (job *JobStatus) eventsSince(seq uint64) ([]jobEvent, <-chan struct{}) {
+	i, _ := slices.BinarySearchFunc(job.events, seq+1, func(e jobEvent, seq uint64) int {
+		return cmp.Compare(e.Seq, seq)
+	})
+	return slices.Clone(job.events[i:]), job.changed
+}
+
+// throughputWindow is how far back the ETA's throughput estimate looks
+const throughputWindow = time.Minute
+
+// progressSample is how many blocks a job had done at a point in time
+type progressSample struct {
+	at     time.Time
+	blocks uint64
+}
+
+// addSample records the job's blocks done now, keeping the samples within
+// throughputWindow plus the one before them. Callers must hold jobsMu.
+func (job *JobStatus) addSample(now time.Time) {
+	job.samples = append(job.samples, progressSample{now, job.BlocksDone})
+	i := 0
+	for i+1 < len(job.samples) && now.Sub(job.samples[i+1].at) >= throughputWindow {
+		i++
+	}
+	job.samples = slices.Delete(job.samples, 0, i)
+}
+
+// jobProgress are the progress fields computed for /status
+type jobProgress struct {
+	// Progress is the fraction of blocks done, from 0 to 1
+	Progress        float64 `json:"progress"`
+	BlocksRemaining uint64  `json:"blocksRemaining"`
+	// ETA is in seconds, from the throughput over the last
+	// throughputWindow. It is omitted until there is one, and for
+	// jobs that aren't running.
+	ETA *float64 `json:"eta,omitempty"`
+}
+
+// progress computes the job's progress fields. Callers must hold jobsMu.
+func (job *JobStatus) progress() jobProgress {
+	if job.Status == "done" {
+		eta := 0.0
+		return jobProgress{Progress: 1, ETA: &eta}
+	}
+	var p jobProgress
+	if job.TotalBlocks > 0 {
+		p.Progress = min(float64(job.BlocksDone)/float64(job.TotalBlocks), 1)
+	}
+	if job.BlocksDone < job.TotalBlocks {
+		p.BlocksRemaining = job.TotalBlocks - job.BlocksDone
+	}
+	if job.Status != "pending" || len(job.samples) < 2 {
+		return p
+	}
+	first, last := job.samples[0], job.samples[len(job.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if last.blocks <= first.blocks || elapsed <= 0 {
+		return p
+	}
+	eta := float64(p.BlocksRemaining) / (float64(last.blocks-first.blocks) / elapsed)
+	p.ETA = &eta
+	return p
+}
+
+// Job ID schemes
+const (
+	jobIDUUID       = "uuid"
+	jobIDSequential = "sequential" // from a counter persisted in the cache database
+)
+
+var jobIDScheme = jobIDUUID
+
+// newJobID returns an unused ID for a new job in the configured scheme
+func newJobID(ctx context.Context, analyzer *Analyzer) (string, error) {
+	if jobIDScheme != jobIDSequential {
+		return uuid.New().String(), nil
+	}
+	for {
+		n, err := analyzer.NextJobID(ctx)
+		if err != nil {
+			return "", err
+		}
+		id := strconv.FormatUint(n, 10)
+		jobsMu.RLock()
+		_, taken := jobs[id]
+		jobsMu.RUnlock()
+		if !taken {
+			return id, nil
+		}
+	}
+}
+
+// startJob runs job's fetch in the background from block from, appending to
+// the job's existing file when resume is set. Callers must hold jobsMu and
+// have marked the job pending.
+func startJob(analyzer *Analyzer, jobID string, job *JobStatus, from uint64, resume bool) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	job.Deadline = nil
+	if job.Options.MaxDuration > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), job.Options.MaxDuration)
+		d, _ := ctx.Deadline()
+		job.Deadline = &d
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	job.Cancel = cancel
+	job.FinishedAt = nil
+	job.stopStatus = ""
+	job.samples = nil
+	job.addSample(time.Now())
+	job.done = make(chan struct{})
+	job.recordEvent()
+	saveJob(jobID, job)
+
+	req := fetchRequest{
+		Ranges:     job.blockRanges(),
+		From:       from,
+		FilePath:   job.FilePath,
+		Opts:       job.Options,
+		Resume:     resume,
+		ResultsKey: jobID,
+		Progress: func(p fetchProgress) {
+			jobsMu.Lock()
+			job.LastWritten = p.LastWritten
+			job.NextBlock = p.NextBlock
+			job.FlushedBytes = p.FlushedBytes
+			job.BlocksDone += p.Blocks
+			job.RowsWritten += p.Rows
+			job.EmptyBlocks += p.EmptyBlocks
+			job.Gaps = append(job.Gaps, p.Gaps...)
+			job.FailedBlocks = append(job.FailedBlocks, p.Failed...)
+			job.addSample(time.Now())
+			job.recordEvent()
+			// Persisted from a copy once unlocked, so a slow write doesn't
+			// hold up status reads. Reports come one at a time, before the
+			// final save below.
+			snapshot := *job
+			jobsMu.Unlock()
+			saveJob(jobID, &snapshot)
+		},
+	}
+	filePath, done := job.FilePath, job.done
+	go func() {
+		defer close(done)
+		defer cancel()
+		err := parallelFetcher(ctx, analyzer, req)
+		jobsMu.Lock()
+		if job.stopStatus == "interrupted" {
+			// Shutting down: flushed, so it can be resumed after a restart
+			job.Status = "interrupted"
+			job.Error = "the server shut down while the job was running"
+		} else if job.stopStatus == "stopped" || ctx.Err() == context.DeadlineExceeded {
+			// Stopped by hand or after maxDuration: the partial file is
+			// kept, and /resume continues it
+			job.Status = "stopped"
+		} else if err != nil && ctx.Err() != context.Canceled {
+			job.Status = "error"
+			job.Error = truncateError(err.Error())
+		} else {
+			job.Status = "done"
+		}
+		finishedAt := time.Now()
+		job.FinishedAt = &finishedAt
+		job.recordEvent()
+		saveJob(jobID, job)
+		manifest := newJobManifest(jobID, job)
+		jobsMu.Unlock()
+
+		// Checksumming can take a while for big files, so do it unlocked
+		if err := writeManifest(filePath, manifest); err != nil {
+			log.Printf("Failed to write manifest for job %s: %v", jobID, err)
+		}
+	}()
+}
+
+// resumePoint returns the block a failed, stopped or interrupted job continues
+// from, and whether it appends to its file. An interrupted job's file is cut
+// back to the last reported batch, since a crash can leave rows past it. A
+// job without a usable file starts over, its progress reset. Callers must
+// hold jobsMu.
+func resumePoint(job *JobStatus) (from uint64, resume bool) {
+	_, err := os.Stat(job.FilePath)
+	if err == nil && job.Status == "interrupted" {
+		// A gzip member cut short has no trailer and can't be appended to
+		if job.NextBlock == 0 || job.Options.Compress == "gzip" {
+			err = os.ErrNotExist
+		} else {
+			err = os.Truncate(job.FilePath, job.FlushedBytes)
+		}
+	}
+	if err != nil {
+		// Failed before creating its file, or it can't be resumed
+		job.NextBlock, job.LastWritten, job.RowsWritten, job.BlocksDone = 0, 0, 0, 0
+		job.Gaps, job.FailedBlocks, job.FlushedBytes, job.EmptyBlocks = nil, nil, 0, 0
+		return job.Start, false
+	}
+	return max(job.NextBlock, job.Start), true
+}
+
+// errJobRunning is returned by deleteJob for a running job without force
+var errJobRunning = errors.New("job is running")
+
+// errNetworkGone is returned when a job's network is no longer configured,
+// so its job_results rows can't be reached
+var errNetworkGone = errors.New("the job's network is no longer configured")
+
+// deleteJob removes a job's record. A running job is only deleted with
+// force, which stops it and waits for its writer to finish first. With purge
+// set, its output file and manifest are deleted too.
+func deleteJob(ctx context.Context, jobID string, force, purge bool) (found bool, err error) {
+	jobsMu.Lock()
+	job, ok := jobs[jobID]
+	if !ok {
+		jobsMu.Unlock()
+		return false, nil
+	}
+	var done chan struct{}
+	if job.Status == "pending" {
+		if !force {
+			jobsMu.Unlock()
+			return true, errJobRunning
+		}
+		job.Cancel()
+		done = job.done
+	}
+	jobsMu.Unlock()
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return true, ctx.Err()
+		}
+	}
+
+	jobsMu.Lock()
+	if jobs[jobID] != job {
+		// Deleted concurrently
+		jobsMu.Unlock()
+		return false, nil
+	}
+	delete(jobs, jobID)
+	filePath, analyzer := job.FilePath, jobAnalyzer(job)
+	job.notify() // ends event streams
+	jobsMu.Unlock()
+	forgetJob(jobID)
+
+	if purge && filePath != "" {
+		for _, path := range []string{filePath, manifestPath(filePath)} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return true, err
+			}
+		}
+	}
+	if purge && job.Options.Results {
+		if analyzer == nil {
+			return true, fmt.Errorf("results of job %s: %w", jobID, errNetworkGone)
+		}
+		if err := analyzer.DeleteJobResults(ctx, jobID); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleRetry(t *testing.T) {
+	a, calls := newFixtureAnalyzer(t, testBlocks(10, 20))
+	setAnalyzer(t, a)
+	dir := t.TempDir()
+
+	// The job failed after writing blocks 10-14
+	path := filepath.Join(dir, "failed.csv")
+	content := "block_number,timestamp,gas_used,tips\n"
+	for n := 10; n <= 14; n++ {
+		content += strconv.Itoa(n) + ",2023-11-14T22:15:20Z,0,0\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	csvJob := fetchOptions{Format: formatCSV}
+	setJobs(t, map[string]*JobStatus{
+		"failed":  {Status: "error", Error: "disk full", Start: 10, End: 20, LastWritten: 14, NextBlock: 15, RowsWritten: 5, FilePath: path, Options: csvJob},
+		"nofile":  {Status: "error", Error: "disk full", Start: 10, End: 20, FilePath: filepath.Join(dir, "nofile.csv"), Options: csvJob},
+		"done":    {Status: "done", Start: 10, End: 20, LastWritten: 20, FilePath: path, Options: csvJob},
+		"running": {Status: "pending", Start: 10, End: 20, FilePath: path, Options: csvJob},
+	})
+	tests := []struct {
+		method, jobID string
+		want          int
+	}{
+		{method: "GET", jobID: "failed", want: 405},
+		{method: "POST", jobID: "missing", want: 404},
+		{method: "POST", jobID: "done", want: 409},
+		{method: "POST", jobID: "running", want: 409},
+		{method: "POST", jobID: "failed", want: 200},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleRetry(rec, httptest.NewRequest(tt.method, "/retry/"+tt.jobID, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s /retry/%s: status %d, want %d", tt.method, tt.jobID, rec.Code, tt.want)
+		}
+	}
+
+	// Resumed after block 14, appending without another header
+	job := waitJob(t, "failed")
+	if job.Status != "done" || job.Error != "" || job.LastWritten != 20 || job.RowsWritten != 11 {
+		t.Errorf("status %s (%q), lastWritten %d, rowsWritten %d; want done at 20 with 11 rows", job.Status, job.Error, job.LastWritten, job.RowsWritten)
+	}
+	var blocks []string
+	for _, rec := range readCSV(t, path) {
+		blocks = append(blocks, rec[0])
+	}
+	want := []string{"block_number", "10", "11", "12", "13", "14", "15", "16", "17", "18", "19", "20"}
+	if !slices.Equal(blocks, want) {
+		t.Errorf("file has %v, want %v", blocks, want)
+	}
+
+	// Failed before creating its file, so started over
+	rec := httptest.NewRecorder()
+	handleRetry(rec, httptest.NewRequest("POST", "/retry/nofile", nil))
+	if rec.Code != 200 {
+		t.Fatalf("POST /retry/nofile: status %d", rec.Code)
+	}
+	job = waitJob(t, "nofile")
+	if records := readCSV(t, job.FilePath); job.Status != "done" || len(records) != 12 || records[1][0] != "10" {
+		t.Errorf("status %s, file %v; want done with blocks 10-20", job.Status, records)
+	}
+	if calls.Load() != 11 {
+		t.Errorf("made %d block calls, want each of 10-20 once", calls.Load())
+	}
+}
+
+func TestHandleResume(t *testing.T) {
+	a, calls := newFixtureAnalyzer(t, testBlocks(10, 20))
+	setAnalyzer(t, a)
+
+	// The job was stopped after writing blocks 10-14
+	path := filepath.Join(t.TempDir(), "stopped.csv")
+	content := "block_number,timestamp,gas_used,tips\n"
+	for n := 10; n <= 14; n++ {
+		content += strconv.Itoa(n) + ",1700000120,0,0\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	csvJob := fetchOptions{Format: formatCSV}
+	setJobs(t, map[string]*JobStatus{
+		"stopped": {Status: "stopped", Start: 10, End: 20, LastWritten: 14, NextBlock: 15, RowsWritten: 5, FilePath: path, Options: csvJob},
+		"failed":  {Status: "error", Start: 10, End: 20, LastWritten: 14, NextBlock: 15, FilePath: path, Options: csvJob},
+		"done":    {Status: "done", Start: 10, End: 20, LastWritten: 20, FilePath: path, Options: csvJob},
+		"gone":    {Status: "stopped", Start: 10, End: 20, FilePath: path, Options: fetchOptions{Format: formatCSV, Network: "gone"}},
+	})
+	tests := []struct {
+		method, jobID string
+		want          int
+	}{
+		{method: "GET", jobID: "stopped", want: 405},
+		{method: "POST", jobID: "missing", want: 404},
+		{method: "POST", jobID: "done", want: 409},
+		{method: "POST", jobID: "failed", want: 409},
+		{method: "POST", jobID: "gone", want: 409},
+		{method: "POST", jobID: "stopped", want: 200},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleResume(rec, httptest.NewRequest(tt.method, "/resume/"+tt.jobID, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s /resume/%s: status %d, want %d", tt.method, tt.jobID, rec.Code, tt.want)
+		}
+	}
+
+	// Continued after block 14 under the same ID, appending without
+	// another header
+	job := waitJob(t, "stopped")
+	if job.Status != "done" || job.LastWritten != 20 || job.RowsWritten != 11 {
+		t.Errorf("status %s (%q), lastWritten %d, rowsWritten %d; want done at 20 with 11 rows", job.Status, job.Error, job.LastWritten, job.RowsWritten)
+	}
+	records := readCSV(t, path)
+	want := []string{"10", "11", "12", "13", "14", "15", "16", "17", "18", "19", "20"}
+	if got := column(t, records, "block_number"); !slices.Equal(got, want) {
+		t.Errorf("file has blocks %v, want %v", got, want)
+	}
+	if calls.Load() != 6 {
+		t.Errorf("made %d block calls, want each of 15-20 once", calls.Load())
+	}
+}
+
+func TestHandleStatusProgress(t *testing.T) {
+	now := time.Now()
+	samples := []progressSample{{now.Add(-10 * time.Second), 20}, {now, 40}}
+	setJobs(t, map[string]*JobStatus{
+		"running": {Status: "pending", TotalBlocks: 100, BlocksDone: 40, samples: samples},
+		"fresh":   {Status: "pending", TotalBlocks: 100, samples: samples[1:]},
+		"stopped": {Status: "stopped", TotalBlocks: 100, BlocksDone: 40, samples: samples},
+		"done":    {Status: "done", TotalBlocks: 100, BlocksDone: 100},
+	})
+	eta := func(v float64) *float64 { return &v }
+	tests := []struct {
+		jobID     string
+		progress  float64
+		remaining uint64
+		eta       *float64
+	}{
+		// 20 blocks in 10s leaves 30s for the remaining 60
+		{jobID: "running", progress: 0.4, remaining: 60, eta: eta(30)},
+		{jobID: "fresh", remaining: 100},
+		{jobID: "stopped", progress: 0.4, remaining: 60},
+		{jobID: "done", progress: 1, eta: eta(0)},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleStatus(rec, httptest.NewRequest("GET", "/status/"+tt.jobID, nil))
+		var got struct {
+			Progress        float64
+			BlocksRemaining uint64
+			ETA             *float64
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); rec.Code != 200 || err != nil {
+			t.Fatalf("GET /status/%s = %d %s", tt.jobID, rec.Code, rec.Body)
+		}
+		if got.Progress != tt.progress || got.BlocksRemaining != tt.remaining || (got.ETA == nil) != (tt.eta == nil) ||
+			(got.ETA != nil && math.Abs(*got.ETA-*tt.eta) > 0.01) {
+			t.Errorf("GET /status/%s = %s, want progress %v, %d remaining, eta %v", tt.jobID, rec.Body, tt.progress, tt.remaining, tt.eta)
+		}
+	}
+	rec := httptest.NewRecorder()
+	handleStatus(rec, httptest.NewRequest("GET", "/status/missing", nil))
+	if rec.Code != 404 {
+		t.Errorf("GET /status/missing = %d, want 404", rec.Code)
+	}
+}
+
+func TestAddSample(t *testing.T) {
+	job := &JobStatus{}
+	start := time.Now()
+	for i := range 5 {
+		job.BlocksDone = uint64(i) * 100
+		job.addSample(start.Add(time.Duration(i) * 30 * time.Second))
+	}
+	// At 2m, the samples within the last minute are at 1m30s and 2m, plus
+	// the one before them at 1m
+	if len(job.samples) != 3 || job.samples[0].blocks != 200 {
+		t.Errorf("samples = %v, want those from 1m on", job.samples)
+	}
+}
+
+func TestResumePoint(t *testing.T) {
+	const content = "header\nrow 1\nrow 2\npartial"
+	flushed := int64(len("header\nrow 1\nrow 2\n"))
+	tests := []struct {
+		name       string
+		status     string
+		compress   string
+		nextBlock  uint64
+		noFile     bool
+		wantFrom   uint64
+		wantResume bool
+		wantSize   int64
+	}{
+		{name: "stopped", status: "stopped", nextBlock: 13, wantFrom: 13, wantResume: true, wantSize: int64(len(content))},
+		{name: "interrupted is cut back", status: "interrupted", nextBlock: 13, wantFrom: 13, wantResume: true, wantSize: flushed},
+		{name: "interrupted before any flush", status: "interrupted", wantFrom: 10, wantSize: int64(len(content))},
+		{name: "interrupted gzip", status: "interrupted", compress: "gzip", nextBlock: 13, wantFrom: 10, wantSize: int64(len(content))},
+		{name: "failed before its file", status: "error", nextBlock: 13, noFile: true, wantFrom: 10},
+		{name: "next block before start", status: "stopped", nextBlock: 5, wantFrom: 10, wantResume: true, wantSize: int64(len(content))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "job.csv")
+			if !tt.noFile {
+				if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			job := &JobStatus{
+				Status:       tt.status,
+				Start:        10,
+				End:          20,
+				FilePath:     path,
+				NextBlock:    tt.nextBlock,
+				LastWritten:  tt.nextBlock - 1,
+				RowsWritten:  2,
+				FlushedBytes: flushed,
+				Options:      fetchOptions{Format: formatCSV, Compress: tt.compress},
+			}
+			from, resume := resumePoint(job)
+			if from != tt.wantFrom || resume != tt.wantResume {
+				t.Fatalf("resumePoint = %d, %v; want %d, %v", from, resume, tt.wantFrom, tt.wantResume)
+			}
+			if !resume && (job.NextBlock != 0 || job.RowsWritten != 0 || job.FlushedBytes != 0) {
+				t.Errorf("starting over kept progress: %+v", job)
+			}
+			if tt.noFile {
+				return
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != tt.wantSize {
+				t.Errorf("file is %d bytes, want %d", info.Size(), tt.wantSize)
+			}
+		})
+	}
+}
+
+// sseEvent is an event read from a Server-Sent Events stream
+type sseEvent struct {
+	id, kind string
+	data     jobEvent
+}
+
+// readEvents reads a job's event stream until the server ends it
+func readEvents(t *testing.T, url, lastEventID string) []sseEvent {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != 200 || ct != "text/event-stream" {
+		t.Fatalf("GET %s = %d with Content-Type %q", url, resp.StatusCode, ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []sseEvent
+	for _, block := range strings.Split(strings.TrimSpace(string(body)), "\n\n") {
+		var e sseEvent
+		for _, line := range strings.Split(block, "\n") {
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				e.id = value
+			case "event":
+				e.kind = value
+			case "data":
+				if err := json.Unmarshal([]byte(value), &e.data); err != nil {
+					t.Fatalf("event data %q: %v", value, err)
+				}
+			}
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestHandleEvents(t *testing.T) {
+	a, _ := newFixtureAnalyzer(t, testBlocks(0, 1200))
+	setJobs(t, map[string]*JobStatus{})
+	srv := httptest.NewServer(http.HandlerFunc(handleEvents))
+	defer srv.Close()
+
+	job := &JobStatus{Status: "pending", Start: 1, End: 1200, FilePath: filepath.Join(t.TempDir(), "job.csv"), Options: fetchOptions{Format: formatCSV}}
+	jobsMu.Lock()
+	jobs["job"] = job
+	startJob(a, "job", job, job.Start, false)
+	jobsMu.Unlock()
+
+	events := readEvents(t, srv.URL+"/events/job", "")
+	if len(events) < 2 {
+		t.Fatalf("got %d events, want at least 2", len(events))
+	}
+	for i, e := range events {
+		if e.id != strconv.FormatUint(e.data.Seq, 10) || i > 0 && e.data.Seq <= events[i-1].data.Seq {
+			t.Errorf("event %d has id %s and seq %d after seq %d", i, e.id, e.data.Seq, events[max(i-1, 0)].data.Seq)
+		}
+		if i < len(events)-1 && (e.kind != "progress" || e.data.Status != "pending") {
+			t.Errorf("event %d = %s %+v, want pending progress", i, e.kind, e.data)
+		}
+	}
+	last := events[len(events)-1]
+	if last.kind != "complete" || last.data.Status != "done" || last.data.LastWritten != 1200 || last.data.RowsWritten != 1200 {
+		t.Errorf("last event = %s %+v, want done at block 1200", last.kind, last.data)
+	}
+
+	// A reconnecting client only gets what it missed
+	resumed := readEvents(t, srv.URL+"/events/job", events[len(events)-2].id)
+	if len(resumed) != 1 || resumed[0].id != last.id {
+		t.Errorf("resumed after event %s, got %v, want only event %s", events[len(events)-2].id, resumed, last.id)
+	}
+
+	resp, err := http.Get(srv.URL + "/events/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("unknown job = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestHandleDeleteJob(t *testing.T) {
+	// A running job whose writer has already finished
+	running := func() *JobStatus {
+		done := make(chan struct{})
+		close(done)
+		return &JobStatus{Status: "pending", Cancel: func() {}, done: done}
+	}
+	tests := []struct {
+		name     string
+		job      *JobStatus
+		query    string
+		want     int
+		wantKept bool // the job record
+		wantFile bool
+	}{
+		{name: "done", job: &JobStatus{Status: "done"}, want: 204, wantFile: true},
+		{name: "purged", job: &JobStatus{Status: "done"}, query: "?purge=true", want: 204},
+		{name: "running", job: running(), query: "?purge=true", want: 409, wantKept: true, wantFile: true},
+		{name: "running with force", job: running(), query: "?force=true&purge=true", want: 204},
+		{
+			// The job and its file go, but its results can't be reached
+			name:  "results on an unconfigured network",
+			job:   &JobStatus{Status: "done", Options: fetchOptions{Network: "gone", Results: true}},
+			query: "?purge=true",
+			want:  409,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.job.FilePath = filepath.Join(t.TempDir(), "job.csv")
+			if err := os.WriteFile(tt.job.FilePath, []byte("block_number\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			setJobs(t, map[string]*JobStatus{"j": tt.job})
+			rec := httptest.NewRecorder()
+			handleDeleteJob(rec, httptest.NewRequest("DELETE", "/jobs/j"+tt.query, nil))
+			if rec.Code != tt.want {
+				t.Errorf("DELETE /jobs/j%s = %d %s, want %d", tt.query, rec.Code, rec.Body, tt.want)
+			}
+			if _, kept := jobs["j"]; kept != tt.wantKept {
+				t.Errorf("record kept: %v, want %v", kept, tt.wantKept)
+			}
+			if _, err := os.Stat(tt.job.FilePath); (err == nil) != tt.wantFile {
+				t.Errorf("file kept: %v, want %v", err == nil, tt.wantFile)
+			}
+		})
+	}
+
+	setJobs(t, map[string]*JobStatus{})
+	for method, want := range map[string]int{"DELETE": 404, "GET": 405} {
+		rec := httptest.NewRecorder()
+		handleDeleteJob(rec, httptest.NewRequest(method, "/jobs/missing", nil))
+		if rec.Code != want {
+			t.Errorf("%s /jobs/missing = %d, want %d", method, rec.Code, want)
+		}
+	}
+}
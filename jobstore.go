@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// jobStore persists job records so they survive a restart. It is the
+// default network's analyzer, whose database also holds the job counter.
+var jobStore *Analyzer
+
+// SaveJob writes a job's record to the jobs table. The summary columns are
+// for ad-hoc queries; the job is restored from record, plus the resume
+// point and flushed size, which the JSON leaves out.
+func (a *Analyzer) SaveJob(ctx context.Context, jobID string, job *JobStatus) error {
+	record, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = a.db.ExecContext(ctx, `
+	INSERT INTO jobs (job_id, status, start_block, end_block, last_written, file_path, error, next_block, flushed_bytes, record)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (job_id) DO UPDATE SET
+		status = excluded.status, start_block = excluded.start_block, end_block = excluded.end_block,
+		last_written = excluded.last_written, file_path = excluded.file_path, error = excluded.error,
+		next_block = excluded.next_block, flushed_bytes = excluded.flushed_bytes, record = excluded.record`,
+		jobID, job.Status, job.Start, job.End, job.LastWritten, job.FilePath, job.Error, job.NextBlock, job.FlushedBytes, record)
+	return err
+}
+
+// DeleteJob removes a job's record from the jobs table
+func (a *Analyzer) DeleteJob(ctx context.Context, jobID string) error {
+	_, err := a.db.ExecContext(ctx, "DELETE FROM jobs WHERE job_id = ?", jobID)
+	return err
+}
+
+// LoadJobs reads every persisted job record
+func (a *Analyzer) LoadJobs(ctx context.Context) (map[string]*JobStatus, error) {
+	rows, err := a.db.QueryContext(ctx, "SELECT job_id, next_block, flushed_bytes, record FROM jobs")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	loaded := make(map[string]*JobStatus)
+	for rows.Next() {
+		var jobID string
+		var record []byte
+		job := &JobStatus{}
+		if err := rows.Scan(&jobID, &job.NextBlock, &job.FlushedBytes, &record); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(record, job); err != nil {
+			log.Printf("Skipping unreadable record of job %s: %v", jobID, err)
+			continue
+		}
+		loaded[jobID] = job
+	}
+	return loaded, rows.Err()
+}
+
+// saveJob persists a job's record, logging failures: the job carries on
+// either way. Callers must hold jobsMu, or pass a copy of the job.
+func saveJob(jobID string, job *JobStatus) {
+	if jobStore == nil {
+		return
+	}
+	if err := jobStore.SaveJob(context.Background(), jobID, job); err != nil {
+		log.Printf("Failed to persist job %s: %v", jobID, err)
+	}
+}
+
+// forgetJob removes a deleted or evicted job's persisted record
+func forgetJob(jobID string) {
+	if jobStore == nil {
+		return
+	}
+	if err := jobStore.DeleteJob(context.Background(), jobID); err != nil {
+		log.Printf("Failed to delete persisted job %s: %v", jobID, err)
+	}
+}
+
+// restoreJobs loads the persisted jobs into jobs at startup. Jobs that were
+// running when the server went down are marked interrupted, so they can be
+// retried.
+func restoreJobs(store *Analyzer) error {
+	loaded, err := store.LoadJobs(context.Background())
+	if err != nil {
+		return err
+	}
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for id, job := range loaded {
+		if job.Status == "pending" {
+			job.Status = "interrupted"
+			job.Error = "the server stopped while the job was running"
+			finishedAt := time.Now()
+			job.FinishedAt = &finishedAt
+			saveJob(id, job)
+		}
+		job.recordEvent() // a final event for /events
+		jobs[id] = job
+	}
+	if len(loaded) > 0 {
+		log.Printf("Restored %d jobs", len(loaded))
+	}
+	return nil
+}
+
+// interruptJobs stops the running jobs at shutdown, marking them
+// interrupted, and waits for them to flush their files until ctx is done.
+func interruptJobs(ctx context.Context) {
+	var running []chan struct{}
+	jobsMu.Lock()
+	for _, job := range jobs {
+		if job.Status == "pending" {
+			job.stopStatus = "interrupted"
+			job.Cancel()
+			running = append(running, job.done)
+		}
+	}
+	jobsMu.Unlock()
+	for _, done := range running {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+var addressPattern = regexp.MustCompile(`^0x[0-9a-f]{40}$`)
+
+// logFilter selects the logs counted by a job's log_count column
+type logFilter struct {
+	Topic   string `json:"topic"`             // first topic (event signature hash)
+	Address string `json:"address,omitempty"` // emitting contract, any if empty
+}
+
+type rpcLog struct {
+	BlockNumber string `json:"blockNumber"`
+	Removed     bool   `json:"removed"`
+}
+
+// LogCounts returns the number of logs matching filter in each block of
+// [start, end]. Counts are cached per block and filter; a range with any
+// uncached block is fetched with a single eth_getLogs call.
+func (a *Analyzer) LogCounts(ctx context.Context, start, end uint64, filter logFilter) (map[uint64]uint64, error) {
+	counts := make(map[uint64]uint64, end-start+1)
+	rows, err := a.db.QueryContext(ctx, "SELECT block_num, count FROM log_counts WHERE topic = ? AND address = ? AND block_num BETWEEN ? AND ?",
+		filter.Topic, filter.Address, start, end)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var blockNum, count uint64
+		if err := rows.Scan(&blockNum, &count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		counts[blockNum] = count
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if uint64(len(counts)) == end-start+1 {
+		return counts, nil
+	}
+
+	params := map[string]any{
+		"fromBlock": fmt.Sprintf("0x%x", start),
+		"toBlock":   fmt.Sprintf("0x%x", end),
+		"topics":    []string{filter.Topic},
+	}
+	if filter.Address != "" {
+		params["address"] = filter.Address
+	}
+	logs, err := rpcCall[[]rpcLog](ctx, a, "eth_getLogs", params)
+	if err != nil {
+		return nil, err
+	}
+	clear(counts)
+	for _, l := range *logs {
+		if l.Removed {
+			continue // dropped by a reorg
+		}
+		blockNum, err := hexToUint64(l.BlockNumber)
+		if err != nil {
+			return nil, err
+		}
+		counts[blockNum]++
+	}
+
+	// Cache zero counts too, so empty blocks aren't refetched
+	tx, err := a.db.Begin()
+	if err != nil {
+		a.cacheError("Cache insert error", err)
+		return counts, nil
+	}
+	defer tx.Rollback()
+	for bn := start; bn <= end; bn++ {
+		_, err := tx.Exec("INSERT OR REPLACE INTO log_counts (block_num, topic, address, count) VALUES (?, ?, ?, ?)",
+			bn, filter.Topic, filter.Address, counts[bn])
+		if err != nil {
+			a.cacheError("Cache insert error", err)
+			return counts, nil
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		a.cacheError("Cache insert error", err)
+	}
+	return counts, nil
+}
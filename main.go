@@ -1,22 +1,35 @@
 package main
 
 import (
+	"cmp"
+	"compress/gzip"
 	"context"
-	"encoding/csv"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"maps"
+	"math"
 	"math/big"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
-
-	"github.com/google/uuid"
+	"unicode"
+	"unicode/utf8"
 )
 
 type BlockResult struct {
@@ -24,19 +37,251 @@ type BlockResult struct {
 	TimeStamp time.Time
 	GasUsed   *big.Int
 	Tips      *big.Int
+	BaseFee   *big.Int
+	Size      uint64 // bytes
+	TxCount   uint64
+	Roots     *blockRoots
+	// Difficulty is nil for rows cached before it was stored, and
+	// TotalDifficulty also when the provider didn't report it
+	Difficulty      *big.Int
+	TotalDifficulty *big.Int
+	// Miner is the lowercase coinbase address; empty for rows cached
+	// before it was stored
+	Miner string
+	// GasPrices are the effective gas prices of the transactions. They
+	// aren't cached, so only freshly fetched blocks have them.
+	GasPrices []*big.Int
 	Err       error
 }
 
+// blockRoots are the trie roots from a block header, as 0x-prefixed hex
+type blockRoots struct {
+	Transactions string
+	State        string
+	Receipts     string
+}
+
 type JobStatus struct {
 	Status   string `json:"status"`
 	FilePath string `json:"filePath,omitempty"`
 	Error    string `json:"error,omitempty"`
+	Label    string `json:"label,omitempty"`
 
 	Start uint64 `json:"start"`
 	End   uint64 `json:"end"`
+	// Ranges is set for multi-range jobs; Start and End then bound all of them
+	Ranges []blockRange `json:"ranges,omitempty"`
+
+	// Options the job was submitted with
+	Options fetchOptions `json:"options"`
+
+	// Deadline is set when the job was submitted with a maxDuration
+	Deadline *time.Time `json:"deadline,omitempty"`
+
+	LastWritten uint64 `json:"lastWritten"`
+	RowsWritten uint64 `json:"rowsWritten"`
+	// BlocksDone of TotalBlocks have been written or passed, across all ranges
+	BlocksDone  uint64 `json:"blocksDone"`
+	TotalBlocks uint64 `json:"totalBlocks"`
+	// EmptyBlocks counts written-through blocks without transactions
+	EmptyBlocks uint64 `json:"emptyBlocks"`
+	// Gaps lists blocks skipped or zero-filled under a non-strict gap policy
+	Gaps []uint64 `json:"gaps,omitempty"`
+	// FailedBlocks lists blocks that failed and were passed the same way
+	// under failurePolicy=advance
+	FailedBlocks []uint64 `json:"failedBlocks,omitempty"`
+	// NextBlock is the first block not yet written, or 0 before any write
+	NextBlock uint64 `json:"-"`
+	// FlushedBytes is the size of the file up to LastWritten
+	FlushedBytes int64 `json:"-"`
+
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+
+	Cancel context.CancelFunc `json:"-"` // for stopping the job
+	done   chan struct{}      // closed once the job's goroutine has finished
+	// stopStatus is the status to record once the job's context is
+	// cancelled: "stopped" by /stop, "interrupted" by a shutdown
+	stopStatus string
+	// samples of BlocksDone over time, for the ETA
+	samples []progressSample
+
+	// Event history, for streaming progress
+	events   []jobEvent
+	eventSeq uint64
+	changed  chan struct{}
+}
+
+// jobSummary is an entry of /jobs?verbose=true
+type jobSummary struct {
+	JobID  string `json:"jobID"`
+	Label  string `json:"label,omitempty"`
+	Status string `json:"status"`
+	Start  uint64 `json:"start"`
+	End    uint64 `json:"end"`
+}
+
+// blockRanges returns the ranges the job covers
+func (j *JobStatus) blockRanges() []blockRange {
+	if j.Ranges != nil {
+		return j.Ranges
+	}
+	return []blockRange{{Start: j.Start, End: j.End}}
+}
+
+// parseRanges parses a ranges parameter such as "100-200,500-600" into
+// sorted inclusive ranges, rejecting overlaps
+func parseRanges(v string) ([]blockRange, error) {
+	var ranges []blockRange
+	for _, part := range strings.Split(v, ",") {
+		startStr, endStr, ok := strings.Cut(strings.TrimSpace(part), "-")
+		if !ok {
+			return nil, fmt.Errorf("range %q is not start-end", part)
+		}
+		start, err := strconv.ParseUint(startStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start in range %q", part)
+		}
+		end, err := strconv.ParseUint(endStr, 10, 64)
+		if err != nil || end < start || end > maxBlockNumber {
+			return nil, fmt.Errorf("invalid end in range %q", part)
+		}
+		ranges = append(ranges, blockRange{Start: start, End: end})
+	}
+	slices.SortFunc(ranges, func(a, b blockRange) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].Start <= ranges[i-1].End {
+			return nil, fmt.Errorf("ranges %d-%d and %d-%d overlap",
+				ranges[i-1].Start, ranges[i-1].End, ranges[i].Start, ranges[i].End)
+		}
+	}
+	return ranges, nil
+}
+
+// clampRanges drops the parts of sorted ranges past end
+func clampRanges(ranges []blockRange, end uint64) []blockRange {
+	var clamped []blockRange
+	for _, rg := range ranges {
+		if rg.Start > end {
+			break
+		}
+		rg.End = min(rg.End, end)
+		clamped = append(clamped, rg)
+	}
+	return clamped
+}
+
+// maxLabelLength bounds user-supplied job labels
+const maxLabelLength = 64
+
+// validLabel reports whether label is short and made only of letters, digits,
+// spaces and the punctuation . _ : -
+func validLabel(label string) bool {
+	if utf8.RuneCountInString(label) > maxLabelLength {
+		return false
+	}
+	for _, c := range label {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && !strings.ContainsRune(" ._:-", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptsGzip reports whether the client's Accept-Encoding allows gzip,
+// named or as *, with a nonzero weight
+func acceptsGzip(r *http.Request) bool {
+	wildcard := false
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if name = strings.TrimSpace(name); name != "gzip" && name != "*" {
+				continue
+			}
+			accepted := true
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				weight, err := strconv.ParseFloat(q, 64)
+				accepted = err == nil && weight > 0
+			}
+			if name == "gzip" {
+				return accepted
+			}
+			wildcard = accepted
+		}
+	}
+	return wildcard
+}
+
+// serveGzip sends content with Content-Encoding: gzip. The compressed
+// length isn't known up front, so the response has no Content-Length.
+func serveGzip(w http.ResponseWriter, r *http.Request, content io.Reader) error {
+	w.Header().Set("Content-Encoding", "gzip")
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	gz := gzip.NewWriter(w)
+	if _, err := io.Copy(gz, content); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// errBodyEncoding is returned by decodeBody for an unsupported Content-Encoding
+var errBodyEncoding = errors.New("unsupported Content-Encoding")
+
+// decodeBody transparently decompresses a request body sent with
+// Content-Encoding: gzip, so large uploads can be compressed.
+func decodeBody(r *http.Request) error {
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+		return nil
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = zr
+		return nil
+	default:
+		return errBodyEncoding
+	}
+}
+
+// writeJSON encodes v as the response body, indented if the client passed
+// pretty=true.
+func writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if r.URL.Query().Get("pretty") == "true" {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(v)
+}
+
+// finalityDepth is how far below head a block is treated as final
+const finalityDepth = 64
+
+// etagMatches reports whether an If-None-Match header matches etag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
 
-	LastWritten uint64             `json:"lastWritten"`
-	Cancel      context.CancelFunc `json:"-"` // for stopping the job
+// jobFile describes a downloadable job artifact returned by /files
+type jobFile struct {
+	JobID       string `json:"jobID"`
+	Start       uint64 `json:"start"`
+	End         uint64 `json:"end"`
+	LastWritten uint64 `json:"lastWritten"`
+	Status      string `json:"status"`
+	DownloadURL string `json:"downloadURL"`
 }
 
 var (
@@ -44,198 +289,2211 @@ var (
 	jobsMu sync.RWMutex
 )
 
-// parallelFetcher fetches blocks in parallel batches and writes sorted output to CSV
-func parallelFetcher(ctx context.Context, analyzer *Analyzer, start, end uint64, filePath string) error {
-	f, err := os.Create(filePath)
+// jobsDir is where jobs write their files
+var jobsDir = "/var/eth-fetcher/jobs"
+
+// fetchOptions are the per-job settings of a fetch request
+type fetchOptions struct {
+	// Format is a key of outputFormats
+	Format string `json:"format"`
+
+	// BaseFeeDelta adds each block's base fee change from the previous block
+	BaseFeeDelta bool `json:"baseFeeDelta,omitempty"`
+
+	// BlockSize adds each block's size in bytes
+	BlockSize bool `json:"blockSize,omitempty"`
+
+	// AvgTipPerGas adds each block's average tip per gas in gwei
+	AvgTipPerGas bool `json:"avgTipPerGas,omitempty"`
+
+	// TxCount adds each block's transaction count
+	TxCount bool `json:"txCount,omitempty"`
+
+	// GasUsedPctChange adds each block's percent change in gas used from
+	// the previous block
+	GasUsedPctChange bool `json:"gasUsedPctChange,omitempty"`
+
+	// BaseFee adds each block's base fee per gas
+	BaseFee bool `json:"baseFee,omitempty"`
+
+	// MinTips drops rows whose total tips are below it (wei)
+	MinTips *big.Int `json:"minTips,omitempty"`
+
+	// MaxDuration stops the job after running this long (nanoseconds)
+	MaxDuration time.Duration `json:"maxDuration,omitempty"`
+
+	// RPCTimeout bounds each of the job's RPC calls (nanoseconds), when
+	// shorter than the client's timeout
+	RPCTimeout time.Duration `json:"rpcTimeout,omitempty"`
+
+	// Concurrency caps the job's fetch calls in flight below
+	// FETCH_CONCURRENCY; each call fetches one batch of rpcBatchSize blocks
+	Concurrency int `json:"concurrency,omitempty"`
+
+	// USDPrice enables the tips_usd column at this ETH/USD price
+	USDPrice *usdPrice `json:"usdPrice,omitempty"`
+
+	// Units selects how CSV wei amounts are rendered: unitsWei or unitsEther
+	Units string `json:"units,omitempty"`
+
+	// TimestampFormat selects how the CSV timestamp is rendered:
+	// timestampUnix (the default when empty) or timestampRFC3339
+	TimestampFormat string `json:"timestampFormat,omitempty"`
+
+	// TimeBuckets adds UTC date, hour and ISO week columns for grouping
+	TimeBuckets bool `json:"timeBuckets,omitempty"`
+
+	// Roots adds the header's transactions, state and receipts roots
+	Roots bool `json:"roots,omitempty"`
+
+	// Difficulty adds the header's difficulty and total difficulty
+	Difficulty bool `json:"difficulty,omitempty"`
+
+	// Logs adds a log_count column counting matching logs per block
+	Logs *logFilter `json:"logs,omitempty"`
+
+	// Network selects the chain and cache; the default network when empty
+	Network string `json:"network,omitempty"`
+
+	// Rollup aggregates CSV rows per UTC hour or day instead of per block
+	Rollup string `json:"rollup,omitempty"`
+
+	// Step samples every Step-th block from the start; 0 or 1 fetches all
+	Step uint64 `json:"step,omitempty"`
+
+	// GasPriceBuckets are the ascending wei boundaries of the columns
+	// counting transactions per effective gas price range
+	GasPriceBuckets []*big.Int `json:"gasPriceBuckets,omitempty"`
+
+	// PriorityFeeBuckets are the ascending wei boundaries of the ndjson
+	// priorityFeeHistogram
+	PriorityFeeBuckets []*big.Int `json:"priorityFeeBuckets,omitempty"`
+
+	// CumulativeGas adds the running total of gas used over the job
+	CumulativeGas bool `json:"cumulativeGas,omitempty"`
+
+	// GasByType adds gas used per transaction type, from block receipts
+	GasByType bool `json:"gasByType,omitempty"`
+
+	// StartTime and EndTime are the requested times start and end were
+	// resolved from, if given
+	StartTime *time.Time `json:"startTime,omitempty"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+
+	// Lag is how far behind the head end was capped at submission
+	Lag uint64 `json:"lag,omitempty"`
+
+	// Compress is "gzip" to store the file gzip-compressed, or empty
+	Compress string `json:"compress,omitempty"`
+
+	// Fields selects the CSV columns and their order; all in canonical
+	// order when nil
+	Fields []string `json:"fields,omitempty"`
+
+	// GapPolicy decides what happens to blocks that could not be fetched
+	GapPolicy string `json:"gapPolicy,omitempty"`
+
+	// FailurePolicy is failureBlock (the default when empty) or
+	// failureAdvance, which needs a non-strict GapPolicy
+	FailurePolicy string `json:"failurePolicy,omitempty"`
+
+	// LineEnding is lineEndingLF (the default when empty) or lineEndingCRLF
+	LineEnding string `json:"lineEnding,omitempty"`
+
+	// MovingAvgWindow adds a column averaging tips over this many blocks
+	MovingAvgWindow int `json:"movingAvgWindow,omitempty"`
+
+	// Results also stores the rows in the SQLite job_results table
+	Results bool `json:"results,omitempty"`
+}
+
+// needsGasPrices reports whether the job's output uses the per-transaction
+// gas prices, which only freshly fetched blocks carry
+func (o fetchOptions) needsGasPrices() bool {
+	return o.GasPriceBuckets != nil || o.PriorityFeeBuckets != nil
+}
+
+// builtinDashboard is served when no frontend directory is available
+//
+//go:embed dashboard.html
+var builtinDashboard []byte
+
+// adminToken guards the /admin/ endpoints; they are disabled when it is empty
+var adminToken string
+
+// requireAdmin checks the request's bearer token against adminToken, writing
+// an error response and returning false if it doesn't match.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		http.Error(w, "Admin endpoints are disabled", 403)
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		http.Error(w, "Unauthorized", 401)
+		return false
+	}
+	return true
+}
+
+// maxErrorLength caps error messages stored on jobs and written to the log,
+// since a misbehaving RPC can return arbitrarily large error strings.
+var maxErrorLength = 1024
+
+// truncateError shortens msg to at most maxErrorLength bytes, marking the cut
+// with an ellipsis.
+func truncateError(msg string) string {
+	if maxErrorLength <= 0 || len(msg) <= maxErrorLength {
+		return msg
+	}
+	cut := maxErrorLength
+	for cut > 0 && !utf8.RuneStart(msg[cut]) {
+		cut-- // don't split a multi-byte character
+	}
+	return msg[:cut] + "…"
+}
+
+// Output fsync policies: never, once the job's file is complete, or also
+// after every batch
+const (
+	syncOff        = "off"
+	syncCompletion = "completion"
+	syncBatch      = "batch"
+)
+
+var syncPolicy = syncOff
+
+// Progress reporting frequency for running jobs. Raising these trades status
+// freshness for less contention on jobsMu when many jobs run at once.
+var (
+	progressEveryBatches = 1
+	progressInterval     time.Duration
+)
+
+// sortBlockResults sorts a batch by block number and drops any duplicates,
+// so no block is written twice
+func sortBlockResults(results []*BlockResult) []*BlockResult {
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].BlockNum < results[j].BlockNum
+	})
+	return slices.CompactFunc(results, func(a, b *BlockResult) bool {
+		return a.BlockNum == b.BlockNum
+	})
+}
+
+// cacheErrorLimit fails a job once more cache errors than this happened on
+// its network while it ran; 0 never fails it, falling back to RPC instead
+var cacheErrorLimit uint64
+
+// livePollInterval is how often /live checks for a new head block, and
+// liveMaxBackfill how far behind the head a /live stream may start
+var livePollInterval = 4 * time.Second
+
+const liveMaxBackfill = 1000
+
+// maxBlockNumber bounds requested blocks, as the cache stores them in signed
+// 64-bit SQLite integers. With steps bounded the same way, a block number
+// plus a step never overflows a uint64.
+const maxBlockNumber = math.MaxInt64
+
+// Gap policies for blocks missing from a batch
+const (
+	gapStrict   = "strict"    // stop writing at the gap and wait for the block
+	gapSkip     = "skip"      // write past the gap, leaving a hole
+	gapFillZero = "fill-zero" // write a zeroed placeholder row for the block
+)
+
+var gapPolicies = []string{gapStrict, gapSkip, gapFillZero}
+
+// maxStrictGapWaits is how many times a job waits gapWait for a block at
+// a strict gap before failing, so /retry can resume at it later
+const maxStrictGapWaits = 5
+
+// Failure policies for blocks that fail to fetch or parse, as opposed to
+// blocks the provider doesn't have. A strict gap policy always blocks.
+const (
+	failureBlock   = "block"   // fail the job at the block, so it can be retried
+	failureAdvance = "advance" // pass it like a gap under the gap policy
+)
+
+// placeholderRow stands in for a missing block under the fill-zero policy
+func placeholderRow(blockNum uint64) *exportRow {
+	return &exportRow{
+		BlockResult: &BlockResult{
+			BlockNum:  blockNum,
+			TimeStamp: time.Unix(0, 0).UTC(),
+			GasUsed:   new(big.Int),
+			Tips:      new(big.Int),
+			BaseFee:   new(big.Int),
+		},
+		BaseFeeDelta: new(big.Int),
+	}
+}
+
+// Units for wei amounts in CSV output
+const (
+	unitsWei   = "wei"
+	unitsEther = "eth" // fixed-scale decimal ETH with 18 decimals
+)
+
+// Timestamp formats for CSV output
+const (
+	timestampUnix    = "unix" // seconds since the epoch, as cached
+	timestampRFC3339 = "rfc3339"
+)
+
+// fetchRequest describes one run of parallelFetcher
+type fetchRequest struct {
+	// Ranges are written one after another into the same file, skipping
+	// blocks before From
+	Ranges []blockRange
+	From   uint64
+
+	FilePath string
+	Opts     fetchOptions
+	// Resume appends to an existing file instead of starting a new one
+	Resume bool
+
+	// ResultsKey keys the rows in job_results when Opts.Results is set
+	ResultsKey string
+	// Progress, if set, is called as the written range grows
+	Progress func(fetchProgress)
+}
+
+// fetchProgress reports how far a fetch has got. The counts and gaps are
+// those accumulated since the previous call.
+type fetchProgress struct {
+	// LastWritten is the last block written or passed
+	LastWritten uint64
+	// NextBlock is the next block to write, where a resume starts
+	NextBlock uint64
+	// FlushedBytes is the size of the file up to LastWritten
+	FlushedBytes int64
+
+	Blocks      uint64
+	Rows        uint64
+	EmptyBlocks uint64
+	Gaps        []uint64
+	Failed      []uint64
+}
+
+// parallelFetcher fetches blocks in parallel batches and writes sorted output in the requested format.
+// It doesn't depend on the job layer, which follows along through req.Progress.
+func parallelFetcher(ctx context.Context, analyzer *Analyzer, req fetchRequest) (err error) {
+	ranges, from, filePath, opts, resume := req.Ranges, req.From, req.FilePath, req.Opts, req.Resume
+	if opts.RPCTimeout > 0 {
+		ctx = WithRPCTimeout(ctx, opts.RPCTimeout)
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(filePath, flags, 0644)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	writer := csv.NewWriter(f)
-	defer writer.Flush()
+	var out io.Writer = f
+	var gz *gzip.Writer
+	if opts.Compress == "gzip" {
+		// Resuming appends a new gzip member, which readers concatenate
+		gz = gzip.NewWriter(f)
+		out = gz
+	}
 
-	// Write header once
-	writer.Write([]string{"block_number", "timestamp", "gas_used", "tips"})
+	// Writes the header once, if the format has one
+	writer := outputFormats[opts.Format].newWriter(out, !resume, opts)
+	if gz != nil {
+		writer = &gzipRowWriter{writer, gz}
+	}
+	if opts.Results {
+		writer = &resultsRowWriter{rowWriter: writer, db: analyzer.db, jobID: req.ResultsKey}
+	}
 
 	const batchSize = 500
-	lastWritten := start
+	// lastWritten is the next block to write; blocks advance by step.
+	// lastDone is the last block passed, once advanced is set.
+	step := max(opts.Step, 1)
+	var lastWritten, lastDone uint64
+	advanced := false
+	var blocksDone, blocksReported uint64
+	// pass advances lastWritten over the block it points at
+	pass := func() {
+		lastDone, advanced = lastWritten, true
+		lastWritten += step
+		blocksDone++
+	}
+	var rowsWritten, rowsReported uint64
+	var emptyBlocks uint64 // not yet reported
+	var flushedBytes int64 // file size after the last completed batch
+	if info, err := f.Stat(); err == nil {
+		flushedBytes = info.Size()
+	}
+	var gaps, failedBlocks []uint64 // not yet reported
+
+	// Progress is published every progressEveryBatches batches or every
+	// progressInterval, whichever comes first, and always on return
+	batchesSinceReport := 0
+	lastReport := time.Now()
+	reportProgress := func() {
+		batchesSinceReport = 0
+		lastReport = time.Now()
+		if !advanced || req.Progress == nil {
+			return // nothing written yet
+		}
+		req.Progress(fetchProgress{
+			LastWritten:  lastDone,
+			NextBlock:    lastWritten,
+			FlushedBytes: flushedBytes,
+			Blocks:       blocksDone - blocksReported,
+			Rows:         rowsWritten - rowsReported,
+			EmptyBlocks:  emptyBlocks,
+			Gaps:         gaps,
+			Failed:       failedBlocks,
+		})
+		rowsReported, blocksReported = rowsWritten, blocksDone
+		gaps, failedBlocks, emptyBlocks = nil, nil, 0
+	}
+	// Finish the file before the final report, so that it covers whatever
+	// the writer held back, like a rollup's last bucket or the gzip
+	// trailer, and a failed close or sync fails the job
+	defer func() {
+		if cerr := writer.Close(); err == nil {
+			err = cerr
+		}
+		if syncPolicy != syncOff {
+			if serr := f.Sync(); err == nil {
+				err = serr
+			}
+		}
+		if info, serr := f.Stat(); serr == nil {
+			flushedBytes = info.Size()
+		}
+		reportProgress()
+	}()
 
-	for batchStart := start; batchStart <= end; batchStart += batchSize {
-		batchEnd := min(batchStart+batchSize-1, end)
+	// cumulativeGas runs across all ranges, carried on from the file when
+	// resuming
+	var cumulativeGas *big.Int
+	if opts.CumulativeGas {
+		cumulativeGas = new(big.Int)
+		if resume && from > 0 {
+			if cumulativeGas, err = lastCumulativeGasUsed(filePath, from-1); err != nil {
+				return err
+			}
+		}
+	}
+	// runningGas adds gasUsed to cumulativeGas and returns a copy for a row
+	runningGas := func(gasUsed *big.Int) *big.Int {
+		if cumulativeGas == nil {
+			return nil
+		}
+		return new(big.Int).Set(cumulativeGas.Add(cumulativeGas, gasUsed))
+	}
 
-		// Collect this batch in memory only
-		batchResults := make([]*BlockResult, 0, batchEnd-batchStart+1)
-		var mu sync.Mutex
-		var wg sync.WaitGroup
+	cacheErrorsAtStart := analyzer.cacheErrors.Load()
+	concurrency := fetchConcurrency
+	if opts.Concurrency > 0 {
+		concurrency = opts.Concurrency
+	}
+	slots := newRampLimiter(fetchRampStart, concurrency, fetchRampDuration)
+	for _, rg := range ranges {
+		// Ranges wholly before from are already written; the one holding
+		// from resumes at its first sample at or after it
+		start, end := rg.Start, rg.End
+		if from > start {
+			start += (from - start + step - 1) / step * step
+		}
+		if start > end {
+			continue
+		}
+		lastWritten = start
 
-		for bn := batchStart; bn <= batchEnd; bn++ {
-			// Check if stop was requested
-			select {
-			case <-ctx.Done():
-				// Stop: exit cleanly, CSV already has lastWritten contiguous data
+		// The first row's base-fee delta and gas change are taken against the
+		// block before the range, or the sample before it when stepping.
+		// Genesis has no predecessor, so its gas change stays undefined.
+		// A predecessor that fails is handled like any failed block: it
+		// fails the job, or under failureAdvance leaves both undefined.
+		prevBaseFee := new(big.Int)
+		var prevGasUsed *big.Int
+		if (opts.BaseFeeDelta || opts.GasUsedPctChange) && start >= step {
+			prev, err := analyzer.GetBlockGasAndTips(ctx, start-step)
+			switch {
+			case err == nil:
+				prevBaseFee, prevGasUsed = prev.BaseFee, prev.GasUsed
+			case ctx.Err() != nil:
 				return nil
+			case opts.FailurePolicy == failureAdvance:
+				prevBaseFee = nil
+				failedBlocks = append(failedBlocks, start-step)
 			default:
+				return fmt.Errorf("block %d: %w", start-step, err)
+			}
+		}
+
+		// The moving-average window picks up the samples of this range
+		// already written before a resume
+		var movingAvg *movingAverage
+		if opts.MovingAvgWindow > 0 {
+			movingAvg = newMovingAverage(opts.MovingAvgWindow)
+			first := start - min((start-rg.Start)/step, uint64(opts.MovingAvgWindow-1))*step
+			for bn := first; bn < start; bn += step {
+				prev, err := analyzer.GetBlockGasAndTips(ctx, bn)
+				if err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					return err
+				}
+				movingAvg.Add(prev.Tips)
+			}
+		}
+
+		// Batches advance from the previous batchEnd rather than by
+		// batchSize*step, which could overflow for huge steps
+		var batchEnd uint64
+		gapWaits := 0 // consecutive batches stopped at the same strict gap
+		for batchStart := start; ; {
+			// The last sampled block of this batch
+			batchEnd = batchStart + min(batchSize-1, (end-batchStart)/step)*step
+			batchBegan, batchRows := time.Now(), rowsWritten
+
+			// Serve what we can from the cache with one query per batch
+			cached, err := analyzer.getCachedSamples(ctx, batchStart, batchEnd, step)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				analyzer.cacheError("Cache error", err)
+			}
+
+			// Collect this batch in memory only
+			batchResults := make([]*BlockResult, 0, (batchEnd-batchStart)/step+1)
+			failed := make(map[uint64]error) // errors of blocks that failed for good
+			var mu sync.Mutex
+			var wg sync.WaitGroup
+
+			var toFetch []uint64
+			for i := uint64(0); i <= (batchEnd-batchStart)/step; i++ {
+				bn := batchStart + i*step
+				// Rows cached before roots or difficulty were stored are
+				// refetched when needed, and gas prices aren't cached at all
+				if r, ok := cached[bn]; ok && (!opts.Roots || r.Roots != nil) && (!opts.Difficulty || r.Difficulty != nil) && !opts.needsGasPrices() {
+					batchResults = append(batchResults, r)
+				} else {
+					toFetch = append(toFetch, bn)
+				}
 			}
 
-			wg.Add(1)
-			go func(blockNum uint64) {
-				defer wg.Done()
+			// The rest are fetched rpcBatchSize blocks per call
+			for chunk := range slices.Chunk(toFetch, max(analyzer.rpcBatchSize, 1)) {
+				// Wait for a fetch slot; this also notices a stop request
+				if err := slots.Acquire(ctx); err != nil {
+					// Stop: exit cleanly, CSV already has lastWritten contiguous data
+					wg.Wait()
+					return nil
+				}
+
+				wg.Add(1)
+				go func(blockNums []uint64) {
+					defer wg.Done()
+					defer slots.Release()
 
-				timestamp, gas, tips := analyzer.GetBlockGasAndTips(ctx, blockNum)
-				if gas != nil && tips != nil {
+					results, errs := analyzer.fetchBlocks(ctx, blockNums)
 					mu.Lock()
-					batchResults = append(batchResults, &BlockResult{
-						BlockNum:  blockNum,
-						TimeStamp: timestamp,
-						GasUsed:   gas,
-						Tips:      tips,
-					})
-					mu.Unlock()
+					defer mu.Unlock()
+					for i, err := range errs {
+						if err == nil {
+							batchResults = append(batchResults, results[i])
+						} else if err != errBlockNotFound && ctx.Err() == nil {
+							failed[blockNums[i]] = err
+						}
+					}
+				}(chunk)
+			}
+
+			wg.Wait()
+
+			batchResults = sortBlockResults(batchResults)
+
+			var logCounts map[uint64]uint64
+			if opts.Logs != nil {
+				logCounts, err = analyzer.LogCounts(ctx, batchStart, batchEnd, *opts.Logs)
+				if err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					return err
 				}
-			}(bn)
-		}
+			}
 
-		wg.Wait()
+			var gasByTypes map[uint64]*gasByType
+			if opts.GasByType {
+				blockNums := make([]uint64, len(batchResults))
+				for i, r := range batchResults {
+					blockNums[i] = r.BlockNum
+				}
+				gasByTypes, err = analyzer.GasByType(ctx, blockNums)
+				if err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					return err
+				}
+			}
 
-		// Sort the batch by block number
-		sort.Slice(batchResults, func(i, j int) bool {
-			return batchResults[i].BlockNum < batchResults[j].BlockNum
-		})
+			// Blocks missing after a stop were cancelled, not lost, so only
+			// apply the gap policy while the job is still running
+			policy := opts.GapPolicy
+			if ctx.Err() != nil {
+				policy = gapStrict
+			}
+			// blocked is set once lastWritten reaches a failed block that
+			// the failure policy doesn't let it pass
+			var blocked error
+			// passGap moves lastWritten up to next under a non-strict policy
+			passGap := func(next uint64) error {
+				for lastWritten < next {
+					if err, ok := failed[lastWritten]; ok {
+						if opts.FailurePolicy != failureAdvance {
+							blocked = fmt.Errorf("block %d: %w", lastWritten, err)
+							return nil
+						}
+						failedBlocks = append(failedBlocks, lastWritten)
+					} else {
+						gaps = append(gaps, lastWritten)
+					}
+					if policy == gapFillZero {
+						row := placeholderRow(lastWritten)
+						row.CumulativeGasUsed = runningGas(row.GasUsed)
+						if err := writer.Write(row); err != nil {
+							return err
+						}
+						rowsWritten++
+					}
+					pass()
+				}
+				return nil
+			}
 
-		// Ensure contiguous write from lastWritten onward
-		for _, r := range batchResults {
-			if r.BlockNum == lastWritten {
-				writer.Write([]string{
-					fmt.Sprintf("%d", r.BlockNum),
-					r.TimeStamp.Format(time.RFC3339),
-					r.GasUsed.String(),
-					r.Tips.String(),
-				})
-				lastWritten++
-			} else if r.BlockNum > lastWritten {
-				// Hit a gap — stop writing this batch
-				break
+			// Ensure contiguous write from lastWritten onward
+			for _, r := range batchResults {
+				if r.BlockNum < lastWritten {
+					// Already written; never write a block twice
+					continue
+				}
+				if r.BlockNum > lastWritten && policy != "" && policy != gapStrict {
+					if err := passGap(r.BlockNum); err != nil {
+						return err
+					}
+				}
+				if r.BlockNum == lastWritten {
+					row := &exportRow{BlockResult: r, LogCount: logCounts[r.BlockNum], GasByType: gasByTypes[r.BlockNum]}
+					if r.TxCount == 0 {
+						emptyBlocks++
+					}
+					if opts.BaseFeeDelta {
+						if prevBaseFee != nil {
+							row.BaseFeeDelta = new(big.Int).Sub(r.BaseFee, prevBaseFee)
+						}
+						prevBaseFee = r.BaseFee
+					}
+					if opts.GasUsedPctChange {
+						row.GasUsedChange = pctChange(prevGasUsed, r.GasUsed)
+						prevGasUsed = r.GasUsed
+					}
+					// Filtered blocks still count toward contiguity and
+					// the moving average
+					if movingAvg != nil {
+						row.TipsMovingAvg = movingAvg.Add(r.Tips)
+					}
+					if opts.MinTips == nil || r.Tips.Cmp(opts.MinTips) >= 0 {
+						row.CumulativeGasUsed = runningGas(r.GasUsed)
+						if err := writer.Write(row); err != nil {
+							return err
+						}
+						rowsWritten++
+					}
+					pass()
+				} else if r.BlockNum > lastWritten {
+					// Hit a gap — stop writing this batch
+					break
+				}
 			}
+			if lastWritten <= batchEnd && policy != "" && policy != gapStrict && blocked == nil {
+				if err := passGap(batchEnd + step); err != nil {
+					return err
+				}
+			}
+			if err, ok := failed[lastWritten]; ok && blocked == nil {
+				// Stopped at a failure under a strict gap policy
+				blocked = fmt.Errorf("block %d: %w", lastWritten, err)
+			}
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+			if syncPolicy == syncBatch {
+				if err := f.Sync(); err != nil {
+					return err
+				}
+			}
+			if info, err := f.Stat(); err == nil {
+				flushedBytes = info.Size()
+			}
+			analyzer.batches.Observe(time.Since(batchBegan), rowsWritten-batchRows)
+			batchesSinceReport++
+			if batchesSinceReport >= progressEveryBatches || (progressInterval > 0 && time.Since(lastReport) >= progressInterval) {
+				reportProgress()
+			}
+			if blocked != nil {
+				// Everything before the failed block is flushed, so a
+				// retry resumes at it
+				return blocked
+			}
+			if n := analyzer.cacheErrors.Load() - cacheErrorsAtStart; cacheErrorLimit > 0 && n > cacheErrorLimit {
+				return fmt.Errorf("giving up after %d cache errors; the cache database may be broken", n)
+			}
+			if lastWritten <= batchEnd {
+				// A strict gap: the provider doesn't have lastWritten (yet).
+				// Wait for it and fetch again from there, a bounded number
+				// of times, rather than fetching blocks that can't be
+				// written and finishing with a short file.
+				if ctx.Err() != nil {
+					return nil
+				}
+				if gapWaits++; gapWaits > maxStrictGapWaits {
+					return fmt.Errorf("block %d: %w after %d attempts", lastWritten, errBlockNotFound, gapWaits)
+				}
+				log.Printf("Waiting for missing block %d (attempt %d of %d)", lastWritten, gapWaits, maxStrictGapWaits)
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(analyzer.gapWait()):
+				}
+				batchStart = lastWritten
+				continue
+			}
+			gapWaits = 0
+			if end-batchEnd < step {
+				break // no sample left in the range
+			}
+			batchStart = batchEnd + step
 		}
-		writer.Flush()
-		jobsMu.Lock()
-		if job, ok := jobs[ctx.Value("jobID").(string)]; ok {
-			job.LastWritten = lastWritten - 1
-		}
-		jobsMu.Unlock()
 	}
 
 	return nil
 }
 
-func main() {
-	apiKey := os.Getenv("ALCHEMY_API_KEY")
-	analyzer := NewAnalyzer(apiKey, "/var/eth-fetcher/results.db")
-
-	// Submit request endpoint
-	http.HandleFunc("/request", func(w http.ResponseWriter, r *http.Request) {
-		startStr := r.URL.Query().Get("start")
-		endStr := r.URL.Query().Get("end")
-		start, err := strconv.ParseUint(startStr, 10, 64)
+// handleRequest validates a fetch request and starts its job
+func handleRequest(w http.ResponseWriter, r *http.Request) {
+	var start, end uint64
+	var ranges []blockRange
+	var err error
+	var startTime, endTime *time.Time
+	if v := r.URL.Query().Get("ranges"); v != "" {
+		if r.URL.Query().Has("start") || r.URL.Query().Has("end") || r.URL.Query().Has("startTime") || r.URL.Query().Has("endTime") {
+			http.Error(w, "ranges cannot be combined with start, end, startTime or endTime", 400)
+			return
+		}
+		ranges, err = parseRanges(v)
 		if err != nil {
-			http.Error(w, "Invalid start block", 400)
+			http.Error(w, "Invalid ranges: "+err.Error(), 400)
 			return
 		}
-		end, err := strconv.ParseUint(endStr, 10, 64)
-		if err != nil || end < start {
-			http.Error(w, "Invalid end block", 400)
+		start, end = ranges[0].Start, ranges[len(ranges)-1].End
+	} else {
+		if (r.URL.Query().Has("startTime") && r.URL.Query().Has("start")) || (r.URL.Query().Has("endTime") && r.URL.Query().Has("end")) {
+			http.Error(w, "startTime and endTime replace start and end", 400)
 			return
 		}
-
-		jobID := uuid.New().String()
-		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "jobID", jobID))
-
-		filePath := fmt.Sprintf("/var/eth-fetcher/jobs/eth_blocks_%d_%d_%s.csv", start, end, jobID)
-
-		jobsMu.Lock()
-		jobs[jobID] = &JobStatus{
-			Status: "pending",
-			Start:  start,
-			End:    end,
-			Cancel: cancel,
+		// Times are resolved to blocks once the network is known
+		if v := r.URL.Query().Get("startTime"); v != "" {
+			t, err := parseTimestamp(v)
+			if err != nil {
+				http.Error(w, "Invalid startTime", 400)
+				return
+			}
+			startTime = &t
+		} else if start, err = strconv.ParseUint(r.URL.Query().Get("start"), 10, 64); err != nil {
+			http.Error(w, "Invalid start block", 400)
+			return
 		}
-		jobsMu.Unlock()
-
-		go func() {
-			err := parallelFetcher(ctx, analyzer, start, end, filePath)
-			jobsMu.Lock()
-			defer jobsMu.Unlock()
-			if err != nil && ctx.Err() != context.Canceled {
-				jobs[jobID].Status = "error"
-				jobs[jobID].Error = err.Error()
-			} else {
-				jobs[jobID].Status = "done"
-				jobs[jobID].FilePath = filePath
+		if v := r.URL.Query().Get("endTime"); v != "" {
+			t, err := parseTimestamp(v)
+			if err != nil {
+				http.Error(w, "Invalid endTime", 400)
+				return
+			}
+			endTime = &t
+		} else {
+			end, err = strconv.ParseUint(r.URL.Query().Get("end"), 10, 64)
+			if err != nil || end > maxBlockNumber {
+				http.Error(w, "Invalid end block", 400)
+				return
 			}
-		}()
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"jobID": jobID})
-	})
-
-	// Stop job endpoint
-	http.HandleFunc("/stop/", func(w http.ResponseWriter, r *http.Request) {
-		jobID := r.URL.Path[len("/stop/"):]
-		jobsMu.RLock()
-		job, ok := jobs[jobID]
-		if ok && job.Status == "pending" {
-			job.Cancel() // cancel context
 		}
-		jobsMu.RUnlock()
-		if !ok {
-			http.Error(w, "Job not found", 404)
+	}
+	opts := fetchOptions{
+		Format:           formatCSV,
+		BaseFeeDelta:     r.URL.Query().Get("baseFeeDelta") == "true",
+		BlockSize:        r.URL.Query().Get("blockSize") == "true",
+		AvgTipPerGas:     r.URL.Query().Get("avgTipPerGas") == "true",
+		TxCount:          r.URL.Query().Get("txCount") == "true",
+		GasUsedPctChange: r.URL.Query().Get("gasUsedPctChange") == "true",
+		BaseFee:          r.URL.Query().Get("baseFee") == "true",
+		Roots:            r.URL.Query().Get("roots") == "true",
+		Difficulty:       r.URL.Query().Get("difficulty") == "true",
+	}
+	if v := r.URL.Query().Get("format"); v != "" {
+		if _, ok := outputFormats[v]; !ok {
+			http.Error(w, "Invalid format", 400)
 			return
 		}
-		w.WriteHeader(200)
-		w.Write([]byte("Stopping job"))
-	})
-
-	// Download endpoint
-	http.HandleFunc("/download/", func(w http.ResponseWriter, r *http.Request) {
-		jobID := r.URL.Path[len("/download/"):]
-		jobsMu.RLock()
-		job, ok := jobs[jobID]
-		defer jobsMu.RUnlock()
-		if !ok || (job.Status != "done" && job.Status != "stopped") || job.FilePath == "" {
-			http.Error(w, "File not ready or job not found", 404)
+		opts.Format = v
+	}
+	if v := r.URL.Query().Get("units"); v != "" {
+		if (v != unitsWei && v != unitsEther) || opts.Format != formatCSV {
+			http.Error(w, "Invalid units", 400)
 			return
 		}
-		w.Header().Set("Content-Type", "text/csv")
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", job.FilePath[len("jobs/"):]))
-		http.ServeFile(w, r, job.FilePath)
-	})
+		opts.Units = v
+	}
+	if v := r.URL.Query().Get("timestampFormat"); v != "" {
+		if (v != timestampUnix && v != timestampRFC3339) || opts.Format != formatCSV {
+			http.Error(w, "Invalid timestampFormat", 400)
+			return
+		}
+		if v == timestampRFC3339 {
+			opts.TimestampFormat = v
+		}
+	}
+	if v := r.URL.Query().Get("lineEnding"); v != "" {
+		if (v != lineEndingLF && v != lineEndingCRLF) || opts.Format != formatCSV {
+			http.Error(w, "Invalid lineEnding", 400)
+			return
+		}
+		opts.LineEnding = v
+	}
+	if r.URL.Query().Get("timeBuckets") == "true" {
+		if opts.Format != formatCSV {
+			http.Error(w, "timeBuckets is only supported for csv", 400)
+			return
+		}
+		opts.TimeBuckets = true
+	}
+	if topic := strings.ToLower(r.URL.Query().Get("topic")); topic != "" {
+		address := strings.ToLower(r.URL.Query().Get("address"))
+		if !hashPattern.MatchString(topic) || (address != "" && !addressPattern.MatchString(address)) {
+			http.Error(w, "Invalid topic or address", 400)
+			return
+		}
+		opts.Logs = &logFilter{Topic: topic, Address: address}
+	}
+	if v := r.URL.Query().Get("minTips"); v != "" {
+		minTips, ok := new(big.Int).SetString(v, 10)
+		if !ok || minTips.Sign() < 0 {
+			http.Error(w, "Invalid minTips", 400)
+			return
+		}
+		opts.MinTips = minTips
+	}
+	if v := r.URL.Query().Get("maxDuration"); v != "" {
+		opts.MaxDuration, err = time.ParseDuration(v)
+		if err != nil || opts.MaxDuration <= 0 {
+			http.Error(w, "Invalid maxDuration", 400)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("rpcTimeout"); v != "" {
+		opts.RPCTimeout, err = time.ParseDuration(v)
+		if err != nil || opts.RPCTimeout <= 0 {
+			http.Error(w, "Invalid rpcTimeout", 400)
+			return
+		}
+	}
+
+	if v := r.URL.Query().Get("gapPolicy"); v != "" {
+		if !slices.Contains(gapPolicies, v) {
+			http.Error(w, "Invalid gapPolicy", 400)
+			return
+		}
+		opts.GapPolicy = v
+	}
+	if v := r.URL.Query().Get("failurePolicy"); v != "" {
+		if v != failureBlock && v != failureAdvance {
+			http.Error(w, "Invalid failurePolicy", 400)
+			return
+		}
+		// A strict gap policy never writes past a block, failed or not
+		if v == failureAdvance && opts.GapPolicy != gapSkip && opts.GapPolicy != gapFillZero {
+			http.Error(w, "failurePolicy=advance requires gapPolicy skip or fill-zero", 400)
+			return
+		}
+		opts.FailurePolicy = v
+	}
+
+	if r.URL.Query().Get("usd") == "true" {
+		opts.USDPrice, err = resolveUSDPrice(r.Context(), networks[defaultNetwork].client)
+		if err != nil {
+			log.Printf("ETH/USD price lookup failed: %v", err)
+			http.Error(w, "Could not determine the ETH/USD price", 502)
+			return
+		}
+	}
+
+	if v := r.URL.Query().Get("network"); v != "" && v != defaultNetwork {
+		if _, ok := networks[v]; !ok {
+			http.Error(w, "Unknown network", 400)
+			return
+		}
+		opts.Network = v
+	}
+	if v := r.URL.Query().Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid concurrency", 400)
+			return
+		}
+		// The server-wide cap still applies
+		opts.Concurrency = min(n, fetchConcurrency)
+	}
+	if v := r.URL.Query().Get("step"); v != "" {
+		opts.Step, err = strconv.ParseUint(v, 10, 64)
+		if err != nil || opts.Step == 0 || opts.Step > maxBlockNumber {
+			http.Error(w, "Invalid step", 400)
+			return
+		}
+		// Log counts come from one eth_getLogs call over the whole batch,
+		// which would cover every block in between
+		if opts.Step > 1 && opts.Logs != nil {
+			http.Error(w, "step can't be combined with topic", 400)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("compress"); v != "" {
+		if v != "gzip" {
+			http.Error(w, "Invalid compress", 400)
+			return
+		}
+		opts.Compress = v
+	}
+	if v := r.URL.Query().Get("movingAvgWindow"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxMovingAvgWindow {
+			http.Error(w, fmt.Sprintf("movingAvgWindow must be between 1 and %d", maxMovingAvgWindow), 400)
+			return
+		}
+		if opts.Format != formatCSV {
+			http.Error(w, "movingAvgWindow is only supported for csv", 400)
+			return
+		}
+		opts.MovingAvgWindow = n
+	}
+	if v := r.URL.Query().Get("gasPriceBuckets"); v != "" {
+		if opts.Format != formatCSV {
+			http.Error(w, "gasPriceBuckets is only supported for csv", 400)
+			return
+		}
+		opts.GasPriceBuckets, err = parseGweiBounds(v)
+		if err != nil {
+			http.Error(w, "Invalid gasPriceBuckets: "+err.Error(), 400)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("priorityFeeBuckets"); v != "" {
+		if opts.Format != formatNDJSON {
+			http.Error(w, "priorityFeeBuckets is only supported for ndjson", 400)
+			return
+		}
+		opts.PriorityFeeBuckets, err = parseGweiBounds(v)
+		if err != nil {
+			http.Error(w, "Invalid priorityFeeBuckets: "+err.Error(), 400)
+			return
+		}
+	}
+	if r.URL.Query().Get("cumulativeGas") == "true" {
+		if opts.Format != formatCSV {
+			http.Error(w, "cumulativeGas is only supported for csv", 400)
+			return
+		}
+		opts.CumulativeGas = true
+	}
+	if r.URL.Query().Get("gasByType") == "true" {
+		if opts.Format != formatCSV {
+			http.Error(w, "gasByType is only supported for csv", 400)
+			return
+		}
+		opts.GasByType = true
+	}
+	opts.Results = r.URL.Query().Get("results") == "true"
+	if v := r.URL.Query().Get("fields"); v != "" {
+		if opts.Format != formatCSV {
+			http.Error(w, "fields is only supported for csv", 400)
+			return
+		}
+		opts.Fields = strings.Split(v, ",")
+		if err := validateFields(opts); err != nil {
+			http.Error(w, "Invalid fields: "+err.Error(), 400)
+			return
+		}
+	}
+
+	if v := r.URL.Query().Get("rollup"); v != "" {
+		if v != rollupHour && v != rollupDay {
+			http.Error(w, "Invalid rollup", 400)
+			return
+		}
+		// Rollup rows have their own columns, and placeholder rows
+		// would land in a 1970 bucket. job_results holds block rows,
+		// which would disagree with the file.
+		if opts.Format != formatCSV || opts.Fields != nil || opts.GapPolicy == gapFillZero || opts.MovingAvgWindow > 0 || opts.GasPriceBuckets != nil || opts.GasByType || opts.CumulativeGas || opts.Results {
+			http.Error(w, "rollup requires csv without fields, fill-zero, movingAvgWindow, gasPriceBuckets, gasByType, cumulativeGas or results", 400)
+			return
+		}
+		opts.Rollup = v
+	}
 
-	// Status endpoint
-	http.HandleFunc("/status/", func(w http.ResponseWriter, r *http.Request) {
-		jobID := r.URL.Path[len("/status/"):]
+	if startTime != nil && endTime != nil && startTime.After(*endTime) {
+		http.Error(w, "startTime is after endTime", 400)
+		return
+	}
+	if startTime != nil {
+		var ok bool
+		start, ok, err = jobAnalyzer(&JobStatus{Options: opts}).FirstBlockAt(r.Context(), *startTime)
+		if err != nil {
+			log.Printf("Failed to resolve startTime %s: %v", startTime.Format(time.RFC3339), err)
+			http.Error(w, "Failed to resolve startTime to a block", 502)
+			return
+		}
+		if !ok {
+			http.Error(w, "startTime is beyond the chain head", 400)
+			return
+		}
+		opts.StartTime = startTime
+	}
+	if endTime != nil {
+		// The last block at or before endTime, which is the head for
+		// times past it. Block timestamps are whole seconds.
+		next, _, err := jobAnalyzer(&JobStatus{Options: opts}).FirstBlockAt(r.Context(), endTime.Truncate(time.Second).Add(time.Second))
+		if err != nil {
+			log.Printf("Failed to resolve endTime %s: %v", endTime.Format(time.RFC3339), err)
+			http.Error(w, "Failed to resolve endTime to a block", 502)
+			return
+		}
+		if next == 0 || next-1 < start {
+			http.Error(w, "No blocks in the requested time range", 400)
+			return
+		}
+		end = next - 1
+		opts.EndTime = endTime
+	} else if end < start {
+		http.Error(w, "Invalid end block", 400)
+		return
+	}
+
+	// Cap the range lag blocks behind the head, to keep clear of
+	// blocks that may still be reorged
+	if v := r.URL.Query().Get("lag"); v != "" {
+		lag, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || lag > maxBlockNumber {
+			http.Error(w, "Invalid lag", 400)
+			return
+		}
+		head, err := jobAnalyzer(&JobStatus{Options: opts}).HeadBlock(r.Context())
+		if err != nil {
+			http.Error(w, "Failed to fetch chain head", 502)
+			return
+		}
+		if head < lag || head-lag < start {
+			http.Error(w, fmt.Sprintf("No blocks from %d are at least %d behind the head (%d)", start, lag, head), 400)
+			return
+		}
+		if end > head-lag {
+			end = head - lag
+			if ranges != nil {
+				ranges = clampRanges(ranges, end)
+				end = ranges[len(ranges)-1].End
+			}
+		}
+		opts.Lag = lag
+	}
+
+	label := strings.TrimSpace(r.URL.Query().Get("label"))
+	if !validLabel(label) {
+		http.Error(w, "Invalid label", 400)
+		return
+	}
+
+	if err := ensureDiskBudget(); err != nil {
+		log.Printf("Disk budget check failed: %v", err)
+		http.Error(w, "Not enough storage for a new job", 507)
+		return
+	}
+
+	jobID, err := newJobID(r.Context(), networks[defaultNetwork])
+	if err != nil {
+		log.Printf("Failed to allocate job ID: %v", err)
+		http.Error(w, "Failed to allocate job ID", 500)
+		return
+	}
+	ext := outputFormats[opts.Format].ext
+	if opts.Compress == "gzip" {
+		ext += ".gz"
+	}
+	filePath := filepath.Join(jobsDir, fmt.Sprintf("eth_blocks_%d_%d_%s.%s", start, end, jobID, ext))
+
+	jobsMu.Lock()
+	job := &JobStatus{
+		Status:    "pending",
+		Label:     label,
+		Start:     start,
+		End:       end,
+		Ranges:    ranges,
+		FilePath:  filePath,
+		Options:   opts,
+		StartedAt: time.Now(),
+	}
+	for _, rg := range job.blockRanges() {
+		job.TotalBlocks += (rg.End-rg.Start)/max(opts.Step, 1) + 1
+	}
+	jobs[jobID] = job
+	startJob(jobAnalyzer(job), jobID, job, start, false)
+	done := job.done
+	purge := evictJobs()
+	jobsMu.Unlock()
+	for id, a := range purge {
+		if err := a.DeleteJobResults(r.Context(), id); err != nil {
+			log.Printf("Failed to delete results of evicted job %s: %v", id, err)
+		}
+	}
+
+	if r.URL.Query().Get("wait") != "true" {
+		writeJSON(w, r, map[string]string{"jobID": jobID})
+		return
+	}
+	// Block until the job finishes; a disconnecting client leaves it running
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		if r.Context().Err() == context.DeadlineExceeded {
+			http.Error(w, "Timed out waiting for job "+jobID, 503)
+		}
+		return
+	}
+	jobsMu.RLock()
+	status := *job
+	jobsMu.RUnlock()
+	writeJSON(w, r, struct {
+		JobID string `json:"jobID"`
+		*JobStatus
+	}{jobID, &status})
+}
+
+// handleRetry continues a failed job from where it errored
+func handleRetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	jobID := r.URL.Path[len("/retry/"):]
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	job, ok := jobs[jobID]
+	if !ok {
+		http.Error(w, "Job not found", 404)
+		return
+	}
+	if job.Status != "error" && job.Status != "interrupted" {
+		http.Error(w, "Only failed or interrupted jobs can be retried", 409)
+		return
+	}
+	analyzer := jobAnalyzer(job)
+	if analyzer == nil {
+		http.Error(w, "The job's network is no longer configured", 409)
+		return
+	}
+	from, resume := resumePoint(job)
+	job.Status = "pending"
+	job.Error = ""
+	startJob(analyzer, jobID, job, from, resume)
+	writeJSON(w, r, map[string]string{"jobID": jobID})
+}
+
+// handleResume continues a stopped or interrupted job where it left off
+func handleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	jobID := r.URL.Path[len("/resume/"):]
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	job, ok := jobs[jobID]
+	if !ok {
+		http.Error(w, "Job not found", 404)
+		return
+	}
+	if job.Status != "stopped" && job.Status != "interrupted" {
+		http.Error(w, "Only stopped or interrupted jobs can be resumed", 409)
+		return
+	}
+	analyzer := jobAnalyzer(job)
+	if analyzer == nil {
+		http.Error(w, "The job's network is no longer configured", 409)
+		return
+	}
+	from, resume := resumePoint(job)
+	job.Status = "pending"
+	job.Error = ""
+	startJob(analyzer, jobID, job, from, resume)
+	writeJSON(w, r, map[string]string{"jobID": jobID})
+}
+
+// handleStop cancels a running job
+func handleStop(w http.ResponseWriter, r *http.Request) {
+	jobID := r.URL.Path[len("/stop/"):]
+	jobsMu.Lock()
+	job, ok := jobs[jobID]
+	if ok && job.Status == "pending" {
+		job.stopStatus = "stopped"
+		job.Cancel() // cancel context
+	}
+	jobsMu.Unlock()
+	if !ok {
+		http.Error(w, "Job not found", 404)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write([]byte("Stopping job"))
+}
+
+// handleEvents streams a job's progress as Server-Sent Events
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	jobID := r.URL.Path[len("/events/"):]
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", 500)
+		return
+	}
+	// Reconnecting clients pick up after the last event they saw
+	var seq uint64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		seq, _ = strconv.ParseUint(v, 10, 64)
+	}
+	started := false
+	for {
 		jobsMu.RLock()
 		job, ok := jobs[jobID]
-		defer jobsMu.RUnlock()
+		var events []jobEvent
+		var changed <-chan struct{}
+		terminal := false
+		if ok {
+			events, changed = job.eventsSince(seq)
+			terminal = job.Status != "pending"
+		}
+		jobsMu.RUnlock()
 		if !ok {
-			http.Error(w, "Job not found", 404)
+			if !started {
+				http.Error(w, "Job not found", 404)
+			}
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(job)
-	})
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			started = true
+		}
+		for _, e := range events {
+			kind := "progress"
+			if e.Status != "pending" {
+				kind = "complete"
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, kind, data)
+			seq = e.Seq
+		}
+		flusher.Flush()
+		if terminal {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
 
-	// List jobs endpoint
-	http.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
-		jobsMu.RLock()
-		jobList := slices.Collect(maps.Keys(jobs))
+// handleLive streams each new block as it appears
+func handleLive(w http.ResponseWriter, r *http.Request) {
+	analyzer, ok := analyzerFor(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", 500)
+		return
+	}
+	head, err := analyzer.HeadBlockWithin(r.Context(), livePollInterval)
+	if err != nil {
+		http.Error(w, "Failed to fetch head block", 502)
+		return
+	}
+	// next is the first block not yet sent. Reconnecting clients pick up
+	// after the last block they saw, and from backfills older blocks.
+	next := head
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			next = n + 1
+		}
+	} else if v := r.URL.Query().Get("from"); v != "" {
+		next, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid from block", 400)
+			return
+		}
+	}
+	// Compared as a difference, as next+liveMaxBackfill could overflow
+	if next < head && head-next > liveMaxBackfill {
+		http.Error(w, fmt.Sprintf("Can backfill at most %d blocks", liveMaxBackfill), 400)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+	for {
+		// Send everything up to head, including blocks mined between polls
+		for ; next <= head; next++ {
+			result, err := analyzer.GetBlockGasAndTips(r.Context(), next)
+			if err != nil {
+				// Not available yet, or the client left; retry next poll
+				break
+			}
+			data, _ := json.Marshal(newBlockRecord(result))
+			fmt.Fprintf(w, "id: %d\nevent: block\ndata: %s\n\n", next, data)
+			flusher.Flush()
+		}
+		select {
+		case <-time.After(livePollInterval):
+		case <-r.Context().Done():
+			return
+		}
+		if h, err := analyzer.HeadBlockWithin(r.Context(), livePollInterval); err == nil {
+			head = h
+		}
+	}
+}
+
+// handleDownload serves a job's output file
+func handleDownload(w http.ResponseWriter, r *http.Request) {
+	jobID := r.URL.Path[len("/download/"):]
+	jobsMu.RLock()
+	job, ok := jobs[jobID]
+	var status, filePath, format, compress string
+	var flushed int64
+	var opts fetchOptions
+	var start, end uint64
+	if ok {
+		status, filePath, format, compress, flushed = job.Status, job.FilePath, job.Options.Format, job.Options.Compress, job.FlushedBytes
+		opts, start, end = job.Options, job.Start, job.End
+	}
+	jobsMu.RUnlock()
+	allowPartial := (status == "error" || status == "interrupted") && r.URL.Query().Get("allowPartial") == "true"
+	if !ok || (status != "done" && status != "stopped" && status != "pending" && !allowPartial) || filePath == "" {
+		http.Error(w, "File not ready or job not found", 404)
+		return
+	}
+	if v := r.URL.Query().Get("maxAge"); v != "" {
+		maxAge, err := time.ParseDuration(v)
+		if err != nil || maxAge <= 0 {
+			http.Error(w, "Invalid maxAge", 400)
+			return
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			http.Error(w, "File not ready or job not found", 404)
+			return
+		}
+		if time.Since(info.ModTime()) > maxAge {
+			http.Error(w, "File is older than maxAge; submit a new job", 410)
+			return
+		}
+	}
+	q := r.URL.Query()
+	filtered := q.Has("from") || q.Has("to")
+	from, to := start, end
+	if filtered {
+		if format != formatCSV || opts.Rollup != "" {
+			http.Error(w, "from and to are only supported for CSV jobs without rollup", 400)
+			return
+		}
+		var err error
+		if v := q.Get("from"); v != "" {
+			if from, err = strconv.ParseUint(v, 10, 64); err != nil {
+				http.Error(w, "Invalid from", 400)
+				return
+			}
+		}
+		if v := q.Get("to"); v != "" {
+			if to, err = strconv.ParseUint(v, 10, 64); err != nil {
+				http.Error(w, "Invalid to", 400)
+				return
+			}
+		}
+		if from > to || from < start || to > end {
+			http.Error(w, fmt.Sprintf("from and to must satisfy %d <= from <= to <= %d", start, end), 400)
+			return
+		}
+	}
+	if compress == "gzip" {
+		w.Header().Set("Content-Type", "application/gzip")
+	} else {
+		w.Header().Set("Content-Type", outputFormats[format].contentType)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(filePath)))
+	// Compress plain files on the fly for clients that accept gzip. Byte
+	// ranges refer to the file as stored, so range requests get it as is.
+	encode := false
+	if compress != "gzip" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encode = r.Header.Get("Range") == "" && acceptsGzip(r)
+	}
+	if (status == "done" || status == "stopped") && !filtered && !encode {
+		http.ServeFile(w, r, filePath)
+		return
+	}
+
+	if allowPartial && status == "interrupted" {
+		w.Header().Set("Warning", `199 eth-fetcher "Incomplete data: the job was interrupted"`)
+	} else if allowPartial {
+		w.Header().Set("Warning", `199 eth-fetcher "Incomplete data: the job failed"`)
+	}
+
+	// A running or failed job's file may end in a partly flushed row,
+	// so serve only the prefix up to its last completed batch
+	f, err := os.Open(filePath)
+	if err != nil {
+		http.Error(w, "File not ready or job not found", 404)
+		return
+	}
+	defer f.Close()
+	if !filtered {
+		var content io.ReadSeeker = f
+		if status != "done" && status != "stopped" {
+			w.Header().Set("Cache-Control", "no-store")
+			content = io.NewSectionReader(f, 0, flushed)
+		}
+		if encode {
+			if err := serveGzip(w, r, content); err != nil {
+				log.Printf("Download %s: %v", jobID, err)
+			}
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, content)
+		return
+	}
+
+	// Filter the rows on the fly, so the response has no known length
+	// and can't serve byte ranges
+	var src io.Reader = f
+	if status != "done" && status != "stopped" {
+		w.Header().Set("Cache-Control", "no-store")
+		src = io.NewSectionReader(f, 0, flushed)
+	}
+	if encode {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	if err := filterCSVRange(w, src, compress == "gzip", encode, opts, from, to); err != nil {
+		if errors.Is(err, errNoBlockColumn) {
+			w.Header().Del("Content-Encoding")
+			http.Error(w, "from and to need the block_number field", 400)
+			return
+		}
+		log.Printf("Download %s: %v", jobID, err)
+	}
+}
+
+// handleStatus reports on a job
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	jobID, sub, _ := strings.Cut(r.URL.Path[len("/status/"):], "/")
+	jobsMu.RLock()
+	job, ok := jobs[jobID]
+	if !ok {
+		jobsMu.RUnlock()
+		http.Error(w, "Job not found", 404)
+		return
+	}
+	switch sub {
+	case "":
+		defer jobsMu.RUnlock()
+		writeJSON(w, r, struct {
+			*JobStatus
+			jobProgress
+		}{job, job.progress()})
+	case "preview":
+		if job.Options.Format != formatCSV {
+			jobsMu.RUnlock()
+			http.Error(w, "Preview is only available for CSV jobs", 400)
+			return
+		}
+		filePath, lastWritten, started := job.FilePath, job.LastWritten, job.LastWritten >= job.Start
+		jobsMu.RUnlock()
+		limit := 10
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "Invalid limit", 400)
+				return
+			}
+			limit = min(n, 1000)
+		}
+		rows := []map[string]string{}
+		if started {
+			var err error
+			rows, err = previewRows(filePath, lastWritten, limit)
+			if err != nil {
+				http.Error(w, "Failed to read job file", 500)
+				return
+			}
+		}
+		writeJSON(w, r, rows)
+	case "manifest":
+		filePath := job.FilePath
 		jobsMu.RUnlock()
+		data, err := os.ReadFile(manifestPath(filePath))
+		if os.IsNotExist(err) {
+			http.Error(w, "Manifest not available until the job finishes", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read manifest", 500)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(jobList)
+		w.Write(data)
+	default:
+		jobsMu.RUnlock()
+		http.NotFound(w, r)
+	}
+}
+
+// handleJobs lists the known jobs
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	label := r.URL.Query().Get("label")
+	verbose := r.URL.Query().Get("verbose") == "true"
+	jobsMu.RLock()
+	jobList := slices.Collect(maps.Keys(jobs))
+	if label != "" {
+		jobList = slices.DeleteFunc(jobList, func(id string) bool {
+			return jobs[id].Label != label
+		})
+	}
+	var summaries []jobSummary
+	if verbose {
+		summaries = make([]jobSummary, 0, len(jobList))
+		for _, id := range jobList {
+			job := jobs[id]
+			summaries = append(summaries, jobSummary{
+				JobID:  id,
+				Label:  job.Label,
+				Status: job.Status,
+				Start:  job.Start,
+				End:    job.End,
+			})
+		}
+	}
+	jobsMu.RUnlock()
+	if verbose {
+		writeJSON(w, r, summaries)
+	} else {
+		writeJSON(w, r, jobList)
+	}
+}
+
+// handleDeleteJob forgets a job and its files
+func handleDeleteJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	jobID := r.URL.Path[len("/jobs/"):]
+	query := r.URL.Query()
+	found, err := deleteJob(r.Context(), jobID, query.Get("force") == "true", query.Get("purge") == "true")
+	if !found {
+		http.Error(w, "Job not found", 404)
+		return
+	}
+	if errors.Is(err, errJobRunning) {
+		http.Error(w, "Job is running; pass force=true to stop and delete it", 409)
+		return
+	}
+	if errors.Is(err, errNetworkGone) {
+		http.Error(w, "Job deleted, but its results can't be: its network is no longer configured", 409)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete job %s: %v", jobID, err)
+		http.Error(w, "Failed to delete job", 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleFiles lists the completed job artifacts whose range intersects [start, end]
+func handleFiles(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.ParseUint(r.URL.Query().Get("start"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid start block", 400)
+		return
+	}
+	end, err := strconv.ParseUint(r.URL.Query().Get("end"), 10, 64)
+	if err != nil || end < start {
+		http.Error(w, "Invalid end block", 400)
+		return
+	}
+	files := []jobFile{}
+	jobsMu.RLock()
+	for id, job := range jobs {
+		if (job.Status != "done" && job.Status != "stopped") || job.FilePath == "" {
+			continue
+		}
+		if job.Start > end || job.End < start {
+			continue
+		}
+		files = append(files, jobFile{
+			JobID:       id,
+			Start:       job.Start,
+			End:         job.End,
+			LastWritten: job.LastWritten,
+			Status:      job.Status,
+			DownloadURL: "/download/" + id,
+		})
+	}
+	jobsMu.RUnlock()
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Start != files[j].Start {
+			return files[i].Start < files[j].Start
+		}
+		return files[i].JobID < files[j].JobID
 	})
+	writeJSON(w, r, files)
+}
+
+// handleArchive streams the cached metrics of a block range as zstd-compressed NDJSON
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.ParseUint(r.URL.Query().Get("start"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid start block", 400)
+		return
+	}
+	end, err := strconv.ParseUint(r.URL.Query().Get("end"), 10, 64)
+	if err != nil || end < start || end > maxBlockNumber {
+		http.Error(w, "Invalid end block", 400)
+		return
+	}
+	analyzer, ok := analyzerFor(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/zstd")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("eth_blocks_%d_%d.ndjson.zst", start, end)))
+	if err := writeArchive(r.Context(), analyzer, start, end, w); err != nil {
+		// Headers are already sent; the truncated stream fails to decompress
+		log.Printf("Archive %d-%d aborted: %v", start, end, err)
+	}
+}
+
+// handleVacuum compacts the SQLite cache
+func handleVacuum(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	analyzer, ok := analyzerFor(w, r)
+	if !ok {
+		return
+	}
+	before, after, err := analyzer.Vacuum(r.Context())
+	if errors.Is(err, errVacuumRunning) {
+		http.Error(w, "Vacuum already running", 409)
+		return
+	}
+	if err != nil {
+		// Typically SQLITE_BUSY while jobs are writing to the cache
+		http.Error(w, "Vacuum failed: "+truncateError(err.Error()), 503)
+		return
+	}
+	writeJSON(w, r, map[string]int64{"sizeBefore": before, "sizeAfter": after})
+}
+
+// handleImport bulk-loads block metrics into the cache
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson") {
+			format = "ndjson"
+		}
+	}
+	if format != "csv" && format != "ndjson" {
+		http.Error(w, "Invalid format", 400)
+		return
+	}
+	analyzer, ok := analyzerFor(w, r)
+	if !ok {
+		return
+	}
+	if err := decodeBody(r); err == errBodyEncoding {
+		http.Error(w, "Unsupported Content-Encoding", 415)
+		return
+	} else if err != nil {
+		http.Error(w, "Invalid gzip body", 400)
+		return
+	}
+	imported, skipped, err := analyzer.ImportCache(r.Context(), r.Body, format)
+	if errors.Is(err, errImportHeader) {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Import failed: "+truncateError(err.Error()), 500)
+		return
+	}
+	writeJSON(w, r, map[string]int{"imported": imported, "skipped": skipped})
+}
+
+// handleBlock serves the metrics of a single block
+func handleBlock(w http.ResponseWriter, r *http.Request) {
+	analyzer, ok := analyzerFor(w, r)
+	if !ok {
+		return
+	}
+	if r.URL.Path[len("/block/"):] == "pending" {
+		result, err := analyzer.PendingBlock(r.Context())
+		if err != nil {
+			http.Error(w, "Failed to fetch pending block", 502)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, r, struct {
+			blockRecord
+			Provisional bool `json:"provisional"`
+		}{newBlockRecord(result), true})
+		return
+	}
+	blockNum, err := strconv.ParseUint(r.URL.Path[len("/block/"):], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid block number", 400)
+		return
+	}
+	head, err := analyzer.HeadBlock(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to fetch chain head", 502)
+		return
+	}
+	if blockNum > head {
+		http.Error(w, "Block not found", 404)
+		return
+	}
+	result, err := analyzer.GetBlockGasAndTips(r.Context(), blockNum)
+	if err == errBlockNotFound {
+		http.Error(w, "Block not found", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch block", 502)
+		return
+	}
+	body, _ := json.Marshal(newBlockRecord(result))
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if blockNum+finalityDepth <= head {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		// May still be reorged
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+// handleTxs computes the tips of specific transactions
+func handleTxs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if err := decodeBody(r); err == errBodyEncoding {
+		http.Error(w, "Unsupported Content-Encoding", 415)
+		return
+	} else if err != nil {
+		http.Error(w, "Invalid gzip body", 400)
+		return
+	}
+	var hashes []string
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&hashes); err != nil {
+		http.Error(w, "Body must be a JSON array of transaction hashes", 400)
+		return
+	}
+	if len(hashes) == 0 || len(hashes) > maxTxsPerRequest {
+		http.Error(w, fmt.Sprintf("Provide between 1 and %d transaction hashes", maxTxsPerRequest), 400)
+		return
+	}
+	for i, hash := range hashes {
+		if !hashPattern.MatchString(hash) {
+			http.Error(w, fmt.Sprintf("Invalid transaction hash %q", hash), 400)
+			return
+		}
+		hashes[i] = strings.ToLower(hash)
+	}
+	analyzer, ok := analyzerFor(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, r, analyzer.GetTxTips(r.Context(), hashes))
+}
 
-	// Serve static files for the frontend
-	http.Handle("/", http.FileServer(http.Dir("/var/eth-fetcher/frontend")))
+// handleCacheStats reports how complete the cache is
+func handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	analyzer, ok := analyzerFor(w, r)
+	if !ok {
+		return
+	}
+	// Serve the periodic report when there is one; computing the
+	// stats scans the whole cache
+	var stats *cacheStats
+	if analyzer == networks[defaultNetwork] {
+		cacheReport.Lock()
+		stats = cacheReport.stats
+		cacheReport.Unlock()
+	}
+	if stats == nil {
+		var err error
+		stats, err = analyzer.CacheStats(r.Context())
+		if err != nil {
+			http.Error(w, "Failed to compute cache stats", 500)
+			return
+		}
+	}
+	writeJSON(w, r, stats)
+}
+
+// handleCacheRange reports the bounds of the cache
+func handleCacheRange(w http.ResponseWriter, r *http.Request) {
+	analyzer, ok := analyzerFor(w, r)
+	if !ok {
+		return
+	}
+	res, err := analyzer.CacheRange(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to read cache range", 500)
+		return
+	}
+	writeJSON(w, r, res)
+}
+
+// handleCacheMiners totals tips and burned fees per miner over cached blocks
+func handleCacheMiners(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.ParseUint(r.URL.Query().Get("start"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid start block", 400)
+		return
+	}
+	end, err := strconv.ParseUint(r.URL.Query().Get("end"), 10, 64)
+	if err != nil || end < start || end > maxBlockNumber {
+		http.Error(w, "Invalid end block", 400)
+		return
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", 400)
+			return
+		}
+	}
+	analyzer, ok := analyzerFor(w, r)
+	if !ok {
+		return
+	}
+	stats, err := analyzer.MinerStats(r.Context(), start, end)
+	if err != nil {
+		log.Printf("Miner stats %d-%d failed: %v", start, end, err)
+		http.Error(w, "Failed to compute miner stats", 500)
+		return
+	}
+	if limit > 0 && len(stats.Miners) > limit {
+		stats.Miners = stats.Miners[:limit]
+	}
+	writeJSON(w, r, stats)
+}
+
+// handleMetrics reports the RPC and fetch metrics
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	analyzer, ok := analyzerFor(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, r, map[string]any{
+		"rpcLatency": analyzer.rpcLatency.Snapshot(),
+		"cacheWrites": map[string]uint64{
+			"written":   analyzer.cacheWritten.Load(),
+			"unchanged": analyzer.cacheUnchanged.Load(),
+			"errors":    analyzer.cacheErrors.Load(),
+		},
+		"batches": analyzer.batches.Snapshot(),
+	})
+}
+
+// handleSchema serves the schema of format=protobuf exports
+func handleSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(blockMetricsProto)
+}
+
+// frontendHandler serves the static files in dir, or the built-in dashboard
+// when dir is empty or isn't a directory
+func frontendHandler(dir string) http.Handler {
+	if info, err := os.Stat(dir); dir != "" && err == nil && info.IsDir() {
+		return http.FileServer(http.Dir(dir))
+	}
+	log.Printf("Frontend directory %q not found, serving the built-in dashboard", dir)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/dashboard.html" && r.URL.Path != "/index.html" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(builtinDashboard)
+	})
+}
+
+func main() {
+	apiKey := os.Getenv("ALCHEMY_API_KEY")
+	var analyzerOpts []AnalyzerOption
+	if proxy := os.Getenv("RPC_PROXY"); proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			log.Fatalf("Invalid RPC_PROXY %q", proxy)
+		}
+		analyzerOpts = append(analyzerOpts, WithProxy(proxyURL))
+	}
+	if v := os.Getenv("RPC_MAX_RESPONSE_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid RPC_MAX_RESPONSE_BYTES %q", v)
+		}
+		analyzerOpts = append(analyzerOpts, WithMaxResponseBytes(n))
+	}
+	if v := os.Getenv("RPC_MAX_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid RPC_MAX_RETRIES %q", v)
+		}
+		analyzerOpts = append(analyzerOpts, WithMaxRetries(n))
+	}
+	rps, burst := float64(defaultRateLimit), defaultRateBurst
+	if v := os.Getenv("ALCHEMY_RPS"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || math.IsInf(f, 0) {
+			log.Fatalf("Invalid ALCHEMY_RPS %q", v)
+		}
+		rps = f
+	}
+	if v := os.Getenv("ALCHEMY_BURST"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid ALCHEMY_BURST %q", v)
+		}
+		burst = n
+	}
+	analyzerOpts = append(analyzerOpts, WithRateLimit(rps, burst))
+	batchSize, batchTokens := defaultRPCBatchSize, 1
+	if v := os.Getenv("RPC_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid RPC_BATCH_SIZE %q", v)
+		}
+		batchSize = n
+	}
+	if v := os.Getenv("RPC_BATCH_TOKENS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid RPC_BATCH_TOKENS %q", v)
+		}
+		batchTokens = n
+	}
+	analyzerOpts = append(analyzerOpts, WithRPCBatch(batchSize, batchTokens))
+	if v := os.Getenv("MAX_ERROR_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid MAX_ERROR_LENGTH %q", v)
+		}
+		maxErrorLength = n
+	}
+	if v := os.Getenv("PROGRESS_EVERY_BATCHES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid PROGRESS_EVERY_BATCHES %q", v)
+		}
+		progressEveryBatches = n
+	}
+	if v := os.Getenv("CACHE_ERROR_LIMIT"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid CACHE_ERROR_LIMIT %q", v)
+		}
+		cacheErrorLimit = n
+	}
+	if v := os.Getenv("PROGRESS_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid PROGRESS_INTERVAL %q", v)
+		}
+		progressInterval = d
+	}
+	if v := os.Getenv("ETH_USD_PRICE"); v != "" {
+		if _, ok := new(big.Rat).SetString(v); !ok {
+			log.Fatalf("Invalid ETH_USD_PRICE %q", v)
+		}
+		staticETHUSDPrice = v
+	}
+	if v := os.Getenv("ETH_USD_PRICE_URL"); v != "" {
+		ethUSDPriceURL = v
+	}
+	if v := os.Getenv("JOBS_DISK_BUDGET"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid JOBS_DISK_BUDGET %q", v)
+		}
+		jobsDiskBudget = n
+	}
+	if v := os.Getenv("JOBS_MAX_RECORDS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid JOBS_MAX_RECORDS %q", v)
+		}
+		maxJobRecords = n
+	}
+	evictJobFiles = os.Getenv("JOBS_EVICT_FILES") == "true"
+	if method := os.Getenv("RPC_BLOCK_METHOD"); method != "" {
+		params := []any{blockParamsPlaceholder, true}
+		if v := os.Getenv("RPC_BLOCK_PARAMS"); v != "" {
+			if err := json.Unmarshal([]byte(v), &params); err != nil || !slices.Contains(params, any(blockParamsPlaceholder)) {
+				log.Fatalf("Invalid RPC_BLOCK_PARAMS %q", v)
+			}
+		}
+		analyzerOpts = append(analyzerOpts, WithBlockMethod(method, params))
+	}
+	if v := os.Getenv("CACHE_WRITE_BEHIND"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid CACHE_WRITE_BEHIND %q", v)
+		}
+		if n > 0 {
+			analyzerOpts = append(analyzerOpts, WithWriteBehind(n))
+		}
+	}
+	var cacheStatsInterval time.Duration
+	if v := os.Getenv("CACHE_STATS_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid CACHE_STATS_INTERVAL %q", v)
+		}
+		cacheStatsInterval = d
+	}
+	if v := os.Getenv("JOB_ID_SCHEME"); v != "" {
+		if v != jobIDUUID && v != jobIDSequential {
+			log.Fatalf("Invalid JOB_ID_SCHEME %q", v)
+		}
+		jobIDScheme = v
+	}
+	if v := os.Getenv("FETCH_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid FETCH_CONCURRENCY %q", v)
+		}
+		fetchConcurrency = n
+	}
+	fetchRampStart = fetchConcurrency
+	if v := os.Getenv("FETCH_RAMP_START"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid FETCH_RAMP_START %q", v)
+		}
+		fetchRampStart = n
+	}
+	if v := os.Getenv("FETCH_RAMP_DURATION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid FETCH_RAMP_DURATION %q", v)
+		}
+		fetchRampDuration = d
+	}
+	if os.Getenv("DETERMINISTIC") == "true" {
+		// Ramping up waits in real time too
+		analyzerOpts = append(analyzerOpts, WithDeterministic())
+		fetchRampDuration = 0
+		log.Printf("Deterministic mode: rate limiting and retry backoff are disabled")
+	}
+	if v := os.Getenv("OUTPUT_SYNC"); v != "" {
+		if v != syncOff && v != syncCompletion && v != syncBatch {
+			log.Fatalf("Invalid OUTPUT_SYNC %q", v)
+		}
+		syncPolicy = v
+	}
+	if v := os.Getenv("LIVE_POLL_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid LIVE_POLL_INTERVAL %q", v)
+		}
+		livePollInterval = d
+	}
+	if v := os.Getenv("HANDLER_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid HANDLER_TIMEOUT %q", v)
+		}
+		handlerTimeout = d
+	}
+	if v := os.Getenv("STREAM_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid STREAM_TIMEOUT %q", v)
+		}
+		streamTimeout = d
+	}
+	if v := os.Getenv("ROUTE_TIMEOUTS"); v != "" {
+		if err := parseRouteTimeouts(v); err != nil {
+			log.Fatalf("Invalid ROUTE_TIMEOUTS: %v", err)
+		}
+	}
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	var fallbackURLs []string
+	if v := os.Getenv("RPC_FALLBACK_URLS"); v != "" {
+		for _, u := range strings.Split(v, ",") {
+			if !validRPCURL(u) {
+				log.Fatalf("Invalid RPC_FALLBACK_URLS entry %q", u)
+			}
+			fallbackURLs = append(fallbackURLs, u)
+		}
+	}
+	defaultOpts := append(slices.Clone(analyzerOpts), WithFallbackRPCURLs(fallbackURLs...))
+	if dir := os.Getenv("RPC_FIXTURE_DIR"); dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			log.Fatalf("Invalid RPC_FIXTURE_DIR %q", dir)
+		}
+		// Replaces the transport, so it must come after WithProxy
+		defaultOpts = append(defaultOpts, WithFixtureDir(dir))
+		log.Printf("Replaying RPC responses from the fixture in %s", dir)
+	}
+	analyzer := NewAnalyzer(apiKey, "/var/eth-fetcher/results.db", defaultOpts...)
+	networks[defaultNetwork] = analyzer
+	if v := os.Getenv("NETWORKS"); v != "" {
+		configs, err := parseNetworks(v, "/var/eth-fetcher")
+		if err != nil {
+			log.Fatalf("Invalid NETWORKS: %v", err)
+		}
+		for _, c := range configs {
+			networks[c.name] = NewAnalyzer("", c.dbPath, append(slices.Clone(analyzerOpts), WithRPCURL(c.rpcURL), WithFallbackRPCURLs(c.fallbacks...))...)
+		}
+	}
+	jobStore = analyzer
+	if err := restoreJobs(jobStore); err != nil {
+		log.Fatalf("Failed to restore jobs: %v", err)
+	}
+
+	// Submit request endpoint
+	http.HandleFunc("/request", handleRequest)
+
+	// Retry endpoint: continue a failed job from where it errored
+	http.HandleFunc("/retry/", handleRetry)
+
+	// Resume endpoint: continue a stopped or interrupted job where it left
+	// off, keeping its ID and file
+	http.HandleFunc("/resume/", handleResume)
+
+	// Stop job endpoint
+	http.HandleFunc("/stop/", handleStop)
+
+	// Events endpoint: stream a job's progress as Server-Sent Events
+	http.HandleFunc("/events/", handleEvents)
+
+	// Live endpoint: stream each new block as it appears, by polling the head
+	http.HandleFunc("/live", handleLive)
+
+	// Download endpoint
+	http.HandleFunc("/download/", handleDownload)
+
+	// Status endpoint, plus /status/{jobID}/preview and /status/{jobID}/manifest
+	http.HandleFunc("/status/", handleStatus)
+
+	// List jobs endpoint
+	http.HandleFunc("/jobs", handleJobs)
+
+	// Delete endpoint: forget a job, stopping it first if forced
+	http.HandleFunc("/jobs/", handleDeleteJob)
+
+	// Files endpoint: completed job artifacts whose range intersects [start, end]
+	http.HandleFunc("/files", handleFiles)
+
+	// Archive endpoint: zstd-compressed NDJSON of block metrics for cold storage
+	http.HandleFunc("/archive", handleArchive)
+
+	// Vacuum endpoint: compact the SQLite cache
+	http.HandleFunc("/admin/vacuum", handleVacuum)
+
+	// Import endpoint: bulk-load a shared CSV or NDJSON dataset into the cache
+	http.HandleFunc("/admin/import", handleImport)
+
+	// Block endpoint: metrics of a single block, cacheable once finalized
+	http.HandleFunc("/block/", handleBlock)
+
+	// Transactions endpoint: fee breakdown of specific transactions
+	http.HandleFunc("/txs", handleTxs)
+
+	// Cache completeness endpoint
+	if cacheStatsInterval > 0 {
+		go reportCacheStats(analyzer, cacheStatsInterval)
+	}
+	http.HandleFunc("/cache/stats", handleCacheStats)
+
+	// Bounds of the cache, for picking the next fetch window
+	http.HandleFunc("/cache/range", handleCacheRange)
+
+	// Tips and burned fees per miner over cached blocks
+	http.HandleFunc("/cache/miners", handleCacheMiners)
+
+	// Metrics endpoint
+	http.HandleFunc("/metrics", handleMetrics)
+
+	// Schema for format=protobuf exports
+	http.HandleFunc("/schema/block_metrics.proto", handleSchema)
+
+	// Serve static files for the frontend, or the built-in dashboard when
+	// FRONTEND_DIR is empty or doesn't exist
+	frontendDir, ok := os.LookupEnv("FRONTEND_DIR")
+	if !ok {
+		frontendDir = "/var/eth-fetcher/frontend"
+	}
+	http.Handle("/", frontendHandler(frontendDir))
 
 	// Health check endpoint
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -243,6 +2501,30 @@ func main() {
 		w.Write([]byte("OK"))
 	})
 
+	// Flush buffered cache writes on SIGINT/SIGTERM
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := &http.Server{Addr: ":8080", Handler: withTimeouts(http.DefaultServeMux)}
+	go func() {
+		<-sigCtx.Done()
+		log.Println("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
 	log.Println("Server listening on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Let running jobs flush and record where they got to, so they can be
+	// retried after the restart
+	interruptCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	interruptJobs(interruptCtx)
+	cancel()
+	for name, a := range networks {
+		if err := a.Close(); err != nil {
+			log.Printf("Failed to close %s cache: %v", name, err)
+		}
+	}
 }
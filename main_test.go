@@ -0,0 +1,2238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testGenesisTime is the timestamp of testBlock(0); blocks are 12s apart
+const testGenesisTime = 1700000000
+
+// testTip is what each transaction of a testBlock tips per gas
+const testTip = 2_000_000_000
+
+// testBlock returns the fixture block n. Its base fee is 1 gwei plus n
+// wei, its size 500 plus n bytes, its roots n followed by 01, 02 and 03,
+// and odd blocks carry one transaction tipping testTip on 21000 gas.
+func testBlock(n uint64) *rpcBlock {
+	baseFee := big.NewInt(1_000_000_000 + int64(n))
+	block := &rpcBlock{
+		Number:           fmt.Sprintf("0x%x", n),
+		GasUsed:          "0x0",
+		BaseFeePerGas:    "0x" + baseFee.Text(16),
+		Size:             fmt.Sprintf("0x%x", 500+n),
+		Timestamp:        fmt.Sprintf("0x%x", testGenesisTime+12*n),
+		TransactionsRoot: fmt.Sprintf("0x%062x01", n),
+		StateRoot:        fmt.Sprintf("0x%062x02", n),
+		ReceiptsRoot:     fmt.Sprintf("0x%062x03", n),
+	}
+	if n%2 == 1 {
+		gasPrice := new(big.Int).Add(baseFee, big.NewInt(testTip))
+		block.GasUsed = "0x5208"
+		block.Transactions = []rpcTx{{GasPrice: "0x" + gasPrice.Text(16), Gas: "0x5208"}}
+	}
+	return block
+}
+
+// testBlocks returns testBlock for [from, to], leaving out skip
+func testBlocks(from, to uint64, skip ...uint64) []*rpcBlock {
+	var blocks []*rpcBlock
+	for n := from; n <= to; n++ {
+		if !slices.Contains(skip, n) {
+			blocks = append(blocks, testBlock(n))
+		}
+	}
+	return blocks
+}
+
+// writeFixture records blocks in an RPC fixture directory
+func writeFixture(t *testing.T, dir string, blocks ...*rpcBlock) {
+	t.Helper()
+	for _, block := range blocks {
+		n, err := hexToUint64(block.Number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.json", n)), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newRPCStub serves JSON-RPC calls with answer. A nil result is sent as
+// null and an error as an error object.
+func newRPCStub(t *testing.T, answer func(ctx context.Context, method string, params []any) (any, error)) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var call jsonRPCRequest
+		if err := json.NewDecoder(r.Body).Decode(&call); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		params, _ := call.Params.([]any)
+		result, err := answer(r.Context(), call.Method, params)
+		res := jsonRPCResponse[any]{JSONRPC: "2.0", ID: call.ID, Result: result}
+		if err != nil {
+			res.Error = &rpcErr{Code: -32000, Message: err.Error()}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// blockParam is the block number a block call asks for
+func blockParam(params []any) uint64 {
+	if len(params) == 0 {
+		return 0
+	}
+	tag, _ := params[0].(string)
+	n, err := hexToBig(tag)
+	if err != nil || !n.IsUint64() {
+		return 0
+	}
+	return n.Uint64()
+}
+
+// newTestAnalyzer returns an unthrottled analyzer calling rpcURL, with an
+// empty cache in a temporary directory. The cache skips fsyncs, which
+// dominate test time.
+func newTestAnalyzer(t testing.TB, rpcURL string, opts ...AnalyzerOption) *Analyzer {
+	t.Helper()
+	a := NewAnalyzer("", "file:"+filepath.Join(t.TempDir(), "cache.db")+"?_sync=OFF", append([]AnalyzerOption{WithDeterministic()}, opts...)...)
+	a.alchURL = rpcURL
+	t.Cleanup(func() { a.db.Close() })
+	return a
+}
+
+// newFixtureAnalyzer returns a test analyzer whose RPC serves blocks, and
+// the number of block calls it has answered
+func newFixtureAnalyzer(t *testing.T, blocks []*rpcBlock) (*Analyzer, *atomic.Int64) {
+	t.Helper()
+	byNumber := make(map[uint64]*rpcBlock)
+	for _, block := range blocks {
+		n, err := hexToBig(block.Number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byNumber[n.Uint64()] = block
+	}
+	var calls atomic.Int64
+	srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		calls.Add(1)
+		if block, ok := byNumber[blockParam(params)]; ok {
+			return block, nil
+		}
+		return nil, nil
+	})
+	return newTestAnalyzer(t, srv.URL), &calls
+}
+
+// seedCache caches blocks without fetching them
+func seedCache(t testing.TB, a *Analyzer, blocks []*rpcBlock) {
+	t.Helper()
+	for _, block := range blocks {
+		tips, err := a.calculateTotalTips(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := hexToUint64(block.Size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, err := hexToUint64(block.Timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = a.db.Exec("INSERT OR REPLACE INTO block_cache (block_num, timestamp, gas_used, total_tips, base_fee, size, tx_count, transactions_root, state_root, receipts_root) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			blockParam([]any{block.Number}), ts, block.GasUsed, fmt.Sprintf("0x%x", tips), block.BaseFeePerGas, size, len(block.Transactions),
+			block.TransactionsRoot, block.StateRoot, block.ReceiptsRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// setAnalyzer replaces the default network's analyzer for the duration of a
+// test
+func setAnalyzer(t *testing.T, a *Analyzer) {
+	t.Helper()
+	saved := networks[defaultNetwork]
+	networks[defaultNetwork] = a
+	t.Cleanup(func() { networks[defaultNetwork] = saved })
+}
+
+// setJobsDir makes jobs write their files to a temporary directory for the
+// duration of a test
+func setJobsDir(t *testing.T) string {
+	t.Helper()
+	saved := jobsDir
+	jobsDir = t.TempDir()
+	t.Cleanup(func() { jobsDir = saved })
+	return jobsDir
+}
+
+// submitJob submits a job through /request and returns its ID
+func submitJob(t *testing.T, query string) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("POST", "/request?"+query, nil))
+	if rec.Code != 200 {
+		t.Fatalf("/request?%s: status %d: %s", query, rec.Code, rec.Body)
+	}
+	var res struct{ JobID string }
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.JobID
+}
+
+// waitJob waits for a job to finish and returns a copy of its status
+func waitJob(t *testing.T, jobID string) JobStatus {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		jobsMu.RLock()
+		job := *jobs[jobID]
+		jobsMu.RUnlock()
+		if job.Status != "pending" {
+			return job
+		}
+	}
+	t.Fatalf("job %s didn't finish", jobID)
+	return JobStatus{}
+}
+
+// setJobs replaces the job table for the duration of a test
+func setJobs(t *testing.T, m map[string]*JobStatus) {
+	t.Helper()
+	jobsMu.Lock()
+	saved := jobs
+	jobs = m
+	jobsMu.Unlock()
+	t.Cleanup(func() {
+		jobsMu.Lock()
+		jobs = saved
+		jobsMu.Unlock()
+	})
+}
+
+func TestHandleFiles(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{
+		"a":       {Status: "done", Start: 100, End: 199, LastWritten: 199, FilePath: "a.csv"},
+		"b":       {Status: "done", Start: 150, End: 250, LastWritten: 250, FilePath: "b.csv"},
+		"c":       {Status: "stopped", Start: 240, End: 400, LastWritten: 260, FilePath: "c.csv"},
+		"d":       {Status: "done", Start: 300, End: 400, LastWritten: 400, FilePath: "d.csv"},
+		"running": {Status: "pending", Start: 100, End: 400, FilePath: "r.csv"},
+		"failed":  {Status: "error", Start: 100, End: 400, FilePath: "f.csv"},
+		"reaped":  {Status: "done", Start: 100, End: 400},
+	})
+	tests := []struct {
+		query      string
+		wantStatus int
+		want       []string
+	}{
+		{query: "start=0&end=99", wantStatus: 200, want: []string{}},
+		{query: "start=0&end=100", wantStatus: 200, want: []string{"a"}},
+		{query: "start=180&end=245", wantStatus: 200, want: []string{"a", "b", "c"}},
+		{query: "start=250&end=250", wantStatus: 200, want: []string{"b", "c"}},
+		{query: "start=0&end=1000", wantStatus: 200, want: []string{"a", "b", "c", "d"}},
+		{query: "start=401&end=500", wantStatus: 200, want: []string{}},
+		{query: "start=500&end=401", wantStatus: 400},
+		{query: "end=100", wantStatus: 400},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleFiles(rec, httptest.NewRequest("GET", "/files?"+tt.query, nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("/files?%s: status %d, want %d", tt.query, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus != 200 {
+			continue
+		}
+		var files []jobFile
+		if err := json.Unmarshal(rec.Body.Bytes(), &files); err != nil {
+			t.Fatalf("/files?%s: %v", tt.query, err)
+		}
+		got := []string{}
+		for _, f := range files {
+			got = append(got, f.JobID)
+			if f.DownloadURL != "/download/"+f.JobID {
+				t.Errorf("job %s: downloadURL %q", f.JobID, f.DownloadURL)
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("/files?%s = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestJobStopsAtMaxDuration(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	// The first batch of 500 blocks is served well within maxDuration, the
+	// rest hang
+	srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		if n := blockParam(params); n <= 500 {
+			return testBlock(n), nil
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	setAnalyzer(t, newTestAnalyzer(t, srv.URL))
+
+	began := time.Now()
+	job := waitJob(t, submitJob(t, "start=1&end=2000&maxDuration=3s"))
+	if elapsed := time.Since(began); elapsed > 8*time.Second {
+		t.Errorf("job took %s to stop", elapsed)
+	}
+	if job.Status != "stopped" || job.Error != "" {
+		t.Fatalf("status %q, error %q; want stopped", job.Status, job.Error)
+	}
+	if job.Deadline == nil || job.Deadline.Sub(began) > 4*time.Second {
+		t.Errorf("deadline %v, want about 3s after %v", job.Deadline, began)
+	}
+	if job.LastWritten != 500 {
+		t.Errorf("lastWritten %d, want 500", job.LastWritten)
+	}
+	records := readCSV(t, job.FilePath)
+	if len(records) != 501 || records[500][0] != "500" {
+		t.Errorf("file has %d records ending in %v, want the header and blocks 1-500", len(records), records[len(records)-1])
+	}
+}
+
+func TestRequestMaxDurationInvalid(t *testing.T) {
+	for _, v := range []string{"soon", "0s", "-1m"} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?start=1&end=2&maxDuration="+v, nil))
+		if rec.Code != 400 {
+			t.Errorf("maxDuration=%s: status %d, want 400", v, rec.Code)
+		}
+	}
+}
+
+// readCSV returns the records of a CSV file, header first
+func readCSV(t *testing.T, path string) [][]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// column returns the named column of CSV records, header first
+func column(t *testing.T, records [][]string, name string) []string {
+	t.Helper()
+	if len(records) == 0 {
+		t.Fatal("no header")
+	}
+	i := slices.Index(records[0], name)
+	if i < 0 {
+		t.Fatalf("no %s column in %v", name, records[0])
+	}
+	values := make([]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		values = append(values, record[i])
+	}
+	return values
+}
+
+func TestBaseFeeDelta(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	baseFees := map[uint64]int64{10: 100, 11: 90, 12: 130, 13: 130, 14: 7}
+	var blocks []*rpcBlock
+	for n := uint64(10); n <= 14; n++ {
+		block := testBlock(n)
+		block.BaseFeePerGas = fmt.Sprintf("0x%x", baseFees[n])
+		blocks = append(blocks, block)
+	}
+	a, _ := newFixtureAnalyzer(t, blocks)
+	setAnalyzer(t, a)
+
+	job := waitJob(t, submitJob(t, "start=11&end=14&baseFeeDelta=true"))
+	if job.Status != "done" {
+		t.Fatalf("status %s (%s), want done", job.Status, job.Error)
+	}
+	records := readCSV(t, job.FilePath)
+	if got := records[0]; !slices.Equal(got, []string{"block_number", "timestamp", "gas_used", "tips", "base_fee_delta"}) {
+		t.Fatalf("header %v", got)
+	}
+	// The first delta is against block 10, before the range
+	want := []string{"-10", "40", "0", "-123"}
+	for i, rec := range records[1:] {
+		if rec[4] != want[i] {
+			t.Errorf("block %s: base_fee_delta %s, want %s", rec[0], rec[4], want[i])
+		}
+	}
+}
+
+func TestBaseFeeDeltaOptIn(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	var fetched []uint64
+	var mu sync.Mutex
+	srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetched = append(fetched, blockParam(params))
+		return testBlock(blockParam(params)), nil
+	})
+	setAnalyzer(t, newTestAnalyzer(t, srv.URL))
+
+	job := waitJob(t, submitJob(t, "start=11&end=14"))
+	if job.Status != "done" {
+		t.Fatalf("status %s (%s), want done", job.Status, job.Error)
+	}
+	records := readCSV(t, job.FilePath)
+	if got := records[0]; !slices.Equal(got, []string{"block_number", "timestamp", "gas_used", "tips"}) {
+		t.Errorf("header %v, want the default columns", got)
+	}
+	if len(records) != 5 || len(records[1]) != 4 {
+		t.Errorf("got %d records of %d fields, want 5 of 4", len(records), len(records[1]))
+	}
+	// Without the delta the block before the range isn't needed
+	slices.Sort(fetched)
+	if !slices.Equal(fetched, []uint64{11, 12, 13, 14}) {
+		t.Errorf("fetched blocks %v, want 11-14", fetched)
+	}
+}
+
+func TestHandleStatusPreview(t *testing.T) {
+	// Rows past lastWritten, and the torn line after them, are still being
+	// flushed
+	path := filepath.Join(t.TempDir(), "job.csv")
+	content := "block_number,timestamp,gas_used,tips\n"
+	for n := 100; n <= 120; n++ {
+		content += fmt.Sprintf("%d,2023-11-14T22:13:20Z,21000,%d\n", n, n*10)
+	}
+	content += "121,2023-11"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setJobs(t, map[string]*JobStatus{
+		"running": {Status: "pending", Start: 100, End: 200, LastWritten: 115, FilePath: path, Options: fetchOptions{Format: formatCSV}},
+		"new":     {Status: "pending", Start: 100, End: 200, LastWritten: 99, FilePath: path, Options: fetchOptions{Format: formatCSV}},
+		"pb":      {Status: "pending", Start: 100, End: 200, LastWritten: 115, FilePath: path, Options: fetchOptions{Format: formatProtobuf}},
+	})
+	tests := []struct {
+		path       string
+		wantStatus int
+		want       []string // block numbers of the rows
+	}{
+		{path: "/status/running/preview?limit=3", wantStatus: 200, want: []string{"113", "114", "115"}},
+		{path: "/status/running/preview", wantStatus: 200, want: []string{"106", "107", "108", "109", "110", "111", "112", "113", "114", "115"}},
+		{path: "/status/running/preview?limit=5000", wantStatus: 200, want: []string{"100", "101", "102", "103", "104", "105", "106", "107", "108", "109", "110", "111", "112", "113", "114", "115"}},
+		{path: "/status/new/preview", wantStatus: 200, want: []string{}},
+		{path: "/status/running/preview?limit=0", wantStatus: 400},
+		{path: "/status/pb/preview", wantStatus: 400},
+		{path: "/status/missing/preview", wantStatus: 404},
+		{path: "/status/running/rows", wantStatus: 404},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleStatus(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.path, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus != 200 {
+			continue
+		}
+		var rows []map[string]string
+		if err := json.Unmarshal(rec.Body.Bytes(), &rows); err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		got := []string{}
+		for _, row := range rows {
+			got = append(got, row["block_number"])
+			if row["gas_used"] != "21000" || row["tips"] != row["block_number"]+"0" {
+				t.Errorf("%s: row %v", tt.path, row)
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s = blocks %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleStatus(rec, httptest.NewRequest("GET", "/status/running", nil))
+	var job JobStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil || job.LastWritten != 115 || job.Status != "pending" {
+		t.Errorf("/status/running = %s (%v)", rec.Body, err)
+	}
+}
+
+func TestTruncateError(t *testing.T) {
+	defer func(n int) { maxErrorLength = n }(maxErrorLength)
+	tests := []struct {
+		max  int
+		msg  string
+		want string
+	}{
+		{max: 5, msg: "short", want: "short"},
+		{max: 5, msg: "too long", want: "too l…"},
+		{max: 5, msg: "abcdé", want: "abcd…"}, // é is two bytes
+		{max: 4, msg: "ab€cd", want: "ab…"},   // € is three bytes
+		{max: 0, msg: "no cap at all", want: "no cap at all"},
+	}
+	for _, tt := range tests {
+		maxErrorLength = tt.max
+		if got := truncateError(tt.msg); got != tt.want {
+			t.Errorf("truncateError(%q) with max %d = %q, want %q", tt.msg, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestMinTips(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(9, 16))
+	setAnalyzer(t, a)
+
+	// Only odd blocks tip; deltas are still taken against the block before
+	job := waitJob(t, submitJob(t, "start=10&end=16&minTips=1&baseFeeDelta=true"))
+	if job.Status != "done" || job.LastWritten != 16 {
+		t.Fatalf("status %s (%s), lastWritten %d; want done at 16", job.Status, job.Error, job.LastWritten)
+	}
+	records := readCSV(t, job.FilePath)
+	var got []string
+	for _, rec := range records[1:] {
+		got = append(got, rec[0])
+		if rec[4] != "1" {
+			t.Errorf("block %s: base_fee_delta %s, want 1", rec[0], rec[4])
+		}
+	}
+	if !slices.Equal(got, []string{"11", "13", "15"}) {
+		t.Errorf("emitted blocks %v, want 11, 13, 15", got)
+	}
+
+	for _, v := range []string{"-1", "1e18", "lots"} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?start=1&end=2&minTips="+v, nil))
+		if rec.Code != 400 {
+			t.Errorf("minTips=%s: status %d, want 400", v, rec.Code)
+		}
+	}
+}
+
+func TestHandleVacuum(t *testing.T) {
+	a, _ := newFixtureAnalyzer(t, testBlocks(1, 20))
+	setAnalyzer(t, a)
+	for n := uint64(1); n <= 20; n++ {
+		if _, err := a.GetBlockGasAndTips(t.Context(), n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(token string) { adminToken = token }(adminToken)
+
+	vacuum := func(method, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/vacuum", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		handleVacuum(rec, req)
+		return rec
+	}
+	adminToken = ""
+	if rec := vacuum("POST", "Bearer "); rec.Code != 403 {
+		t.Errorf("without ADMIN_TOKEN: status %d, want 403", rec.Code)
+	}
+	adminToken = "secret"
+	tests := []struct {
+		method, auth string
+		want         int
+	}{
+		{method: "GET", auth: "Bearer secret", want: 405},
+		{method: "POST", want: 401},
+		{method: "POST", auth: "Bearer wrong", want: 401},
+		{method: "POST", auth: "secret", want: 401},
+		{method: "POST", auth: "Bearer secret", want: 200},
+	}
+	for _, tt := range tests {
+		rec := vacuum(tt.method, tt.auth)
+		if rec.Code != tt.want {
+			t.Errorf("%s with %q: status %d, want %d", tt.method, tt.auth, rec.Code, tt.want)
+		}
+		if rec.Code == 200 {
+			var sizes map[string]int64
+			if err := json.Unmarshal(rec.Body.Bytes(), &sizes); err != nil || len(sizes) != 2 {
+				t.Errorf("body %s (%v), want sizeBefore and sizeAfter", rec.Body, err)
+			}
+		}
+	}
+
+	// The cache still serves after compaction
+	var count int
+	if err := a.db.QueryRow("SELECT COUNT(*) FROM block_cache").Scan(&count); err != nil || count != 20 {
+		t.Errorf("cache has %d blocks (%v), want 20", count, err)
+	}
+
+	a.vacuumMu.Lock()
+	defer a.vacuumMu.Unlock()
+	if rec := vacuum("POST", "Bearer secret"); rec.Code != 409 {
+		t.Errorf("during another vacuum: status %d, want 409", rec.Code)
+	}
+}
+
+func TestOptInColumns(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(9, 12))
+	setAnalyzer(t, a)
+	tests := []struct {
+		query  string
+		header []string
+		row    []string // of block 11
+	}{
+		{
+			query:  "",
+			header: []string{"block_number", "timestamp", "gas_used", "tips"},
+			row:    []string{"11", "1700000132", "21000", "42000000000000"},
+		},
+		{
+			query:  "&blockSize=true",
+			header: []string{"block_number", "timestamp", "gas_used", "tips", "block_size_bytes"},
+			row:    []string{"11", "1700000132", "21000", "42000000000000", "511"},
+		},
+		{
+			query:  "&blockSize=true&baseFeeDelta=true",
+			header: []string{"block_number", "timestamp", "gas_used", "tips", "base_fee_delta", "block_size_bytes"},
+			row:    []string{"11", "1700000132", "21000", "42000000000000", "1", "511"},
+		},
+		{
+			query:  "&avgTipPerGas=true",
+			header: []string{"block_number", "timestamp", "gas_used", "tips", "avg_tip_per_gas_gwei"},
+			row:    []string{"11", "1700000132", "21000", "42000000000000", "2.000000000"},
+		},
+		{
+			query:  "&txCount=true",
+			header: []string{"block_number", "timestamp", "gas_used", "tips", "tx_count"},
+			row:    []string{"11", "1700000132", "21000", "42000000000000", "1"},
+		},
+		{
+			// Block 10 used no gas, so there is no change to report
+			query:  "&gasUsedPctChange=true",
+			header: []string{"block_number", "timestamp", "gas_used", "tips", "gas_used_pct_change"},
+			row:    []string{"11", "1700000132", "21000", "42000000000000", ""},
+		},
+		{
+			query:  "&baseFee=true&txCount=true",
+			header: []string{"block_number", "timestamp", "gas_used", "tips", "tx_count", "base_fee"},
+			row:    []string{"11", "1700000132", "21000", "42000000000000", "1", "1000000011"},
+		},
+		{
+			query:  "&units=eth",
+			header: []string{"block_number", "timestamp", "gas_used", "tips_eth"},
+			row:    []string{"11", "1700000132", "21000", "0.000042000000000000"},
+		},
+		{
+			query:  "&timestampFormat=rfc3339",
+			header: []string{"block_number", "timestamp", "gas_used", "tips"},
+			row:    []string{"11", "2023-11-14T22:15:32Z", "21000", "42000000000000"},
+		},
+		{
+			query:  "&timestampFormat=unix",
+			header: []string{"block_number", "timestamp", "gas_used", "tips"},
+			row:    []string{"11", "1700000132", "21000", "42000000000000"},
+		},
+		{
+			query:  "&timeBuckets=true",
+			header: []string{"block_number", "timestamp", "gas_used", "tips", "utc_date", "utc_hour", "utc_iso_week"},
+			row:    []string{"11", "1700000132", "21000", "42000000000000", "2023-11-14", "22", "2023-W46"},
+		},
+		{
+			query:  "&fields=tips,block_number",
+			header: []string{"tips", "block_number"},
+			row:    []string{"42000000000000", "11"},
+		},
+		{
+			query:  "&txCount=true&units=eth&fields=tx_count,tips_eth,timestamp",
+			header: []string{"tx_count", "tips_eth", "timestamp"},
+			row:    []string{"1", "0.000042000000000000", "1700000132"},
+		},
+	}
+	for _, tt := range tests {
+		job := waitJob(t, submitJob(t, "start=10&end=12"+tt.query))
+		if job.Status != "done" {
+			t.Fatalf("%s: status %s (%s), want done", tt.query, job.Status, job.Error)
+		}
+		records := readCSV(t, job.FilePath)
+		if len(records) != 4 || !slices.Equal(records[0], tt.header) || !slices.Equal(records[2], tt.row) {
+			t.Errorf("%s: got %v, want header %v and block 11 %v", tt.query, records, tt.header, tt.row)
+		}
+		// Blocks 10 and 12 have no transactions
+		if job.EmptyBlocks != 2 {
+			t.Errorf("%s: emptyBlocks %d, want 2", tt.query, job.EmptyBlocks)
+		}
+	}
+
+	// units, timestampFormat, timeBuckets and fields only apply to CSV, gwei
+	// isn't a unit, iso isn't a timestamp format, and fields may only pick
+	// enabled columns, once each
+	for _, query := range []string{
+		"&units=eth&format=protobuf", "&timeBuckets=true&format=protobuf", "&units=gwei",
+		"&timestampFormat=iso", "&timestampFormat=rfc3339&format=protobuf",
+		"&fields=tips&format=protobuf", "&fields=tx_count", "&units=eth&fields=tips", "&fields=tips,tips", "&fields=tips,", "&fields=gas_used_pct_change", "&fields=base_fee",
+	} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?start=10&end=12"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestSingleBlockAndGenesisRanges(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	// Genesis predates London and has no base fee
+	genesis := testBlock(0)
+	genesis.BaseFeePerGas = ""
+	a, _ := newFixtureAnalyzer(t, append([]*rpcBlock{genesis}, testBlocks(1, 42)...))
+	setAnalyzer(t, a)
+	tests := []struct {
+		query  string
+		blocks []string
+		deltas []string
+	}{
+		// Against block 40, fetched for the delta but not written
+		{query: "start=41&end=41", blocks: []string{"41"}, deltas: []string{"1"}},
+		{query: "start=0&end=0", blocks: []string{"0"}, deltas: []string{"0"}},
+		// The first London-style block's delta is its whole base fee
+		{query: "start=0&end=1", blocks: []string{"0", "1"}, deltas: []string{"0", "1000000001"}},
+	}
+	for _, tt := range tests {
+		job := waitJob(t, submitJob(t, tt.query+"&baseFeeDelta=true"))
+		if job.Status != "done" || job.LastWritten != job.End {
+			t.Errorf("%s: status %s (%s), lastWritten %d", tt.query, job.Status, job.Error, job.LastWritten)
+			continue
+		}
+		var blocks, deltas []string
+		for _, rec := range readCSV(t, job.FilePath)[1:] {
+			blocks, deltas = append(blocks, rec[0]), append(deltas, rec[4])
+		}
+		if !slices.Equal(blocks, tt.blocks) || !slices.Equal(deltas, tt.deltas) {
+			t.Errorf("%s: blocks %v with deltas %v, want %v with %v", tt.query, blocks, deltas, tt.blocks, tt.deltas)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("POST", "/request?start=5&end=4", nil))
+	if rec.Code != 400 {
+		t.Errorf("reversed range: status %d, want 400", rec.Code)
+	}
+
+	// A job that hasn't created its file yet previews as empty
+	setJobs(t, map[string]*JobStatus{
+		"new": {Status: "pending", Start: 0, End: 10, FilePath: filepath.Join(t.TempDir(), "missing.csv"), Options: fetchOptions{Format: formatCSV}},
+	})
+	rec = httptest.NewRecorder()
+	handleStatus(rec, httptest.NewRequest("GET", "/status/new/preview", nil))
+	if rec.Code != 200 || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("preview before the file exists: status %d, body %s", rec.Code, rec.Body)
+	}
+}
+
+func TestProgressEveryBatches(t *testing.T) {
+	defer func(n int) { progressEveryBatches = n }(progressEveryBatches)
+	progressEveryBatches = 3
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	// Blocks past the fourth batch wait for release
+	release := make(chan struct{})
+	var fifthBatch atomic.Bool
+	srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		n := blockParam(params)
+		if n > 2000 {
+			fifthBatch.Store(true)
+			<-release
+		}
+		return testBlock(n), nil
+	})
+	setAnalyzer(t, newTestAnalyzer(t, srv.URL))
+
+	jobID := submitJob(t, "start=1&end=2600") // six batches
+	for deadline := time.Now().Add(10 * time.Second); !fifthBatch.Load(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the fifth batch never started")
+		}
+	}
+	jobsMu.RLock()
+	lastWritten := jobs[jobID].LastWritten
+	jobsMu.RUnlock()
+	if lastWritten != 1500 {
+		t.Errorf("lastWritten %d after four batches, want 1500 from the third", lastWritten)
+	}
+	close(release)
+	if job := waitJob(t, jobID); job.Status != "done" || job.LastWritten != 2600 {
+		t.Errorf("status %s, lastWritten %d; want done at 2600", job.Status, job.LastWritten)
+	}
+}
+
+func TestJobLabels(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(1, 2))
+	setAnalyzer(t, a)
+
+	for _, label := range []string{"a/b", "<script>", strings.Repeat("x", 65)} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?start=1&end=2&label="+url.QueryEscape(label), nil))
+		if rec.Code != 400 {
+			t.Errorf("label %q: status %d, want 400", label, rec.Code)
+		}
+	}
+	jobID := submitJob(t, "start=1&end=2&label="+url.QueryEscape(" backfill: Q3-2024 "))
+	if job := waitJob(t, jobID); job.Label != "backfill: Q3-2024" {
+		t.Errorf("label %q, want it trimmed", job.Label)
+	}
+
+	setJobs(t, map[string]*JobStatus{
+		"a": {Status: "done", Label: "nightly", Start: 1, End: 2},
+		"b": {Status: "pending", Label: "nightly", Start: 3, End: 4},
+		"c": {Status: "done", Start: 5, End: 6},
+	})
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "", want: []string{"a", "b", "c"}},
+		{query: "?label=nightly", want: []string{"a", "b"}},
+		{query: "?label=weekly", want: []string{}},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleJobs(rec, httptest.NewRequest("GET", "/jobs"+tt.query, nil))
+		var got []string
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("/jobs%s = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleJobs(rec, httptest.NewRequest("GET", "/jobs?label=nightly&verbose=true", nil))
+	var summaries []jobSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summaries); err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(summaries, func(x, y jobSummary) int { return strings.Compare(x.JobID, y.JobID) })
+	want := []jobSummary{
+		{JobID: "a", Label: "nightly", Status: "done", Start: 1, End: 2},
+		{JobID: "b", Label: "nightly", Status: "pending", Start: 3, End: 4},
+	}
+	if !slices.Equal(summaries, want) {
+		t.Errorf("/jobs?label=nightly&verbose=true = %+v, want %+v", summaries, want)
+	}
+}
+
+func TestFetchFullyCached(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, calls := newFixtureAnalyzer(t, testBlocks(99, 1099))
+	setAnalyzer(t, a)
+	seedCache(t, a, testBlocks(99, 1099))
+
+	cached, err := a.getCachedBlocks(t.Context(), 100, 599)
+	if err != nil || len(cached) != 500 {
+		t.Fatalf("getCachedBlocks returned %d blocks, %v; want the whole batch", len(cached), err)
+	}
+	if r := cached[101]; r.Tips.String() != "42000000000000" || r.TimeStamp.Unix() != testGenesisTime+12*101 || r.Size != 601 {
+		t.Errorf("block 101 = %+v", r)
+	}
+
+	job := waitJob(t, submitJob(t, "start=100&end=1099&baseFeeDelta=true"))
+	if job.Status != "done" {
+		t.Fatalf("status %s (%s), want done", job.Status, job.Error)
+	}
+	if records := readCSV(t, job.FilePath); len(records) != 1001 || records[1][4] != "1" {
+		t.Errorf("got %d rows starting %v, want 1000 with deltas", len(records)-1, records[1])
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("made %d RPC calls for a fully cached range", n)
+	}
+}
+
+func TestSortBlockResults(t *testing.T) {
+	tests := []struct {
+		in, want []uint64
+	}{
+		{in: nil, want: []uint64{}},
+		{in: []uint64{5}, want: []uint64{5}},
+		{in: []uint64{3, 1, 2}, want: []uint64{1, 2, 3}},
+		{in: []uint64{2, 1, 2, 3, 1, 3, 3}, want: []uint64{1, 2, 3}},
+		{in: []uint64{7, 7}, want: []uint64{7}},
+	}
+	for _, tt := range tests {
+		results := make([]*BlockResult, len(tt.in))
+		for i, n := range tt.in {
+			results[i] = &BlockResult{BlockNum: n}
+		}
+		got := []uint64{}
+		for _, r := range sortBlockResults(results) {
+			got = append(got, r.BlockNum)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("sortBlockResults(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFrontendHandler(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "app.js"), []byte("// app"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dir, path  string
+		wantStatus int
+		want       []byte
+	}{
+		{dir: dir, path: "/app.js", wantStatus: 200, want: []byte("// app")},
+		{dir: dir, path: "/dashboard.html", wantStatus: 404},
+		{dir: filepath.Join(dir, "missing"), path: "/", wantStatus: 200, want: builtinDashboard},
+		{dir: filepath.Join(dir, "app.js"), path: "/dashboard.html", wantStatus: 200, want: builtinDashboard},
+		{dir: "", path: "/index.html", wantStatus: 200, want: builtinDashboard},
+		{dir: "", path: "/app.js", wantStatus: 404},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		frontendHandler(tt.dir).ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.wantStatus || tt.want != nil && !bytes.Equal(rec.Body.Bytes(), tt.want) {
+			t.Errorf("dir %q, GET %s: status %d, want %d", tt.dir, tt.path, rec.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestHandleBlock(t *testing.T) {
+	srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		if method == "eth_blockNumber" {
+			return "0x64", nil
+		}
+		return testBlock(blockParam(params)), nil
+	})
+	setAnalyzer(t, newTestAnalyzer(t, srv.URL))
+	get := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		handleBlock(rec, req)
+		return rec
+	}
+
+	rec := get("/block/10", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != 200 || etag == "" {
+		t.Fatalf("GET /block/10 = %d with ETag %q, want 200 with an ETag", rec.Code, etag)
+	}
+	if cc := rec.Header().Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("finalized block Cache-Control = %q, want immutable", cc)
+	}
+	var record blockRecord
+	if err := json.Unmarshal(rec.Body.Bytes(), &record); err != nil || record.BlockNumber != 10 {
+		t.Errorf("GET /block/10 body = %s (%v)", rec.Body, err)
+	}
+
+	tests := []struct {
+		path, ifNoneMatch string
+		want              int
+	}{
+		{path: "/block/10", ifNoneMatch: etag, want: 304},
+		{path: "/block/10", ifNoneMatch: `"other", W/` + etag, want: 304},
+		{path: "/block/10", ifNoneMatch: "*", want: 304},
+		{path: "/block/10", ifNoneMatch: `"other"`, want: 200},
+		{path: "/block/101", want: 404},
+		{path: "/block/ten", want: 400},
+	}
+	for _, tt := range tests {
+		if rec := get(tt.path, tt.ifNoneMatch); rec.Code != tt.want {
+			t.Errorf("GET %s with If-None-Match %s = %d, want %d", tt.path, tt.ifNoneMatch, rec.Code, tt.want)
+		}
+	}
+
+	rec = get("/block/90", "")
+	if cc := rec.Header().Get("Cache-Control"); rec.Code != 200 || cc != "no-store" {
+		t.Errorf("unfinalized block = %d with Cache-Control %q, want 200 with no-store", rec.Code, cc)
+	}
+
+	rec = get("/block/pending", "")
+	var pending struct {
+		blockRecord
+		Provisional bool `json:"provisional"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &pending); err != nil || !pending.Provisional || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("GET /block/pending = %d %s (%v), want a provisional block that isn't cached", rec.Code, rec.Body, err)
+	}
+}
+
+func TestRoots(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, calls := newFixtureAnalyzer(t, testBlocks(1, 4))
+	setAnalyzer(t, a)
+	seedCache(t, a, testBlocks(1, 4))
+	// Block 3 was cached before roots were stored
+	if _, err := a.db.Exec("UPDATE block_cache SET transactions_root = NULL, state_root = NULL, receipts_root = NULL WHERE block_num = 3"); err != nil {
+		t.Fatal(err)
+	}
+
+	job := waitJob(t, submitJob(t, "start=1&end=4"))
+	if header := readCSV(t, job.FilePath)[0]; len(header) != 4 || calls.Load() != 0 {
+		t.Errorf("without roots: header %v after %d RPC calls, want the default columns from the cache", header, calls.Load())
+	}
+
+	job = waitJob(t, submitJob(t, "start=1&end=4&roots=true"))
+	if job.Status != "done" {
+		t.Fatalf("status %s (%s), want done", job.Status, job.Error)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("made %d RPC calls, want 1 for block 3", calls.Load())
+	}
+	records := readCSV(t, job.FilePath)
+	for i, name := range []string{"transactions_root", "state_root", "receipts_root"} {
+		for j, got := range column(t, records, name) {
+			if want := fmt.Sprintf("0x%062x%02x", j+1, i+1); got != want {
+				t.Errorf("block %d %s = %s, want %s", j+1, name, got, want)
+			}
+		}
+	}
+	var cached int
+	if err := a.db.QueryRow("SELECT COUNT(*) FROM block_cache WHERE block_num = 3 AND state_root IS NOT NULL").Scan(&cached); err != nil || cached != 1 {
+		t.Errorf("refetched roots weren't cached: %v", err)
+	}
+}
+
+func TestDifficulty(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	// Block 4's provider leaves out the total difficulty
+	blocks := testBlocks(1, 4)
+	for i, block := range blocks {
+		block.Difficulty = fmt.Sprintf("0x%x", 1000+i+1)
+		if i < 3 {
+			block.TotalDifficulty = fmt.Sprintf("0x%x", 50000+i+1)
+		}
+	}
+	a, calls := newFixtureAnalyzer(t, blocks)
+	setAnalyzer(t, a)
+	// seedCache stores no difficulty, like rows cached before it was
+	seedCache(t, a, blocks)
+
+	job := waitJob(t, submitJob(t, "start=1&end=4"))
+	if header := readCSV(t, job.FilePath)[0]; len(header) != 4 || calls.Load() != 0 {
+		t.Errorf("without difficulty: header %v after %d RPC calls, want the default columns from the cache", header, calls.Load())
+	}
+
+	// The second job reads back what the first one cached
+	for i, wantCalls := range []int64{4, 4} {
+		job = waitJob(t, submitJob(t, "start=1&end=4&difficulty=true"))
+		if job.Status != "done" {
+			t.Fatalf("job %d: status %s (%s), want done", i, job.Status, job.Error)
+		}
+		if calls.Load() != wantCalls {
+			t.Errorf("job %d: %d RPC calls in all, want %d", i, calls.Load(), wantCalls)
+		}
+		records := readCSV(t, job.FilePath)
+		difficulty, total := column(t, records, "difficulty"), column(t, records, "total_difficulty")
+		if want := []string{"1001", "1002", "1003", "1004"}; !slices.Equal(difficulty, want) {
+			t.Errorf("job %d: difficulty %v, want %v", i, difficulty, want)
+		}
+		if want := []string{"50001", "50002", "50003", ""}; !slices.Equal(total, want) {
+			t.Errorf("job %d: total_difficulty %v, want %v", i, total, want)
+		}
+	}
+}
+
+func TestWriteJSONPretty(t *testing.T) {
+	tests := []struct {
+		query, want string
+	}{
+		{query: "", want: "{\"jobID\":\"1\"}\n"},
+		{query: "?pretty=false", want: "{\"jobID\":\"1\"}\n"},
+		{query: "?pretty=true", want: "{\n  \"jobID\": \"1\"\n}\n"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		writeJSON(rec, httptest.NewRequest("GET", "/status/1"+tt.query, nil), map[string]string{"jobID": "1"})
+		if rec.Body.String() != tt.want || rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%q: got %q (%s), want %q", tt.query, rec.Body, rec.Header().Get("Content-Type"), tt.want)
+		}
+	}
+}
+
+func TestDownloadRunningJob(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "job.csv")
+	const flushed = "block_number,timestamp,gas_used,tips\n1,2023-11-14T22:13:32Z,0,0\n"
+	if err := os.WriteFile(path, []byte(flushed+"2,2023-11-14T22:1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	job := func(status string) *JobStatus {
+		return &JobStatus{Status: status, FilePath: path, FlushedBytes: int64(len(flushed)), Options: fetchOptions{Format: formatCSV}}
+	}
+	setJobs(t, map[string]*JobStatus{"pending": job("pending"), "done": job("done"), "error": job("error")})
+	tests := []struct {
+		path        string
+		wantStatus  int
+		wantBody    string
+		wantWarning bool
+	}{
+		{path: "pending", wantStatus: 200, wantBody: flushed},
+		{path: "done", wantStatus: 200, wantBody: flushed + "2,2023-11-14T22:1"},
+		{path: "done?allowPartial=true", wantStatus: 200, wantBody: flushed + "2,2023-11-14T22:1"},
+		{path: "error", wantStatus: 404},
+		{path: "error?allowPartial=true", wantStatus: 200, wantBody: flushed, wantWarning: true},
+		{path: "unknown?allowPartial=true", wantStatus: 404},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleDownload(rec, httptest.NewRequest("GET", "/download/"+tt.path, nil))
+		if rec.Code != tt.wantStatus || tt.wantStatus == 200 && rec.Body.String() != tt.wantBody {
+			t.Errorf("download %s = %d %q, want %d %q", tt.path, rec.Code, rec.Body, tt.wantStatus, tt.wantBody)
+		}
+		if warning := rec.Header().Get("Warning"); (warning != "") != tt.wantWarning {
+			t.Errorf("download %s: Warning %q", tt.path, warning)
+		}
+	}
+}
+
+func TestDownloadMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "job.csv")
+	if err := os.WriteFile(path, []byte("block_number,timestamp,gas_used,tips\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	hourAgo := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, hourAgo, hourAgo); err != nil {
+		t.Fatal(err)
+	}
+	setJobs(t, map[string]*JobStatus{"job": {Status: "done", FilePath: path, Options: fetchOptions{Format: formatCSV}}})
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{query: "", want: 200},
+		{query: "?maxAge=2h", want: 200},
+		{query: "?maxAge=30m", want: 410},
+		{query: "?maxAge=soon", want: 400},
+		{query: "?maxAge=-1h", want: 400},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleDownload(rec, httptest.NewRequest("GET", "/download/job"+tt.query, nil))
+		if rec.Code != tt.want {
+			t.Errorf("download%s = %d, want %d", tt.query, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	dir := t.TempDir()
+	const header = "block_number,gas_used\n"
+	const rows = "10,1\n11,2\n12,3\n13,4\n14,5\n"
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(header + rows))
+	zw.Close()
+	csvOpts := fetchOptions{Format: formatCSV}
+	setJobs(t, map[string]*JobStatus{
+		"done":    {Status: "done", Start: 10, End: 14, FilePath: write("done.csv", header+rows), Options: csvOpts},
+		"gzip":    {Status: "done", Start: 10, End: 14, FilePath: write("gzip.csv.gz", gz.String()), Options: fetchOptions{Format: formatCSV, Compress: "gzip"}},
+		"pending": {Status: "pending", Start: 10, End: 14, FilePath: write("pending.csv", header+"10,1\n11,2\n12,"), FlushedBytes: int64(len(header + "10,1\n11,2\n")), Options: csvOpts},
+		"noblock": {Status: "done", Start: 10, End: 14, FilePath: write("noblock.csv", "gas_used\n1\n"), Options: csvOpts},
+		"arrow":   {Status: "done", Start: 10, End: 14, FilePath: write("done.arrow", ""), Options: fetchOptions{Format: formatArrow}},
+		"rollup":  {Status: "done", Start: 10, End: 14, FilePath: write("rollup.csv", header), Options: fetchOptions{Format: formatCSV, Rollup: "hour"}},
+	})
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{path: "done?from=11&to=12", wantStatus: 200, wantBody: header + "11,2\n12,3\n"},
+		{path: "done?from=13", wantStatus: 200, wantBody: header + "13,4\n14,5\n"},
+		{path: "done?to=10", wantStatus: 200, wantBody: header + "10,1\n"},
+		{path: "done?from=10&to=14", wantStatus: 200, wantBody: header + rows},
+		{path: "gzip?from=12&to=12", wantStatus: 200, wantBody: header + "12,3\n"},
+		{path: "pending?from=11", wantStatus: 200, wantBody: header + "11,2\n"},
+		{path: "done?from=9", wantStatus: 400},
+		{path: "done?to=15", wantStatus: 400},
+		{path: "done?from=12&to=11", wantStatus: 400},
+		{path: "done?from=ten", wantStatus: 400},
+		{path: "noblock?from=10", wantStatus: 400},
+		{path: "arrow?from=10", wantStatus: 400},
+		{path: "rollup?from=10", wantStatus: 400},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleDownload(rec, httptest.NewRequest("GET", "/download/"+tt.path, nil))
+		body := rec.Body.String()
+		if strings.HasPrefix(tt.path, "gzip") && rec.Code == 200 {
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Errorf("download %s: %v", tt.path, err)
+				continue
+			}
+			data, _ := io.ReadAll(zr)
+			body = string(data)
+		}
+		if rec.Code != tt.wantStatus || tt.wantStatus == 200 && body != tt.wantBody {
+			t.Errorf("download %s = %d %q, want %d %q", tt.path, rec.Code, body, tt.wantStatus, tt.wantBody)
+		}
+		if tt.wantStatus == 200 && rec.Header().Get("Content-Length") != "" {
+			t.Errorf("download %s: filtered response has Content-Length %s", tt.path, rec.Header().Get("Content-Length"))
+		}
+	}
+}
+
+func TestGapPolicies(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	// Block 5 isn't available
+	a, _ := newFixtureAnalyzer(t, testBlocks(0, 8, 5))
+	setAnalyzer(t, a)
+	tests := []struct {
+		policy      string
+		status      string
+		blocks      []string // written block numbers
+		lastWritten uint64
+		gaps        []uint64
+	}{
+		// strict gives up after maxStrictGapWaits, which don't wait in
+		// deterministic mode
+		{policy: gapStrict, status: "error", blocks: []string{"1", "2", "3", "4"}, lastWritten: 4},
+		{policy: gapSkip, status: "done", blocks: []string{"1", "2", "3", "4", "6", "7", "8"}, lastWritten: 8, gaps: []uint64{5}},
+		{policy: gapFillZero, status: "done", blocks: []string{"1", "2", "3", "4", "5", "6", "7", "8"}, lastWritten: 8, gaps: []uint64{5}},
+	}
+	for _, tt := range tests {
+		job := waitJob(t, submitJob(t, "start=1&end=8&gapPolicy="+tt.policy))
+		if job.Status != tt.status {
+			t.Errorf("%s: status %s (%s), want %s", tt.policy, job.Status, job.Error, tt.status)
+		}
+		if tt.status == "error" && !strings.Contains(job.Error, "block 5") {
+			t.Errorf("%s: error %q doesn't name block 5", tt.policy, job.Error)
+		}
+		records := readCSV(t, job.FilePath)
+		if got := column(t, records, "block_number"); !slices.Equal(got, tt.blocks) {
+			t.Errorf("%s: wrote blocks %v, want %v", tt.policy, got, tt.blocks)
+		}
+		if job.LastWritten != tt.lastWritten || !slices.Equal(job.Gaps, tt.gaps) {
+			t.Errorf("%s: lastWritten %d, gaps %v; want %d, %v", tt.policy, job.LastWritten, job.Gaps, tt.lastWritten, tt.gaps)
+		}
+		if tt.policy == gapFillZero {
+			if row := records[5]; row[1] != "0" || row[2] != "0" || row[3] != "0" {
+				t.Errorf("placeholder row %v, want zeros", row)
+			}
+		}
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	// Block 5 fails for good with a malformed timestamp
+	blocks := testBlocks(0, 10)
+	blocks[5].Timestamp = "0xzz"
+	a, _ := newFixtureAnalyzer(t, blocks)
+	setAnalyzer(t, a)
+	tests := []struct {
+		query        string
+		wantErr      bool
+		blocks       []string // written block numbers
+		failedBlocks []uint64
+		deltas       []string // base_fee_delta, with baseFeeDelta=true
+	}{
+		{query: "start=1&end=8", wantErr: true, blocks: []string{"1", "2", "3", "4"}},
+		{query: "start=1&end=8&gapPolicy=skip&failurePolicy=block", wantErr: true, blocks: []string{"1", "2", "3", "4"}},
+		{query: "start=1&end=8&gapPolicy=skip&failurePolicy=advance", blocks: []string{"1", "2", "3", "4", "6", "7", "8"}, failedBlocks: []uint64{5}},
+		{query: "start=1&end=8&gapPolicy=fill-zero&failurePolicy=advance", blocks: []string{"1", "2", "3", "4", "5", "6", "7", "8"}, failedBlocks: []uint64{5}},
+		// The block before the range follows the same policy
+		{query: "start=6&end=8&baseFeeDelta=true", wantErr: true},
+		{query: "start=6&end=8&baseFeeDelta=true&gapPolicy=skip&failurePolicy=advance", blocks: []string{"6", "7", "8"}, failedBlocks: []uint64{5}, deltas: []string{"", "1", "1"}},
+	}
+	for _, tt := range tests {
+		job := waitJob(t, submitJob(t, tt.query))
+		if wantStatus := map[bool]string{false: "done", true: "error"}[tt.wantErr]; job.Status != wantStatus {
+			t.Errorf("%s: status %s (%s), want %s", tt.query, job.Status, job.Error, wantStatus)
+			continue
+		}
+		if tt.wantErr && !strings.Contains(job.Error, "block 5") {
+			t.Errorf("%s: error %q, want it to name block 5", tt.query, job.Error)
+		}
+		records := readCSV(t, job.FilePath)
+		if got := column(t, records, "block_number"); !slices.Equal(got, tt.blocks) && len(got)+len(tt.blocks) > 0 {
+			t.Errorf("%s: wrote blocks %v, want %v", tt.query, got, tt.blocks)
+		}
+		if !slices.Equal(job.FailedBlocks, tt.failedBlocks) || job.Gaps != nil {
+			t.Errorf("%s: failedBlocks %v, gaps %v; want %v and no gaps", tt.query, job.FailedBlocks, job.Gaps, tt.failedBlocks)
+		}
+		if tt.deltas != nil {
+			if got := column(t, records, "base_fee_delta"); !slices.Equal(got, tt.deltas) {
+				t.Errorf("%s: base_fee_delta %v, want %v", tt.query, got, tt.deltas)
+			}
+		}
+	}
+
+	for _, query := range []string{"start=1&end=8&failurePolicy=advance", "start=1&end=8&gapPolicy=strict&failurePolicy=advance", "start=1&end=8&failurePolicy=sometimes"} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestRequestRPCTimeout(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	// Block 3 hangs the first time it is asked for
+	var stalled atomic.Bool
+	srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		if n := blockParam(params); n == 3 && stalled.CompareAndSwap(false, true) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return testBlock(blockParam(params)), nil
+	})
+	setAnalyzer(t, newTestAnalyzer(t, srv.URL))
+
+	job := waitJob(t, submitJob(t, "start=1&end=5&rpcTimeout=50ms"))
+	if job.Status != "done" || job.Options.RPCTimeout != 50*time.Millisecond || job.LastWritten != 5 {
+		t.Errorf("status %s (%s), rpcTimeout %v, lastWritten %d; want done, 50ms, 5", job.Status, job.Error, job.Options.RPCTimeout, job.LastWritten)
+	}
+	if !stalled.Load() {
+		t.Error("block 3 was never asked for")
+	}
+	for _, v := range []string{"0s", "-1s", "soon"} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?start=1&end=5&rpcTimeout="+v, nil))
+		if rec.Code != 400 {
+			t.Errorf("rpcTimeout=%s: status %d, want 400", v, rec.Code)
+		}
+	}
+}
+
+func TestRequestWait(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(0, 30))
+	setAnalyzer(t, a)
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("POST", "/request?start=1&end=30&wait=true", nil))
+	if rec.Code != 200 {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var res struct {
+		JobID string
+		JobStatus
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.JobID == "" || res.Status != "done" || res.LastWritten != 30 || res.RowsWritten != 30 {
+		t.Errorf("got %s", rec.Body)
+	}
+	if rows := readCSV(t, res.FilePath); len(rows) != 31 {
+		t.Errorf("got %d CSV rows, want 31", len(rows))
+	}
+
+	// A client that gives up waiting, or a wait that runs out of time,
+	// leaves the job running
+	seen := map[string]bool{res.JobID: true}
+	cancelled, cancel := context.WithCancel(t.Context())
+	cancel()
+	expired, cancel := context.WithDeadline(t.Context(), time.Now())
+	defer cancel()
+	for _, tt := range []struct {
+		ctx  context.Context
+		code int
+	}{{ctx: cancelled, code: 200}, {ctx: expired, code: 503}} {
+		rec = httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?start=1&end=30&wait=true", nil).WithContext(tt.ctx))
+		if rec.Code != tt.code {
+			t.Errorf("%v: status %d, want %d", tt.ctx.Err(), rec.Code, tt.code)
+		}
+		jobsMu.RLock()
+		var jobID string
+		for id := range jobs {
+			if !seen[id] {
+				jobID = id
+			}
+		}
+		jobsMu.RUnlock()
+		seen[jobID] = true
+		if job := waitJob(t, jobID); job.Status != "done" {
+			t.Errorf("abandoned job: status %s (%s), want done", job.Status, job.Error)
+		}
+	}
+}
+
+func TestCompressGzip(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(0, 30))
+	setAnalyzer(t, a)
+
+	jobID := submitJob(t, "start=1&end=30&compress=gzip")
+	job := waitJob(t, jobID)
+	if job.Status != "done" || !strings.HasSuffix(job.FilePath, ".csv.gz") {
+		t.Fatalf("status %s (%s), file %s; want done with a .csv.gz", job.Status, job.Error, job.FilePath)
+	}
+	// The final report comes after the gzip trailer is written
+	info, err := os.Stat(job.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.FlushedBytes != info.Size() {
+		t.Errorf("flushedBytes %d, want file size %d", job.FlushedBytes, info.Size())
+	}
+
+	rec := httptest.NewRecorder()
+	handleDownload(rec, httptest.NewRequest("GET", "/download/"+jobID, nil))
+	if ct := rec.Header().Get("Content-Type"); rec.Code != 200 || ct != "application/gzip" {
+		t.Fatalf("download: status %d, Content-Type %q", rec.Code, ct)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(gz).ReadAll()
+	if err != nil {
+		t.Fatalf("reading the download: %v", err)
+	}
+	if blocks := column(t, records, "block_number"); len(blocks) != 30 || blocks[29] != "30" {
+		t.Errorf("downloaded blocks %v, want 1 to 30", blocks)
+	}
+
+	rec = httptest.NewRecorder()
+	handleStatus(rec, httptest.NewRequest("GET", "/status/"+jobID+"/preview?limit=2", nil))
+	var rows []map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &rows); err != nil || len(rows) != 2 || rows[1]["block_number"] != "30" {
+		t.Errorf("preview: %s", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("POST", "/request?start=1&end=30&compress=zstd", nil))
+	if rec.Code != 400 {
+		t.Errorf("compress=zstd: status %d, want 400", rec.Code)
+	}
+}
+
+func TestFetchStep(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	tests := []struct {
+		name       string
+		step       uint64
+		start, end uint64
+		want       []uint64
+	}{
+		{name: "tenth", step: 10, start: 5, end: 50, want: []uint64{5, 15, 25, 35, 45}},
+		{name: "end on a sample", step: 10, start: 0, end: 30, want: []uint64{0, 10, 20, 30}},
+		{name: "step over the range", step: 1000, start: 7, end: 60, want: []uint64{7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			fetched := map[uint64]bool{}
+			srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+				n := blockParam(params)
+				mu.Lock()
+				fetched[n] = true
+				mu.Unlock()
+				return testBlock(n), nil
+			})
+			a := newTestAnalyzer(t, srv.URL)
+			setAnalyzer(t, a)
+			job := waitJob(t, submitJob(t, fmt.Sprintf("start=%d&end=%d&step=%d&baseFeeDelta=true", tt.start, tt.end, tt.step)))
+			if job.Status != "done" || job.LastWritten != tt.want[len(tt.want)-1] {
+				t.Fatalf("status %s (%s), lastWritten %d", job.Status, job.Error, job.LastWritten)
+			}
+			var got []uint64
+			for _, v := range column(t, readCSV(t, job.FilePath), "block_number") {
+				n, _ := strconv.ParseUint(v, 10, 64)
+				got = append(got, n)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("rows for blocks %v, want %v", got, tt.want)
+			}
+			mu.Lock()
+			for n := range fetched {
+				// The sample before the first gives its base fee delta
+				if (n < tt.start || (n-tt.start)%tt.step != 0) && n+tt.step != tt.start {
+					t.Errorf("fetched unsampled block %d", n)
+				}
+			}
+			mu.Unlock()
+
+			// Unsampled blocks in the cache are left out of a stepped read
+			seedCache(t, a, testBlocks(tt.start, tt.end))
+			cached, err := a.getCachedSamples(t.Context(), tt.start, tt.end, tt.step)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keys := slices.Sorted(maps.Keys(cached)); !slices.Equal(keys, tt.want) {
+				t.Errorf("getCachedSamples returned blocks %v, want %v", keys, tt.want)
+			}
+		})
+	}
+
+	for _, query := range []string{"step=0", "step=x", "step=2&topic=0x" + strings.Repeat("ab", 32)} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?start=1&end=10&"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestOutputSync(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(0, 1200))
+	setAnalyzer(t, a)
+	defer func(policy string) { syncPolicy = policy }(syncPolicy)
+	for _, policy := range []string{syncOff, syncCompletion, syncBatch} {
+		syncPolicy = policy
+		for _, query := range []string{"", "&compress=gzip"} {
+			job := waitJob(t, submitJob(t, "start=1&end=1200"+query))
+			info, err := os.Stat(job.FilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if job.Status != "done" || job.RowsWritten != 1200 || job.FlushedBytes != info.Size() {
+				t.Errorf("%s%s: status %s (%s), %d rows, flushedBytes %d of %d", policy, query, job.Status, job.Error, job.RowsWritten, job.FlushedBytes, info.Size())
+			}
+		}
+	}
+}
+
+func TestRanges(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(0, 120))
+	setAnalyzer(t, a)
+	tests := []struct {
+		query  string
+		blocks []string
+		total  uint64
+	}{
+		{
+			query:  "ranges=50-53,10-12,100-100",
+			blocks: []string{"10", "11", "12", "50", "51", "52", "53", "100"},
+			total:  8,
+		},
+		{
+			query:  "ranges=10-20,50-56&step=3",
+			blocks: []string{"10", "13", "16", "19", "50", "53", "56"},
+			total:  7,
+		},
+	}
+	for _, tt := range tests {
+		job := waitJob(t, submitJob(t, tt.query+"&baseFeeDelta=true"))
+		if job.Status != "done" || job.BlocksDone != tt.total || job.TotalBlocks != tt.total {
+			t.Fatalf("%s: status %s (%s), %d of %d blocks done; want %d", tt.query, job.Status, job.Error, job.BlocksDone, job.TotalBlocks, tt.total)
+		}
+		records := readCSV(t, job.FilePath)
+		if got := column(t, records, "block_number"); !slices.Equal(got, tt.blocks) {
+			t.Errorf("%s: wrote blocks %v, want %v", tt.query, got, tt.blocks)
+		}
+		// Each range's first delta is taken against the block, or sample,
+		// before it, and the base fee grows by one wei per block
+		step := uint64(1)
+		if job.Options.Step > 0 {
+			step = job.Options.Step
+		}
+		for _, delta := range column(t, records, "base_fee_delta") {
+			if delta != strconv.FormatUint(step, 10) {
+				t.Errorf("%s: base_fee_delta %s, want %d", tt.query, delta, step)
+			}
+		}
+		if first, last := job.Ranges[0], job.Ranges[len(job.Ranges)-1]; job.Start != first.Start || job.End != last.End {
+			t.Errorf("%s: start %d, end %d; want the bounds of %v", tt.query, job.Start, job.End, job.Ranges)
+		}
+	}
+
+	for _, query := range []string{"ranges=10-20,15-30", "ranges=10-20&start=10", "ranges=20-10", "ranges=10", "ranges=a-b"} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestLag(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	var headErr atomic.Bool
+	srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		if method == "eth_blockNumber" {
+			if headErr.Load() {
+				return nil, fmt.Errorf("unavailable")
+			}
+			return "0x64", nil // 100
+		}
+		return testBlock(blockParam(params)), nil
+	})
+	setAnalyzer(t, newTestAnalyzer(t, srv.URL))
+	tests := []struct {
+		query      string
+		start, end uint64
+		ranges     []blockRange
+	}{
+		{query: "start=80&end=100&lag=10", start: 80, end: 90},
+		{query: "start=80&end=85&lag=10", start: 80, end: 85},
+		{query: "start=90&end=100&lag=10", start: 90, end: 90},
+		{query: "ranges=10-20,85-95,97-99&lag=10", start: 10, end: 90, ranges: []blockRange{{10, 20}, {85, 90}}},
+		{query: "ranges=10-20,92-95&lag=10", start: 10, end: 20, ranges: []blockRange{{10, 20}}},
+	}
+	for _, tt := range tests {
+		job := waitJob(t, submitJob(t, tt.query))
+		if job.Status != "done" || job.Start != tt.start || job.End != tt.end || job.Options.Lag != 10 {
+			t.Errorf("%s: status %s (%s), blocks %d-%d with lag %d; want done, %d-%d with lag 10", tt.query, job.Status, job.Error, job.Start, job.End, job.Options.Lag, tt.start, tt.end)
+			continue
+		}
+		if tt.ranges != nil && !slices.Equal(job.Ranges, tt.ranges) {
+			t.Errorf("%s: ranges %v, want %v", tt.query, job.Ranges, tt.ranges)
+		}
+		if got := column(t, readCSV(t, job.FilePath), "block_number"); got[len(got)-1] != strconv.FormatUint(tt.end, 10) {
+			t.Errorf("%s: last block written %s, want %d", tt.query, got[len(got)-1], tt.end)
+		}
+	}
+
+	for _, query := range []string{"start=91&end=100&lag=10", "start=0&end=10&lag=101", "start=0&end=10&lag=-1", "start=0&end=10&lag=soon"} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+	// A fresh analyzer, as the head is cached
+	headErr.Store(true)
+	setAnalyzer(t, newTestAnalyzer(t, srv.URL))
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("POST", "/request?start=0&end=10&lag=5", nil))
+	if rec.Code != 502 {
+		t.Errorf("lag without a head: status %d, want 502", rec.Code)
+	}
+}
+
+func TestTimeRange(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	// Block n is at testGenesisTime+12n, up to the head at 100
+	var headErr atomic.Bool
+	srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		if method == "eth_blockNumber" {
+			if headErr.Load() {
+				return nil, fmt.Errorf("unavailable")
+			}
+			return "0x64", nil
+		}
+		return testBlock(blockParam(params)), nil
+	})
+	setAnalyzer(t, newTestAnalyzer(t, srv.URL))
+	tests := []struct {
+		query      string
+		start, end uint64
+	}{
+		{query: "startTime=1700000120&endTime=1700000240", start: 10, end: 20},
+		{query: "startTime=1700000121&endTime=1700000239", start: 11, end: 19},
+		{query: "startTime=2023-11-14T22:15:20Z&end=15", start: 10, end: 15},
+		{query: "start=5&endTime=1700000100", start: 5, end: 8},
+		{query: "startTime=1700001100&endTime=2030-01-01T00:00:00Z", start: 92, end: 100},
+	}
+	for _, tt := range tests {
+		job := waitJob(t, submitJob(t, tt.query))
+		if job.Status != "done" || job.Start != tt.start || job.End != tt.end {
+			t.Errorf("%s: status %s (%s), blocks %d-%d; want done, %d-%d", tt.query, job.Status, job.Error, job.Start, job.End, tt.start, tt.end)
+		}
+		if q, _ := url.ParseQuery(tt.query); (job.Options.StartTime != nil) != q.Has("startTime") || (job.Options.EndTime != nil) != q.Has("endTime") {
+			t.Errorf("%s: options.startTime %v, endTime %v", tt.query, job.Options.StartTime, job.Options.EndTime)
+		}
+	}
+
+	for _, query := range []string{
+		"startTime=soon&end=10", "start=1&endTime=soon", "startTime=1700000120&start=10&end=20", "ranges=1-5&startTime=1700000120",
+		"startTime=1700000240&endTime=1700000120", "startTime=1700002000&endTime=1700003000", "startTime=1700000121&endTime=1700000122",
+	} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+	// A fresh analyzer, as the head is cached
+	headErr.Store(true)
+	setAnalyzer(t, newTestAnalyzer(t, srv.URL))
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("POST", "/request?startTime=1700000120&end=20", nil))
+	if rec.Code != 502 {
+		t.Errorf("startTime without a head: status %d, want 502", rec.Code)
+	}
+}
+
+func TestMovingAvgWindow(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(0, 10))
+	setAnalyzer(t, a)
+	// Odd blocks carry all the tips
+	odd := strconv.Itoa(21000 * testTip)
+	tests := []struct {
+		query  string
+		column string
+		want   []string
+	}{
+		{query: "start=1&end=4&movingAvgWindow=2", column: "tips_moving_avg", want: []string{odd, "21000000000000", "21000000000000", "21000000000000"}},
+		{query: "start=2&end=6&movingAvgWindow=3", column: "tips_moving_avg", want: []string{"0", "21000000000000", "14000000000000", "28000000000000", "14000000000000"}},
+		{query: "start=1&end=3&movingAvgWindow=1&units=eth", column: "tips_moving_avg_eth", want: []string{"0.000042000000000000", "0.000000000000000000", "0.000042000000000000"}},
+		{query: "start=1&end=4&step=2&movingAvgWindow=2", column: "tips_moving_avg", want: []string{odd, odd}},
+	}
+	for _, tt := range tests {
+		job := waitJob(t, submitJob(t, tt.query))
+		if job.Status != "done" {
+			t.Fatalf("%s: status %s (%s)", tt.query, job.Status, job.Error)
+		}
+		if got := column(t, readCSV(t, job.FilePath), tt.column); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %s = %v, want %v", tt.query, tt.column, got, tt.want)
+		}
+	}
+
+	// A resumed job primes the window with the blocks already written
+	job := &JobStatus{Status: "pending", Start: 1, End: 5, FilePath: filepath.Join(t.TempDir(), "job.csv"), Options: fetchOptions{Format: formatCSV, MovingAvgWindow: 3}}
+	if err := os.WriteFile(job.FilePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	jobsMu.Lock()
+	jobs["resumed"] = job
+	startJob(a, "resumed", job, 4, true)
+	done := job.done
+	jobsMu.Unlock()
+	<-done
+	// The appended rows have no header; the average is their last column
+	var got []string
+	for _, record := range readCSV(t, job.FilePath) {
+		got = append(got, record[len(record)-1])
+	}
+	if want := []string{"14000000000000", "28000000000000"}; !slices.Equal(got, want) {
+		t.Errorf("resumed at block 4: tips_moving_avg = %v, want %v", got, want)
+	}
+
+	for _, query := range []string{"movingAvgWindow=0", "movingAvgWindow=x", "movingAvgWindow=10001", "movingAvgWindow=2&format=json", "movingAvgWindow=2&rollup=day"} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?start=1&end=10&"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestFetchProgress(t *testing.T) {
+	// Block 700 is missing; progress is reported after every batch
+	a, _ := newFixtureAnalyzer(t, testBlocks(0, 1200, 700))
+	var reports []fetchProgress
+	req := fetchRequest{
+		Ranges:   []blockRange{{Start: 1, End: 1200}},
+		From:     1,
+		FilePath: filepath.Join(t.TempDir(), "out.csv"),
+		Opts:     fetchOptions{Format: formatCSV, GapPolicy: gapSkip},
+		Progress: func(p fetchProgress) { reports = append(reports, p) },
+	}
+	// The fetcher runs outside any job
+	if err := parallelFetcher(t.Context(), a, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) < 2 {
+		t.Fatalf("got %d progress reports, want one per batch", len(reports))
+	}
+	var total fetchProgress
+	for i, p := range reports {
+		if i > 0 && p.LastWritten < reports[i-1].LastWritten {
+			t.Errorf("report %d went back from block %d to %d", i, reports[i-1].LastWritten, p.LastWritten)
+		}
+		if p.NextBlock != p.LastWritten+1 {
+			t.Errorf("report %d: nextBlock %d after lastWritten %d", i, p.NextBlock, p.LastWritten)
+		}
+		total.Blocks += p.Blocks
+		total.Rows += p.Rows
+		total.EmptyBlocks += p.EmptyBlocks
+		total.Gaps = append(total.Gaps, p.Gaps...)
+	}
+	last := reports[len(reports)-1]
+	info, err := os.Stat(req.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.LastWritten != 1200 || last.FlushedBytes != info.Size() {
+		t.Errorf("last report at block %d with %d bytes flushed, want block 1200 and %d bytes", last.LastWritten, last.FlushedBytes, info.Size())
+	}
+	// Even blocks have no transactions, and the gap is passed without a row
+	if total.Blocks != 1200 || total.Rows != 1199 || total.EmptyBlocks != 599 || !slices.Equal(total.Gaps, []uint64{700}) {
+		t.Errorf("reports add up to %d blocks, %d rows, %d empty blocks and gaps %v; want 1200, 1199, 599 and [700]",
+			total.Blocks, total.Rows, total.EmptyBlocks, total.Gaps)
+	}
+}
+
+func TestLineEnding(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(0, 10))
+	setAnalyzer(t, a)
+	tests := []struct {
+		query string
+		lines int
+		crlf  bool
+	}{
+		{query: "start=1&end=10", lines: 11},
+		{query: "start=1&end=10&lineEnding=lf", lines: 11},
+		{query: "start=1&end=10&lineEnding=crlf", lines: 11, crlf: true},
+		{query: "start=1&end=10&lineEnding=crlf&rollup=day", lines: 2, crlf: true},
+	}
+	for _, tt := range tests {
+		job := waitJob(t, submitJob(t, tt.query))
+		if job.Status != "done" {
+			t.Fatalf("%s: status %s (%s)", tt.query, job.Status, job.Error)
+		}
+		data, err := os.ReadFile(job.FilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lf, crlf := bytes.Count(data, []byte("\n")), bytes.Count(data, []byte("\r\n"))
+		want := 0
+		if tt.crlf {
+			want = tt.lines
+		}
+		if lf != tt.lines || crlf != want {
+			t.Errorf("%s: %d lines, %d ending in CRLF; want %d and %d", tt.query, lf, crlf, tt.lines, want)
+		}
+	}
+
+	for _, query := range []string{"lineEnding=cr", "lineEnding=CRLF", "lineEnding=crlf&format=protobuf"} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?start=1&end=10&"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestFetchNearMaxBlock(t *testing.T) {
+	const top = maxBlockNumber
+	tests := []struct {
+		name       string
+		start, end uint64
+		step       uint64
+		want       []uint64
+	}{
+		{name: "last blocks", start: top - 2, end: top, want: []uint64{top - 2, top - 1, top}},
+		{name: "step past the end", start: top - 1000, end: top, step: 600, want: []uint64{top - 1000, top - 400}},
+		{name: "largest step", start: 0, end: top, step: top, want: []uint64{0, top}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Timestamps and base fees of testBlock would overflow up here
+			srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+				n := blockParam(params)
+				block := testBlock(n % 1000)
+				block.Number = fmt.Sprintf("0x%x", n)
+				return block, nil
+			})
+			a := newTestAnalyzer(t, srv.URL)
+			ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+			defer cancel()
+			path := filepath.Join(t.TempDir(), "job.csv")
+			err := parallelFetcher(ctx, a, fetchRequest{
+				Ranges:   []blockRange{{tt.start, tt.end}},
+				FilePath: path,
+				Opts:     fetchOptions{Format: formatCSV, Step: tt.step},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ctx.Err() != nil {
+				t.Fatal("fetch didn't terminate")
+			}
+			var got []uint64
+			for _, v := range column(t, readCSV(t, path), "block_number") {
+				n, _ := strconv.ParseUint(v, 10, 64)
+				got = append(got, n)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("rows for blocks %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Past the cache's signed 64-bit integers
+	past := strconv.FormatUint(top+1, 10)
+	for _, query := range []string{"start=1&end=" + past, "start=1&end=10&step=" + past, "ranges=1-" + past} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestHandleLive(t *testing.T) {
+	// Restored in a cleanup, after the streams' handlers have returned
+	saved := livePollInterval
+	livePollInterval = 20 * time.Millisecond
+	t.Cleanup(func() { livePollInterval = saved })
+	var head atomic.Uint64
+	head.Store(2000)
+	stub := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		if method == "eth_blockNumber" {
+			return fmt.Sprintf("0x%x", head.Load()), nil
+		}
+		if n := blockParam(params); n <= head.Load() {
+			return testBlock(n), nil
+		}
+		return nil, nil
+	})
+	setAnalyzer(t, newTestAnalyzer(t, stub.URL))
+	srv := httptest.NewServer(http.HandlerFunc(handleLive))
+	t.Cleanup(srv.Close)
+
+	// open starts a stream, which is closed when the test ends
+	open := func(query, lastEventID string) *http.Response {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		t.Cleanup(cancel)
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/live"+query, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	// ids reads the ids of the next n events of a stream
+	ids := func(sc *bufio.Scanner, n int) []uint64 {
+		t.Helper()
+		var got []uint64
+		for len(got) < n && sc.Scan() {
+			if v, ok := strings.CutPrefix(sc.Text(), "id: "); ok {
+				id, _ := strconv.ParseUint(v, 10, 64)
+				got = append(got, id)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	tests := []struct {
+		name, query, lastEventID string
+		want                     []uint64
+	}{
+		{name: "head", want: []uint64{2000}},
+		{name: "backfill", query: "?from=1998", want: []uint64{1998, 1999, 2000}},
+		{name: "longest backfill", query: "?from=1000", want: []uint64{1000, 1001}},
+		{name: "reconnect", query: "?from=1990", lastEventID: "1998", want: []uint64{1999, 2000}},
+	}
+	for _, tt := range tests {
+		resp := open(tt.query, tt.lastEventID)
+		if ct := resp.Header.Get("Content-Type"); resp.StatusCode != 200 || ct != "text/event-stream" {
+			t.Errorf("%s: status %d with Content-Type %q", tt.name, resp.StatusCode, ct)
+			continue
+		}
+		if got := ids(bufio.NewScanner(resp.Body), len(tt.want)); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got events %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, query := range []string{"?from=ten", "?from=999", "?from=0"} {
+		if resp := open(query, ""); resp.StatusCode != 400 {
+			t.Errorf("GET /live%s = %d, want 400", query, resp.StatusCode)
+		}
+	}
+
+	// Blocks mined after the stream starts are sent as the head moves,
+	// including any mined between polls
+	sc := bufio.NewScanner(open("", "").Body)
+	if got := ids(sc, 1); !slices.Equal(got, []uint64{2000}) {
+		t.Fatalf("got events %v, want [2000]", got)
+	}
+	head.Store(2002)
+	if got := ids(sc, 2); !slices.Equal(got, []uint64{2001, 2002}) {
+		t.Errorf("after the head moved got events %v, want [2001 2002]", got)
+	}
+
+	// A start past the head waits for it rather than overflowing
+	if resp := open("?from=18446744073709551615", ""); resp.StatusCode != 200 {
+		t.Errorf("GET /live?from=max = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestGasPriceBuckets(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, calls := newFixtureAnalyzer(t, testBlocks(0, 10))
+	setAnalyzer(t, a)
+	// Cached rows carry no gas prices, so they are fetched again
+	seedCache(t, a, testBlocks(1, 10))
+
+	// Odd blocks have one transaction paying about 3 gwei per gas
+	job := waitJob(t, submitJob(t, "start=1&end=10&gasPriceBuckets=2,3.5,10"))
+	if job.Status != "done" {
+		t.Fatalf("status %s (%s), want done", job.Status, job.Error)
+	}
+	if calls.Load() < 10 {
+		t.Errorf("made %d block calls, want the 10 cached blocks fetched", calls.Load())
+	}
+	records := readCSV(t, job.FilePath)
+	for _, name := range []string{"txs_lt_2_gwei", "txs_2_3.5_gwei", "txs_3.5_10_gwei", "txs_ge_10_gwei"} {
+		for i, v := range column(t, records, name) {
+			want := "0"
+			if name == "txs_2_3.5_gwei" && i%2 == 0 {
+				want = "1"
+			}
+			if v != want {
+				t.Errorf("block %d: %s = %s, want %s", i+1, name, v, want)
+			}
+		}
+	}
+
+	for _, query := range []string{
+		"start=1&end=10&gasPriceBuckets=3,2",
+		"start=1&end=10&gasPriceBuckets=2&format=protobuf",
+		"start=1&end=10&gasPriceBuckets=2&rollup=hour",
+	} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestCumulativeGas(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	// Odd blocks use 21000 gas and carry all the tips; block 3 is missing
+	a, _ := newFixtureAnalyzer(t, testBlocks(0, 6, 3))
+	setAnalyzer(t, a)
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "start=4&end=6", want: []string{"0", "21000", "21000"}},
+		{query: "ranges=1-2,5-6", want: []string{"21000", "21000", "42000", "42000"}},
+		{query: "start=4&end=6&minTips=1", want: []string{"21000"}},
+		{query: "start=1&end=6&gapPolicy=fill-zero", want: []string{"21000", "21000", "21000", "21000", "42000", "42000"}},
+	}
+	for _, tt := range tests {
+		job := waitJob(t, submitJob(t, tt.query+"&cumulativeGas=true"))
+		if job.Status != "done" {
+			t.Errorf("%s: status %s (%s), want done", tt.query, job.Status, job.Error)
+			continue
+		}
+		if got := column(t, readCSV(t, job.FilePath), "cumulative_gas_used"); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: cumulative_gas_used %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// A resumed job carries the total on from its file
+	path := filepath.Join(t.TempDir(), "job.csv")
+	if err := os.WriteFile(path, []byte("block_number,gas_used,cumulative_gas_used\n1,21000,21000\n2,0,21000\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	req := fetchRequest{
+		Ranges:   []blockRange{{Start: 1, End: 6}},
+		From:     4,
+		FilePath: path,
+		Opts:     fetchOptions{Format: formatCSV, CumulativeGas: true, Fields: []string{"block_number", "gas_used", "cumulative_gas_used"}},
+		Resume:   true,
+	}
+	if err := parallelFetcher(t.Context(), a, req); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := column(t, readCSV(t, path), "cumulative_gas_used"), []string{"21000", "21000", "21000", "42000", "42000"}; !slices.Equal(got, want) {
+		t.Errorf("resumed at block 4: cumulative_gas_used %v, want %v", got, want)
+	}
+
+	for _, query := range []string{"cumulativeGas=true&format=protobuf", "cumulativeGas=true&rollup=day"} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?start=1&end=6&"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestCacheErrorLimit(t *testing.T) {
+	defer func(n uint64) { cacheErrorLimit = n }(cacheErrorLimit)
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(0, 5))
+	setAnalyzer(t, a)
+	// Every cache read and write of a block now fails
+	if _, err := a.db.Exec("DROP TABLE block_cache"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a limit the job carries on over RPC
+	cacheErrorLimit = 0
+	if job := waitJob(t, submitJob(t, "start=1&end=5")); job.Status != "done" || job.LastWritten != 5 {
+		t.Errorf("no limit: status %s (%s), lastWritten %d; want done at 5", job.Status, job.Error, job.LastWritten)
+	}
+	cacheErrorLimit = 1
+	if job := waitJob(t, submitJob(t, "start=1&end=5")); job.Status != "error" || !strings.Contains(job.Error, "cache errors") {
+		t.Errorf("limit 1: status %s (%s), want an error about cache errors", job.Status, job.Error)
+	}
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	var metrics struct {
+		CacheWrites struct {
+			Errors uint64 `json:"errors"`
+		} `json:"cacheWrites"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &metrics); err != nil || metrics.CacheWrites.Errors < 2 {
+		t.Errorf("cacheWrites.errors = %d (%v), want the errors of both jobs", metrics.CacheWrites.Errors, err)
+	}
+}
+
+func TestDownloadGzip(t *testing.T) {
+	content := "block_number,timestamp,gas_used,tips\n"
+	for n := 10; n <= 20; n++ {
+		content += fmt.Sprintf("%d,1700000000,21000,42000000000000\n", n)
+	}
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "plain.csv")
+	gzPath := filepath.Join(dir, "stored.csv.gz")
+	var stored bytes.Buffer
+	zw := gzip.NewWriter(&stored)
+	zw.Write([]byte(content))
+	zw.Close()
+	if err := os.WriteFile(plainPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(gzPath, stored.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	flushed := int64(strings.Index(content, "15,"))
+	job := func(status, path, compress string) *JobStatus {
+		return &JobStatus{
+			Status: status, Start: 10, End: 20, FilePath: path, FlushedBytes: flushed,
+			Options: fetchOptions{Format: formatCSV, Compress: compress},
+		}
+	}
+	setJobs(t, map[string]*JobStatus{
+		"done":    job("done", plainPath, ""),
+		"running": job("pending", plainPath, ""),
+		"stored":  job("done", gzPath, "gzip"),
+	})
+
+	tests := []struct {
+		name     string
+		target   string
+		accept   string
+		rng      string
+		wantCode int
+		wantGzip bool   // Content-Encoding: gzip
+		want     string // body, decoded when wantGzip
+	}{
+		{name: "identity", target: "/download/done", wantCode: 200, want: content},
+		{name: "gzip", target: "/download/done", accept: "gzip, deflate", wantCode: 200, wantGzip: true, want: content},
+		{name: "wildcard", target: "/download/done", accept: "*", wantCode: 200, wantGzip: true, want: content},
+		{name: "gzip refused", target: "/download/done", accept: "gzip;q=0", wantCode: 200, want: content},
+		{name: "only others", target: "/download/done", accept: "br, *;q=0", wantCode: 200, want: content},
+		{name: "range", target: "/download/done", accept: "gzip", rng: "bytes=0-11", wantCode: 206, want: content[:12]},
+		{name: "running", target: "/download/running", accept: "gzip", wantCode: 200, wantGzip: true, want: content[:flushed]},
+		{
+			name: "filtered", target: "/download/done?from=19&to=20", accept: "gzip", wantCode: 200, wantGzip: true,
+			want: "block_number,timestamp,gas_used,tips\n19,1700000000,21000,42000000000000\n20,1700000000,21000,42000000000000\n",
+		},
+		{name: "stored gzip", target: "/download/stored", accept: "gzip", wantCode: 200, want: stored.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept-Encoding", tt.accept)
+			}
+			if tt.rng != "" {
+				req.Header.Set("Range", tt.rng)
+			}
+			rec := httptest.NewRecorder()
+			handleDownload(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Encoding") == "gzip"; got != tt.wantGzip {
+				t.Fatalf("gzip encoded: %v, want %v", got, tt.wantGzip)
+			}
+			file := filepath.Base(plainPath)
+			if strings.HasPrefix(tt.target, "/download/stored") {
+				file = filepath.Base(gzPath)
+			}
+			if got, want := rec.Header().Get("Content-Disposition"), fmt.Sprintf("attachment; filename=%q", file); got != want {
+				t.Errorf("Content-Disposition %q, want %q", got, want)
+			}
+			body := rec.Body.Bytes()
+			if tt.wantGzip {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(body) != tt.want {
+				t.Errorf("body %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
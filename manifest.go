@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// version identifies the fetcher build in manifests; set it with
+// -ldflags "-X main.version=..."
+var version = "dev"
+
+// jobManifest records the provenance of a finished job's output file
+type jobManifest struct {
+	JobID       string       `json:"jobID"`
+	Version     string       `json:"version"`
+	Status      string       `json:"status"`
+	Options     fetchOptions `json:"options"`
+	Start       uint64       `json:"start"`
+	End         uint64       `json:"end"`
+	LastWritten uint64       `json:"lastWritten"`
+	Rows        uint64       `json:"rows"`
+	Gaps        []uint64     `json:"gaps,omitempty"`
+	Failed      []uint64     `json:"failedBlocks,omitempty"`
+	EmptyBlocks uint64       `json:"emptyBlocks"`
+	Columns     []string     `json:"columns"`
+	File        string       `json:"file"`
+	Compression string       `json:"compression,omitempty"`
+	SHA256      string       `json:"sha256"`
+	StartedAt   time.Time    `json:"startedAt"`
+	FinishedAt  *time.Time   `json:"finishedAt"`
+}
+
+// newJobManifest snapshots job; callers must hold jobsMu. The checksum is
+// filled in by writeManifest.
+func newJobManifest(jobID string, job *JobStatus) *jobManifest {
+	return &jobManifest{
+		JobID:       jobID,
+		Version:     version,
+		Status:      job.Status,
+		Options:     job.Options,
+		Start:       job.Start,
+		End:         job.End,
+		LastWritten: job.LastWritten,
+		Rows:        job.RowsWritten,
+		Gaps:        job.Gaps,
+		Failed:      job.FailedBlocks,
+		EmptyBlocks: job.EmptyBlocks,
+		Columns:     outputFormats[job.Options.Format].columns(job.Options),
+		File:        filepath.Base(job.FilePath),
+		Compression: job.Options.Compress,
+		StartedAt:   job.StartedAt,
+		FinishedAt:  job.FinishedAt,
+	}
+}
+
+func manifestPath(filePath string) string {
+	return filePath + ".manifest.json"
+}
+
+// writeManifest checksums the job file and atomically writes the manifest
+// next to it, so readers never observe a half-written manifest.
+func writeManifest(filePath string, manifest *jobManifest) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	manifest.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".manifest-*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), manifestPath(filePath))
+}
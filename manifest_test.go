@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestJobManifest(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(9, 20))
+	setAnalyzer(t, a)
+
+	// Only the five odd blocks tip
+	jobID := submitJob(t, "start=10&end=20&minTips=1&baseFeeDelta=true")
+	job := waitJob(t, jobID)
+	if job.Status != "done" {
+		t.Fatalf("status %s (%s), want done", job.Status, job.Error)
+	}
+	rec := httptest.NewRecorder()
+	handleStatus(rec, httptest.NewRequest("GET", "/status/"+jobID+"/manifest", nil))
+	if rec.Code != 200 {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var m jobManifest
+	if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(job.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if m.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("sha256 %s, want %x", m.SHA256, sum)
+	}
+	if m.JobID != jobID || m.Status != "done" || m.Start != 10 || m.End != 20 || m.LastWritten != 20 || m.Rows != 5 {
+		t.Errorf("manifest %+v, want job %s done over 10-20 with 5 rows", m, jobID)
+	}
+	if m.File != filepath.Base(job.FilePath) || m.Version != version || m.FinishedAt == nil || m.FinishedAt.Before(m.StartedAt) {
+		t.Errorf("manifest %+v", m)
+	}
+	if want := []string{"block_number", "timestamp", "gas_used", "tips", "base_fee_delta"}; !slices.Equal(m.Columns, want) {
+		t.Errorf("columns %v, want %v", m.Columns, want)
+	}
+
+	// Running jobs have no manifest yet
+	setJobs(t, map[string]*JobStatus{
+		"running": {Status: "pending", Start: 10, End: 20, FilePath: filepath.Join(t.TempDir(), "job.csv")},
+	})
+	rec = httptest.NewRecorder()
+	handleStatus(rec, httptest.NewRequest("GET", "/status/running/manifest", nil))
+	if rec.Code != 404 {
+		t.Errorf("running job: status %d, want 404", rec.Code)
+	}
+}
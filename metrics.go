@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the histogram upper bounds, from sub-second to
+// multi-second RPC round trips. Slower observations land in an overflow bucket.
+var latencyBuckets = []time.Duration{
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// latencyHistogram is a fixed-bucket histogram of durations
+type latencyHistogram struct {
+	mu     sync.Mutex
+	counts []uint64 // len(latencyBuckets)+1, last is overflow
+	count  uint64
+	sum    time.Duration
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *latencyHistogram) Observe(d time.Duration) {
+	i := len(latencyBuckets)
+	for j, le := range latencyBuckets {
+		if d <= le {
+			i = j
+			break
+		}
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	h.mu.Unlock()
+}
+
+type histogramBucket struct {
+	LeMs  float64 `json:"leMs"` // +Inf for the overflow bucket, encoded as -1
+	Count uint64  `json:"count"`
+}
+
+type histogramSnapshot struct {
+	Count   uint64            `json:"count"`
+	MeanMs  float64           `json:"meanMs"`
+	P50Ms   float64           `json:"p50Ms"`
+	P90Ms   float64           `json:"p90Ms"`
+	P99Ms   float64           `json:"p99Ms"`
+	Buckets []histogramBucket `json:"buckets"`
+}
+
+// Snapshot returns the bucket counts and percentile estimates. Percentiles
+// are the upper bound of the bucket holding them (-1 if in the overflow).
+func (h *latencyHistogram) Snapshot() histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snap := histogramSnapshot{Count: h.count, Buckets: make([]histogramBucket, len(h.counts))}
+	for i, c := range h.counts {
+		snap.Buckets[i] = histogramBucket{LeMs: bucketBoundMs(i), Count: c}
+	}
+	if h.count == 0 {
+		return snap
+	}
+	snap.MeanMs = float64(h.sum.Microseconds()) / 1000 / float64(h.count)
+	snap.P50Ms = h.quantileMs(0.50)
+	snap.P90Ms = h.quantileMs(0.90)
+	snap.P99Ms = h.quantileMs(0.99)
+	return snap
+}
+
+func (h *latencyHistogram) quantileMs(q float64) float64 {
+	rank := uint64(math.Ceil(q * float64(h.count)))
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			return bucketBoundMs(i)
+		}
+	}
+	return -1
+}
+
+func bucketBoundMs(i int) float64 {
+	if i >= len(latencyBuckets) {
+		return -1
+	}
+	return float64(latencyBuckets[i].Microseconds()) / 1000
+}
+
+// batchWindow is how many recent batches the rolling batch averages cover
+const batchWindow = 100
+
+type batchSample struct {
+	took time.Duration
+	rows uint64
+}
+
+// batchStats keeps rolling averages of fetch batch durations and write
+// throughput over the last batchWindow batches. Recording a batch costs one
+// clock read and a short lock, next to the hundreds of RPCs it covers.
+type batchStats struct {
+	mu      sync.Mutex
+	samples []batchSample // ring of up to batchWindow
+	next    int
+	count   uint64
+}
+
+func (s *batchStats) Observe(took time.Duration, rows uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sample := batchSample{took, rows}
+	if len(s.samples) < batchWindow {
+		s.samples = append(s.samples, sample)
+	} else {
+		s.samples[s.next] = sample
+		s.next = (s.next + 1) % batchWindow
+	}
+	s.count++
+}
+
+type batchSnapshot struct {
+	Count      uint64  `json:"count"`
+	Window     int     `json:"window"`
+	MeanMs     float64 `json:"meanMs"`
+	RowsPerSec float64 `json:"rowsPerSec"`
+}
+
+// Snapshot returns the total batch count and the averages over the window.
+// rowsPerSec is the rows written divided by the time spent on their batches.
+func (s *batchStats) Snapshot() batchSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := batchSnapshot{Count: s.count, Window: len(s.samples)}
+	var took time.Duration
+	var rows uint64
+	for _, sample := range s.samples {
+		took += sample.took
+		rows += sample.rows
+	}
+	if took > 0 {
+		snap.MeanMs = float64(took.Microseconds()) / 1000 / float64(len(s.samples))
+		snap.RowsPerSec = float64(rows) / took.Seconds()
+	}
+	return snap
+}
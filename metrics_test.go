@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram()
+	if snap := h.Snapshot(); snap.Count != 0 || snap.P50Ms != 0 || len(snap.Buckets) != len(latencyBuckets)+1 {
+		t.Errorf("empty snapshot %+v", snap)
+	}
+	// 90 fast calls, 9 at a second and one past the last bucket
+	for range 90 {
+		h.Observe(10 * time.Millisecond)
+	}
+	for range 9 {
+		h.Observe(time.Second)
+	}
+	h.Observe(time.Minute)
+
+	snap := h.Snapshot()
+	if snap.Count != 100 {
+		t.Errorf("count %d, want 100", snap.Count)
+	}
+	if want := (90*10.0 + 9*1000 + 60000) / 100; snap.MeanMs != want {
+		t.Errorf("mean %vms, want %vms", snap.MeanMs, want)
+	}
+	if snap.P50Ms != 25 || snap.P90Ms != 25 || snap.P99Ms != 1000 {
+		t.Errorf("p50, p90, p99 = %v, %v, %vms; want 25, 25, 1000", snap.P50Ms, snap.P90Ms, snap.P99Ms)
+	}
+	want := map[float64]uint64{25: 90, 1000: 9, -1: 1}
+	for _, b := range snap.Buckets {
+		if b.Count != want[b.LeMs] {
+			t.Errorf("bucket %vms has %d, want %d", b.LeMs, b.Count, want[b.LeMs])
+		}
+	}
+	h.Observe(time.Minute)
+	if snap := h.Snapshot(); snap.P99Ms != -1 {
+		t.Errorf("p99 %vms, want -1 once it is in the overflow bucket", snap.P99Ms)
+	}
+}
+
+func TestBatchStats(t *testing.T) {
+	var s batchStats
+	if snap := s.Snapshot(); snap != (batchSnapshot{}) {
+		t.Errorf("empty snapshot %+v", snap)
+	}
+	// Slow batches that fall out of the window, then 100 of 10ms and 50 rows
+	for range 20 {
+		s.Observe(time.Second, 1)
+	}
+	for range batchWindow {
+		s.Observe(10*time.Millisecond, 50)
+	}
+	want := batchSnapshot{Count: batchWindow + 20, Window: batchWindow, MeanMs: 10, RowsPerSec: 5000}
+	if snap := s.Snapshot(); snap != want {
+		t.Errorf("snapshot %+v, want %+v", snap, want)
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	a, calls := newFixtureAnalyzer(t, testBlocks(1, 5))
+	setAnalyzer(t, a)
+	for n := uint64(1); n <= 5; n++ {
+		if _, err := a.GetBlockGasAndTips(t.Context(), n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Cache hits make no RPC round trip
+	if _, err := a.GetBlockGasAndTips(t.Context(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	var metrics struct {
+		RPCLatency histogramSnapshot `json:"rpcLatency"`
+		Batches    batchSnapshot     `json:"batches"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if got := metrics.RPCLatency.Count; got != 5 || got != uint64(calls.Load()) {
+		t.Errorf("rpcLatency count %d, want the 5 block calls", got)
+	}
+
+	// Fetches count their batches
+	req := fetchRequest{
+		Ranges:   []blockRange{{Start: 1, End: 5}},
+		From:     1,
+		FilePath: filepath.Join(t.TempDir(), "out.csv"),
+		Opts:     fetchOptions{Format: formatCSV},
+	}
+	if err := parallelFetcher(t.Context(), a, req); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if err := json.Unmarshal(rec.Body.Bytes(), &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if b := metrics.Batches; b.Count != 1 || b.Window != 1 || b.RowsPerSec <= 0 {
+		t.Errorf("batches %+v, want the one batch of 5 rows", b)
+	}
+}
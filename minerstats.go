@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriver is go-sqlite3 with the cache's SQL helpers registered on
+// every connection
+const sqliteDriver = "sqlite3_ethfetcher"
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterAggregator("hexsum", newHexSum, true); err != nil {
+				return err
+			}
+			return conn.RegisterAggregator("hexprodsum", newHexProdSum, true)
+		},
+	})
+}
+
+// sqlHex parses a hex TEXT amount as passed to an aggregate. NULL is zero.
+func sqlHex(v any) (*big.Int, error) {
+	switch v := v.(type) {
+	case string:
+		return hexToBig(v)
+	case []byte:
+		return hexToBig(string(v))
+	case nil:
+		return new(big.Int), nil
+	}
+	return nil, fmt.Errorf("hex amount has type %T", v)
+}
+
+// hexSum is the hexsum(x) aggregate: the exact sum of hex amounts such as
+// total_tips, as decimal TEXT. SQLite's SUM would overflow 64 bits.
+type hexSum struct {
+	total big.Int
+}
+
+func newHexSum() *hexSum { return &hexSum{} }
+
+func (s *hexSum) Step(v any) error {
+	n, err := sqlHex(v)
+	if err != nil {
+		return err
+	}
+	s.total.Add(&s.total, n)
+	return nil
+}
+
+func (s *hexSum) Done() (string, error) { return s.total.String(), nil }
+
+// hexProdSum is the hexprodsum(x, y) aggregate: the sum of x*y over hex
+// amounts, such as base_fee and gas_used for burned fees, as decimal TEXT.
+type hexProdSum struct {
+	total big.Int
+}
+
+func newHexProdSum() *hexProdSum { return &hexProdSum{} }
+
+func (s *hexProdSum) Step(x, y any) error {
+	a, err := sqlHex(x)
+	if err != nil {
+		return err
+	}
+	b, err := sqlHex(y)
+	if err != nil {
+		return err
+	}
+	s.total.Add(&s.total, a.Mul(a, b))
+	return nil
+}
+
+func (s *hexProdSum) Done() (string, error) { return s.total.String(), nil }
+
+// minerTotals are the cached blocks of one fee recipient. Amounts are in
+// wei, as decimal strings.
+type minerTotals struct {
+	Miner      string `json:"miner"`
+	Blocks     uint64 `json:"blocks"`
+	Tips       string `json:"tips"`
+	BurnedFees string `json:"burnedFees"`
+
+	tips *big.Int
+}
+
+// minerStats totals the cached blocks in a range by miner. Unattributed
+// counts cached blocks without a miner, cached before it was stored.
+type minerStats struct {
+	Start        uint64         `json:"start"`
+	End          uint64         `json:"end"`
+	Blocks       uint64         `json:"blocks"`
+	Unattributed uint64         `json:"unattributed"`
+	Miners       []*minerTotals `json:"miners"`
+}
+
+const minerStatsQuery = `
+SELECT miner, COUNT(*), hexsum(total_tips), hexprodsum(base_fee, gas_used)
+FROM block_cache
+WHERE block_num BETWEEN ? AND ? AND miner IS NOT NULL AND miner != ''
+GROUP BY miner`
+
+// MinerStats groups the cached blocks in [start, end] by miner, with their
+// total tips and burned fees, largest tips first. Only cached blocks are
+// counted; nothing is fetched.
+func (a *Analyzer) MinerStats(ctx context.Context, start, end uint64) (*minerStats, error) {
+	stats := &minerStats{Start: start, End: end, Miners: []*minerTotals{}}
+	rows, err := a.db.QueryContext(ctx, minerStatsQuery, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m := &minerTotals{}
+		if err := rows.Scan(&m.Miner, &m.Blocks, &m.Tips, &m.BurnedFees); err != nil {
+			return nil, err
+		}
+		m.tips, _ = new(big.Int).SetString(m.Tips, 10)
+		stats.Blocks += m.Blocks
+		stats.Miners = append(stats.Miners, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	err = a.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM block_cache
+		WHERE block_num BETWEEN ? AND ? AND (miner IS NULL OR miner = '')`, start, end).Scan(&stats.Unattributed)
+	if err != nil {
+		return nil, err
+	}
+	stats.Blocks += stats.Unattributed
+	sort.Slice(stats.Miners, func(i, j int) bool {
+		if c := stats.Miners[i].tips.Cmp(stats.Miners[j].tips); c != 0 {
+			return c > 0
+		}
+		return stats.Miners[i].Miner < stats.Miners[j].Miner
+	})
+	return stats, nil
+}
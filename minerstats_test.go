@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleCacheMiners(t *testing.T) {
+	a := newTestAnalyzer(t, "")
+	setAnalyzer(t, a)
+
+	// Blocks 1-3 are mined by a, 4-6 by b; 7-8 were cached without a miner
+	var results []*BlockResult
+	for i, block := range testBlocks(1, 6) {
+		block.Miner = "0x00000000000000000000000000000000000000BB"
+		if i < 3 {
+			block.Miner = "0x00000000000000000000000000000000000000AA"
+		}
+		r, err := a.parseBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.BlockNum = uint64(i + 1)
+		results = append(results, r)
+	}
+	a.insertCacheRows(results)
+	seedCache(t, a, testBlocks(7, 8))
+
+	// totals sums the tips and burned fees of blocks as wei strings
+	totals := func(blocks ...uint64) (tips, burned string) {
+		tipSum, burnedSum := new(big.Int), new(big.Int)
+		for _, r := range results {
+			for _, n := range blocks {
+				if r.BlockNum == n {
+					tipSum.Add(tipSum, r.Tips)
+					burnedSum.Add(burnedSum, new(big.Int).Mul(r.BaseFee, r.GasUsed))
+				}
+			}
+		}
+		return tipSum.String(), burnedSum.String()
+	}
+	aTips, aBurned := totals(1, 2, 3)
+	bTips, bBurned := totals(4, 5, 6)
+	minerA := minerTotals{Miner: "0x00000000000000000000000000000000000000aa", Blocks: 3, Tips: aTips, BurnedFees: aBurned}
+	minerB := minerTotals{Miner: "0x00000000000000000000000000000000000000bb", Blocks: 3, Tips: bTips, BurnedFees: bBurned}
+
+	tests := []struct {
+		query            string
+		want             []minerTotals
+		wantBlocks       uint64
+		wantUnattributed uint64
+	}{
+		{query: "start=1&end=8", want: []minerTotals{minerA, minerB}, wantBlocks: 8, wantUnattributed: 2},
+		{query: "start=1&end=8&limit=1", want: []minerTotals{minerA}, wantBlocks: 8, wantUnattributed: 2},
+		{query: "start=4&end=6", want: []minerTotals{minerB}, wantBlocks: 3},
+		{query: "start=100&end=200", want: []minerTotals{}},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleCacheMiners(rec, httptest.NewRequest("GET", "/cache/miners?"+tt.query, nil))
+		var stats minerStats
+		if err := json.Unmarshal(rec.Body.Bytes(), &stats); rec.Code != 200 || err != nil {
+			t.Fatalf("GET /cache/miners?%s = %d %s", tt.query, rec.Code, rec.Body)
+		}
+		if stats.Blocks != tt.wantBlocks || stats.Unattributed != tt.wantUnattributed {
+			t.Errorf("GET /cache/miners?%s: %d blocks, %d unattributed; want %d, %d", tt.query, stats.Blocks, stats.Unattributed, tt.wantBlocks, tt.wantUnattributed)
+		}
+		if len(stats.Miners) != len(tt.want) {
+			t.Errorf("GET /cache/miners?%s: got %d miners, want %d", tt.query, len(stats.Miners), len(tt.want))
+			continue
+		}
+		for i, m := range stats.Miners {
+			m.tips = nil
+			if *m != tt.want[i] {
+				t.Errorf("GET /cache/miners?%s: miner %d = %+v, want %+v", tt.query, i, *m, tt.want[i])
+			}
+		}
+	}
+
+	for _, query := range []string{"end=8", "start=1", "start=8&end=1", "start=1&end=8&limit=0", "start=1&end=8&limit=x"} {
+		rec := httptest.NewRecorder()
+		handleCacheMiners(rec, httptest.NewRequest("GET", "/cache/miners?"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("GET /cache/miners?%s = %d, want 400", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/big"
+	"strconv"
+)
+
+// ndjsonRecord is a line of an ndjson job: the /archive record plus the
+// job's optional fields
+type ndjsonRecord struct {
+	blockRecord
+	TransactionsRoot     string        `json:"transactions_root,omitempty"`
+	StateRoot            string        `json:"state_root,omitempty"`
+	ReceiptsRoot         string        `json:"receipts_root,omitempty"`
+	LogCount             *uint64       `json:"log_count,omitempty"`
+	Difficulty           *string       `json:"difficulty,omitempty"`
+	TotalDifficulty      *string       `json:"total_difficulty,omitempty"`
+	PriorityFeeHistogram *feeHistogram `json:"priorityFeeHistogram,omitempty"`
+}
+
+// feeHistogram counts a block's transactions per gwei bucket. It encodes as
+// an object keyed by the bucket labels, in ascending order.
+type feeHistogram struct {
+	labels []string
+	counts []uint64
+}
+
+func (h *feeHistogram) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, label := range h.labels {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(strconv.Quote(label))
+		buf.WriteByte(':')
+		buf.WriteString(strconv.FormatUint(h.counts[i], 10))
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// ndjsonColumnNames returns the top-level keys of a job's ndjson records
+func ndjsonColumnNames(opts fetchOptions) []string {
+	cols := []string{"block_number", "timestamp", "gas_used", "tips", "base_fee", "block_size_bytes", "tx_count"}
+	if opts.Roots {
+		cols = append(cols, "transactions_root", "state_root", "receipts_root")
+	}
+	if opts.Logs != nil {
+		cols = append(cols, "log_count")
+	}
+	if opts.Difficulty {
+		cols = append(cols, "difficulty", "total_difficulty")
+	}
+	if opts.PriorityFeeBuckets != nil {
+		cols = append(cols, "priorityFeeHistogram")
+	}
+	return cols
+}
+
+// ndjsonRowWriter writes one JSON record per line. It has no header, so
+// appending on resume needs nothing special.
+type ndjsonRowWriter struct {
+	w      *bufio.Writer
+	enc    *json.Encoder
+	opts   fetchOptions
+	labels []string
+}
+
+func newNDJSONRowWriter(w io.Writer, _ bool, opts fetchOptions) rowWriter {
+	bw := bufio.NewWriter(w)
+	n := &ndjsonRowWriter{w: bw, enc: json.NewEncoder(bw), opts: opts}
+	if opts.PriorityFeeBuckets != nil {
+		n.labels = gweiBucketLabels(opts.PriorityFeeBuckets)
+	}
+	return n
+}
+
+func (n *ndjsonRowWriter) Write(row *exportRow) error {
+	rec := ndjsonRecord{blockRecord: newBlockRecord(row.BlockResult)}
+	if n.opts.Roots {
+		roots := row.roots()
+		rec.TransactionsRoot, rec.StateRoot, rec.ReceiptsRoot = roots.Transactions, roots.State, roots.Receipts
+	}
+	if n.opts.Logs != nil {
+		rec.LogCount = &row.LogCount
+	}
+	if n.opts.Difficulty {
+		rec.Difficulty, rec.TotalDifficulty = optionalBigPtr(row.Difficulty), optionalBigPtr(row.TotalDifficulty)
+	}
+	if n.labels != nil {
+		// The priority fee is what each transaction pays above the base fee
+		rec.PriorityFeeHistogram = &feeHistogram{
+			labels: n.labels,
+			counts: gweiBucketCounts(n.opts.PriorityFeeBuckets, row.GasPrices, row.BaseFee),
+		}
+	}
+	return n.enc.Encode(rec)
+}
+
+func (n *ndjsonRowWriter) Flush() error { return n.w.Flush() }
+
+func (n *ndjsonRowWriter) Close() error { return n.Flush() }
+
+// optionalBigPtr renders n in decimal, or nil if it is nil
+func optionalBigPtr(n *big.Int) *string {
+	if n == nil {
+		return nil
+	}
+	s := n.String()
+	return &s
+}
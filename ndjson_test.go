@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestNDJSONExport(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, calls := newFixtureAnalyzer(t, testBlocks(0, 4))
+	setAnalyzer(t, a)
+	// Cached rows carry no gas prices, so the histogram refetches them
+	seedCache(t, a, testBlocks(1, 4))
+
+	// Odd blocks have one transaction paying a 2 gwei priority fee
+	job := waitJob(t, submitJob(t, "start=1&end=4&format=ndjson&roots=true&priorityFeeBuckets=1,2.5"))
+	if job.Status != "done" {
+		t.Fatalf("status %s (%s), want done", job.Status, job.Error)
+	}
+	if calls.Load() < 4 {
+		t.Errorf("made %d block calls, want the 4 cached blocks fetched", calls.Load())
+	}
+	f, err := os.Open(job.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var blocks []uint64
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec struct {
+			BlockNumber      uint64          `json:"block_number"`
+			TxCount          int             `json:"tx_count"`
+			TransactionsRoot string          `json:"transactions_root"`
+			Histogram        json.RawMessage `json:"priorityFeeHistogram"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		blocks = append(blocks, rec.BlockNumber)
+		want := `{"lt_1":0,"1_2.5":0,"ge_2.5":0}`
+		if rec.BlockNumber%2 == 1 {
+			want = `{"lt_1":0,"1_2.5":1,"ge_2.5":0}`
+		}
+		if string(rec.Histogram) != want {
+			t.Errorf("block %d: histogram %s, want %s", rec.BlockNumber, rec.Histogram, want)
+		}
+		if wantRoot := testBlock(rec.BlockNumber).TransactionsRoot; rec.TransactionsRoot != wantRoot {
+			t.Errorf("block %d: transactions_root %s, want %s", rec.BlockNumber, rec.TransactionsRoot, wantRoot)
+		}
+	}
+	if !slices.Equal(blocks, []uint64{1, 2, 3, 4}) {
+		t.Errorf("wrote blocks %v, want 1-4", blocks)
+	}
+
+	for _, query := range []string{
+		"start=1&end=4&priorityFeeBuckets=1",
+		"start=1&end=4&format=ndjson&priorityFeeBuckets=2,1",
+		"start=1&end=4&format=ndjson&gasPriceBuckets=1",
+	} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// defaultNetwork names the analyzer configured with ALCHEMY_API_KEY
+const defaultNetwork = "mainnet"
+
+// networks maps network names to their analyzers, each with its own cache
+// database and RPC endpoint. It is filled in by main before serving.
+var networks = map[string]*Analyzer{}
+
+var networkNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// networkConfig is an extra network from the NETWORKS variable
+type networkConfig struct {
+	name      string
+	rpcURL    string
+	fallbacks []string
+	dbPath    string
+}
+
+// parseNetworks parses NETWORKS, a comma-separated list of name=rpcURL
+// entries, where rpcURL may be followed by |-separated fallback URLs. Each
+// network caches into <name>.db next to the default database.
+func parseNetworks(v, dbDir string) ([]networkConfig, error) {
+	var configs []networkConfig
+	seen := map[string]bool{defaultNetwork: true}
+	for _, entry := range strings.Split(v, ",") {
+		name, urls, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || !networkNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid network entry %q", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate network %q", name)
+		}
+		seen[name] = true
+		rpcURLs := strings.Split(urls, "|")
+		for _, rpcURL := range rpcURLs {
+			if !validRPCURL(rpcURL) {
+				return nil, fmt.Errorf("invalid RPC URL for network %q", name)
+			}
+		}
+		configs = append(configs, networkConfig{name, rpcURLs[0], rpcURLs[1:], filepath.Join(dbDir, name+".db")})
+	}
+	return configs, nil
+}
+
+// validRPCURL reports whether v is an absolute URL
+func validRPCURL(v string) bool {
+	u, err := url.Parse(v)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// networkParam returns the request's network parameter, or the default
+func networkParam(r *http.Request) string {
+	if v := r.URL.Query().Get("network"); v != "" {
+		return v
+	}
+	return defaultNetwork
+}
+
+// analyzerFor returns the analyzer of the request's network, replying 400
+// if there is no such network.
+func analyzerFor(w http.ResponseWriter, r *http.Request) (*Analyzer, bool) {
+	a, ok := networks[networkParam(r)]
+	if !ok {
+		http.Error(w, "Unknown network", 400)
+	}
+	return a, ok
+}
+
+// jobAnalyzer returns the analyzer of the network a job was submitted for
+func jobAnalyzer(job *JobStatus) *Analyzer {
+	if job.Options.Network == "" {
+		return networks[defaultNetwork]
+	}
+	return networks[job.Options.Network]
+}
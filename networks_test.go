@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []networkConfig
+		wantErr bool
+	}{
+		{
+			in:   "sepolia=https://eth-sepolia.example/v2/key",
+			want: []networkConfig{{"sepolia", "https://eth-sepolia.example/v2/key", []string{}, "/data/sepolia.db"}},
+		},
+		{
+			in: "sepolia=http://a.example, base-1=http://b.example:8545",
+			want: []networkConfig{
+				{"sepolia", "http://a.example", []string{}, "/data/sepolia.db"},
+				{"base-1", "http://b.example:8545", []string{}, "/data/base-1.db"},
+			},
+		},
+		{
+			in:   "sepolia=http://a.example|http://b.example|http://c.example",
+			want: []networkConfig{{"sepolia", "http://a.example", []string{"http://b.example", "http://c.example"}, "/data/sepolia.db"}},
+		},
+		{in: "sepolia", wantErr: true},
+		{in: "Sepolia=http://a.example", wantErr: true},
+		{in: "../x=http://a.example", wantErr: true},
+		{in: "mainnet=http://a.example", wantErr: true},
+		{in: "a=http://a.example,a=http://b.example", wantErr: true},
+		{in: "a=a.example", wantErr: true},
+		{in: "a=http://a.example|b.example", wantErr: true},
+		{in: "a=http://a.example|", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseNetworks(tt.in, "/data")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseNetworks(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseNetworks(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNetworkSelection(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	// chain serves a chain whose head is block head
+	chain := func(head uint64) *Analyzer {
+		srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+			if method == "eth_blockNumber" {
+				return fmt.Sprintf("0x%x", head), nil
+			}
+			if n := blockParam(params); n <= head {
+				return testBlock(n), nil
+			}
+			return nil, nil
+		})
+		return newTestAnalyzer(t, srv.URL)
+	}
+	// Only the extra network has blocks past 3
+	setAnalyzer(t, chain(3))
+	networks["sepolia"] = chain(10)
+	t.Cleanup(func() { delete(networks, "sepolia") })
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{path: "/block/8", want: 404},
+		{path: "/block/8?network=mainnet", want: 404},
+		{path: "/block/8?network=sepolia", want: 200},
+		{path: "/block/8?network=goerli", want: 400},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleBlock(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.want {
+			t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, tt.want)
+		}
+	}
+
+	job := waitJob(t, submitJob(t, "start=1&end=8&network=sepolia"))
+	if job.Status != "done" || job.LastWritten != 8 || job.Options.Network != "sepolia" {
+		t.Errorf("sepolia job: status %s (%s), lastWritten %d, network %q", job.Status, job.Error, job.LastWritten, job.Options.Network)
+	}
+	if job := waitJob(t, submitJob(t, "start=1&end=3&network=mainnet")); job.Status != "done" || job.Options.Network != "" {
+		t.Errorf("mainnet job: status %s (%s), network %q; want the default network", job.Status, job.Error, job.Options.Network)
+	}
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("POST", "/request?start=1&end=8&network=goerli", nil))
+	if rec.Code != 400 {
+		t.Errorf("unknown network: status %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// ETH/USD price sources for the tips_usd column. A static price takes
+// precedence over the price API.
+var (
+	staticETHUSDPrice string
+	ethUSDPriceURL    = "https://api.coingecko.com/api/v3/simple/price?ids=ethereum&vs_currencies=usd"
+)
+
+// usdPrice is the ETH/USD price snapshot a job converts tips with
+type usdPrice struct {
+	Price      string    `json:"price"` // decimal USD per ETH
+	Source     string    `json:"source"`
+	SnapshotAt time.Time `json:"snapshotAt"`
+}
+
+// resolveUSDPrice returns the static price if configured, else fetches the
+// current price once from ethUSDPriceURL.
+func resolveUSDPrice(ctx context.Context, client *http.Client) (*usdPrice, error) {
+	if staticETHUSDPrice != "" {
+		return &usdPrice{Price: staticETHUSDPrice, Source: "ETH_USD_PRICE", SnapshotAt: time.Now().UTC()}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ethUSDPriceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("price API returned %s", resp.Status)
+	}
+	// CoinGecko shape: {"ethereum":{"usd":3012.45}}
+	var body struct {
+		Ethereum struct {
+			USD json.Number `json:"usd"`
+		} `json:"ethereum"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&body); err != nil {
+		return nil, err
+	}
+	price, ok := new(big.Rat).SetString(body.Ethereum.USD.String())
+	if !ok || price.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid price %q", body.Ethereum.USD)
+	}
+	return &usdPrice{Price: body.Ethereum.USD.String(), Source: ethUSDPriceURL, SnapshotAt: time.Now().UTC()}, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestResolveUSDPrice(t *testing.T) {
+	defer func(static, url string) { staticETHUSDPrice, ethUSDPriceURL = static, url }(staticETHUSDPrice, ethUSDPriceURL)
+	var body string
+	status := 200
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer api.Close()
+	ethUSDPriceURL = api.URL
+
+	tests := []struct {
+		name          string
+		static, body  string
+		status        int
+		want, wantSrc string
+		wantErr       bool
+	}{
+		{name: "static", static: "2500.5", body: `{"ethereum":{"usd":1}}`, status: 200, want: "2500.5", wantSrc: "ETH_USD_PRICE"},
+		{name: "api", body: `{"ethereum":{"usd":3012.45}}`, status: 200, want: "3012.45", wantSrc: api.URL},
+		{name: "api error", body: `{}`, status: 429, wantErr: true},
+		{name: "no price", body: `{"ethereum":{}}`, status: 200, wantErr: true},
+		{name: "zero price", body: `{"ethereum":{"usd":0}}`, status: 200, wantErr: true},
+	}
+	for _, tt := range tests {
+		staticETHUSDPrice, body, status = tt.static, tt.body, tt.status
+		got, err := resolveUSDPrice(t.Context(), http.DefaultClient)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %+v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got.Price != tt.want || got.Source != tt.wantSrc || got.SnapshotAt.IsZero() {
+			t.Errorf("%s: got %+v, %v; want %s from %s", tt.name, got, err, tt.want, tt.wantSrc)
+		}
+	}
+}
+
+func TestTipsUSD(t *testing.T) {
+	price, _ := new(big.Rat).SetString("3000.10")
+	tests := []struct {
+		tips string
+		want string
+	}{
+		{tips: "0", want: "0.00"},
+		{tips: "1000000000000000000", want: "3000.10"},
+		{tips: "42000000000000", want: "0.13"}, // 0.126
+		{tips: "1000000000000", want: "0.00"},
+	}
+	for _, tt := range tests {
+		tips, _ := new(big.Int).SetString(tt.tips, 10)
+		if got := tipsUSD(tips, price); got != tt.want {
+			t.Errorf("tipsUSD(%s) = %s, want %s", tt.tips, got, tt.want)
+		}
+	}
+}
+
+func TestUSDJob(t *testing.T) {
+	defer func(static string) { staticETHUSDPrice = static }(staticETHUSDPrice)
+	staticETHUSDPrice = "2000"
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(10, 11))
+	setAnalyzer(t, a)
+
+	job := waitJob(t, submitJob(t, "start=10&end=11&usd=true"))
+	if job.Status != "done" || job.Options.USDPrice == nil || job.Options.USDPrice.Price != "2000" {
+		t.Fatalf("status %s, options %+v; want done at the static price", job.Status, job.Options)
+	}
+	records := readCSV(t, job.FilePath)
+	if want := []string{"block_number", "timestamp", "gas_used", "tips", "tips_usd"}; !slices.Equal(records[0], want) {
+		t.Errorf("header %v, want %v", records[0], want)
+	}
+	if got := column(t, records, "tips_usd"); !slices.Equal(got, []string{"0.00", "0.08"}) {
+		t.Errorf("tips_usd %v, want [0.00 0.08]", got)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Per-job fetch concurrency, counted in RPC calls: each slot fetches one
+// chunk of up to rpcBatchSize blocks. A job starts with fetchRampStart
+// calls in flight and raises the cap linearly to fetchConcurrency over
+// fetchRampDuration, so it doesn't open with a burst against the provider.
+var (
+	fetchConcurrency  = 500
+	fetchRampStart    = 500
+	fetchRampDuration time.Duration
+)
+
+// rampLimiter caps the number of concurrent fetch calls, with a cap that
+// grows from start to max over the ramp duration.
+type rampLimiter struct {
+	mu       sync.Mutex
+	inFlight int
+	start    int
+	max      int
+	ramp     time.Duration
+	began    time.Time
+}
+
+func newRampLimiter(start, max int, ramp time.Duration) *rampLimiter {
+	return &rampLimiter{start: min(start, max), max: max, ramp: ramp, began: time.Now()}
+}
+
+// limit is the concurrency cap at time now
+func (l *rampLimiter) limit(now time.Time) int {
+	elapsed := now.Sub(l.began)
+	if l.ramp <= 0 || elapsed >= l.ramp {
+		return l.max
+	}
+	return l.start + int(int64(l.max-l.start)*int64(elapsed)/int64(l.ramp))
+}
+
+// Acquire waits for a fetch slot, returning ctx's error if it ends first
+func (l *rampLimiter) Acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.inFlight < l.limit(time.Now()) {
+			l.inFlight++
+			l.mu.Unlock()
+			return nil
+		}
+		l.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// Release frees a slot taken by Acquire
+func (l *rampLimiter) Release() {
+	l.mu.Lock()
+	l.inFlight--
+	l.mu.Unlock()
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRampLimiterLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, max int
+		ramp       time.Duration
+		elapsed    time.Duration
+		want       int
+	}{
+		{name: "no ramp", start: 5, max: 50, want: 50},
+		{name: "ramp start", start: 5, max: 50, ramp: 10 * time.Second, want: 5},
+		{name: "halfway", start: 10, max: 50, ramp: 10 * time.Second, elapsed: 5 * time.Second, want: 30},
+		{name: "ramp done", start: 10, max: 50, ramp: 10 * time.Second, elapsed: time.Minute, want: 50},
+		{name: "start above max", start: 80, max: 50, ramp: 10 * time.Second, want: 50},
+	}
+	for _, tt := range tests {
+		l := newRampLimiter(tt.start, tt.max, tt.ramp)
+		if got := l.limit(l.began.Add(tt.elapsed)); got != tt.want {
+			t.Errorf("%s: limit = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
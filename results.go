@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// resultsRowWriter also stores every row of a job in the job_results table,
+// so its output can be queried with SQL. Rows are buffered and inserted in
+// one transaction before the wrapped writer flushes, so the table is never
+// behind the file; a resumed job's reinserts simply replace.
+type resultsRowWriter struct {
+	rowWriter
+	db      *sql.DB
+	jobID   string
+	pending []*exportRow
+}
+
+func (rw *resultsRowWriter) Write(row *exportRow) error {
+	if err := rw.rowWriter.Write(row); err != nil {
+		return err
+	}
+	rw.pending = append(rw.pending, row)
+	return nil
+}
+
+func (rw *resultsRowWriter) Flush() error {
+	if err := rw.insert(); err != nil {
+		return err
+	}
+	return rw.rowWriter.Flush()
+}
+
+func (rw *resultsRowWriter) Close() error {
+	if err := rw.insert(); err != nil {
+		return err
+	}
+	return rw.rowWriter.Close()
+}
+
+func (rw *resultsRowWriter) insert() error {
+	if len(rw.pending) == 0 {
+		return nil
+	}
+	tx, err := rw.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO job_results (job_id, block_num, timestamp, gas_used, tips, base_fee, base_fee_delta, size, tx_count) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range rw.pending {
+		// NULL unless the job asked for base fee deltas
+		var baseFeeDelta any
+		if row.BaseFeeDelta != nil {
+			baseFeeDelta = row.BaseFeeDelta.String()
+		}
+		_, err := stmt.Exec(rw.jobID, row.BlockNum, row.TimeStamp.Unix(), row.GasUsed.String(), row.Tips.String(),
+			row.BaseFee.String(), baseFeeDelta, row.Size, row.TxCount)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	rw.pending = rw.pending[:0]
+	return nil
+}
+
+// DeleteJobResults drops a job's rows from job_results
+func (a *Analyzer) DeleteJobResults(ctx context.Context, jobID string) error {
+	_, err := a.db.ExecContext(ctx, "DELETE FROM job_results WHERE job_id = ?", jobID)
+	return err
+}
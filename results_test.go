@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestJobResults(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(0, 1200))
+	setAnalyzer(t, a)
+	count := func(jobID string) int {
+		var n int
+		if err := a.db.QueryRow("SELECT COUNT(*) FROM job_results WHERE job_id = ?", jobID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	tests := []struct {
+		query     string
+		wantDelta bool
+	}{
+		{query: "start=1&end=1200&results=true"},
+		{query: "start=1&end=1200&results=true&baseFeeDelta=true", wantDelta: true},
+	}
+	for _, tt := range tests {
+		jobID := submitJob(t, tt.query)
+		if job := waitJob(t, jobID); job.Status != "done" {
+			t.Fatalf("%s: status %s (%s)", tt.query, job.Status, job.Error)
+		}
+		if n := count(jobID); n != 1200 {
+			t.Errorf("%s: %d rows in job_results, want 1200", tt.query, n)
+		}
+		var tips string
+		var delta sql.NullString
+		err := a.db.QueryRow("SELECT tips, base_fee_delta FROM job_results WHERE job_id = ? AND block_num = 7", jobID).Scan(&tips, &delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tips != strconv.Itoa(21000*testTip) || delta.Valid != tt.wantDelta || tt.wantDelta && delta.String != "1" {
+			t.Errorf("%s: block 7 has tips %s and base fee delta %v", tt.query, tips, delta)
+		}
+
+		rec := httptest.NewRecorder()
+		handleDeleteJob(rec, httptest.NewRequest("DELETE", "/jobs/"+jobID+"?purge=true", nil))
+		if rec.Code != 204 {
+			t.Fatalf("DELETE /jobs/%s: status %d", jobID, rec.Code)
+		}
+		if n := count(jobID); n != 0 {
+			t.Errorf("%s: %d rows left in job_results after purge", tt.query, n)
+		}
+	}
+
+	// Without results=true nothing is stored
+	jobID := submitJob(t, "start=1&end=10")
+	waitJob(t, jobID)
+	if n := count(jobID); n != 0 {
+		t.Errorf("job without results stored %d rows", n)
+	}
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("POST", "/request?start=1&end=10&results=true&rollup=day", nil))
+	if rec.Code != 400 {
+		t.Errorf("results with rollup: status %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestRollup(t *testing.T) {
+	setJobs(t, map[string]*JobStatus{})
+	setJobsDir(t)
+	a, _ := newFixtureAnalyzer(t, testBlocks(199, 1200))
+	setAnalyzer(t, a)
+	// bucket is a rollup row for blocks [first, last], of which the odd
+	// ones carry a transaction
+	bucket := func(start string, first, last uint64) []string {
+		txs := (last+1)/2 - first/2
+		return []string{
+			start,
+			strconv.FormatUint(first, 10),
+			strconv.FormatUint(last, 10),
+			strconv.FormatUint(last-first+1, 10),
+			strconv.FormatUint(21000*txs, 10),
+			strconv.FormatUint(21000*testTip*txs, 10),
+		}
+	}
+	tests := []struct {
+		query string
+		want  [][]string
+	}{
+		{
+			// Spans a batch boundary, and the last bucket is only
+			// written when the job finishes
+			query: "start=200&end=1200&rollup=day",
+			want: [][]string{
+				rollupColumns,
+				bucket("2023-11-14T00:00:00Z", 200, 533),
+				bucket("2023-11-15T00:00:00Z", 534, 1200),
+			},
+		},
+		{
+			query: "start=200&end=600&rollup=hour",
+			want: [][]string{
+				rollupColumns,
+				bucket("2023-11-14T22:00:00Z", 200, 233),
+				bucket("2023-11-14T23:00:00Z", 234, 533),
+				bucket("2023-11-15T00:00:00Z", 534, 600),
+			},
+		},
+	}
+	for _, tt := range tests {
+		for _, compress := range []string{"", "&compress=gzip"} {
+			job := waitJob(t, submitJob(t, tt.query+compress))
+			if job.Status != "done" || job.RowsWritten != job.End-job.Start+1 {
+				t.Fatalf("%s%s: status %s (%s), rowsWritten %d", tt.query, compress, job.Status, job.Error, job.RowsWritten)
+			}
+			f, err := os.Open(job.FilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if info, _ := f.Stat(); info.Size() != job.FlushedBytes {
+				t.Errorf("%s%s: flushedBytes %d, want file size %d", tt.query, compress, job.FlushedBytes, info.Size())
+			}
+			r := csv.NewReader(f)
+			if compress != "" {
+				gz, err := gzip.NewReader(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r = csv.NewReader(gz)
+			}
+			records, err := r.ReadAll()
+			if err != nil {
+				t.Fatalf("%s%s: %v", tt.query, compress, err)
+			}
+			if !slices.EqualFunc(records, tt.want, slices.Equal) {
+				t.Errorf("%s%s = %v, want %v", tt.query, compress, records, tt.want)
+			}
+		}
+	}
+
+	for _, query := range []string{"rollup=week", "rollup=hour&format=protobuf", "rollup=hour&fields=tips", "rollup=hour&gapPolicy=fill-zero"} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("POST", "/request?start=200&end=600&"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// defaultRPCBatchSize is how many blocks a job fetches per JSON-RPC batch
+// call. Full blocks run to a few MB, so larger batches mostly risk the
+// client timeout.
+const defaultRPCBatchSize = 10
+
+// WithRPCBatch fetches blocks size at a time with JSON-RPC batch calls, each
+// taking tokens from the rate limiter. A size of 1 makes one plain call per
+// block.
+func WithRPCBatch(size, tokens int) AnalyzerOption {
+	return func(a *Analyzer) {
+		a.rpcBatchSize = size
+		a.rpcBatchTokens = tokens
+	}
+}
+
+// rpcBatchCallTo performs calls as one JSON-RPC batch against p, returning
+// the raw result or error of each call in order. The error return is for
+// the batch as a whole: the request failed, or the provider didn't answer
+// with an array, as when it doesn't support batches.
+func rpcBatchCallTo(ctx context.Context, a *Analyzer, p *rpcProvider, calls []jsonRPCRequest) ([]json.RawMessage, []error, error) {
+	if err := p.limiter.WaitN(ctx, min(a.rpcBatchTokens, p.limiter.Burst())); err != nil {
+		return nil, nil, err
+	}
+	if timeout, ok := ctx.Value(rpcTimeoutKey{}).(time.Duration); ok && timeout < a.client.Timeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	reqBody, _ := json.Marshal(calls)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	began := time.Now()
+	defer func() { a.rpcLatency.Observe(time.Since(began)) }()
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	// The response size cap applies per call in the batch
+	limit := a.maxResponseBytes * int64(len(calls))
+	body := &io.LimitedReader{R: resp.Body, N: limit + 1}
+	data, err := io.ReadAll(body)
+	if body.N <= 0 {
+		return nil, nil, fmt.Errorf("RPC batch response exceeds %d bytes", limit)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var responses []jsonRPCResponse[json.RawMessage]
+	if err := json.Unmarshal(data, &responses); err != nil {
+		// A single error object, e.g. for a rejected batch
+		var single jsonRPCResponse[json.RawMessage]
+		if json.Unmarshal(data, &single) == nil && single.Error != nil {
+			return nil, nil, fmt.Errorf("RPC error: %s", single.Error.Message)
+		}
+		return nil, nil, fmt.Errorf("invalid RPC batch response: %w", err)
+	}
+
+	// Responses may come in any order; match them to calls by ID
+	index := make(map[int64]int, len(calls))
+	for i, call := range calls {
+		index[call.ID] = i
+	}
+	results := make([]json.RawMessage, len(calls))
+	errs := make([]error, len(calls))
+	answered := make([]bool, len(calls))
+	for _, res := range responses {
+		i, ok := index[res.ID]
+		if !ok || answered[i] {
+			continue
+		}
+		answered[i] = true
+		if res.Error != nil {
+			errs[i] = fmt.Errorf("RPC error: %s", res.Error.Message)
+		} else {
+			results[i] = res.Result
+		}
+	}
+	for i := range calls {
+		if !answered[i] {
+			errs[i] = fmt.Errorf("no response to call %d of the RPC batch", i)
+		}
+	}
+	return results, errs, nil
+}
+
+// getBlocksWithTxs fetches blocks with one batch call to the primary
+// provider. errs holds each block's error, errBlockNotFound for blocks the
+// provider doesn't have; err is set instead when the whole batch failed.
+func (a *Analyzer) getBlocksWithTxs(ctx context.Context, blockNums []uint64) (blocks []*rpcBlock, errs []error, err error) {
+	base := time.Now().UnixNano()
+	calls := make([]jsonRPCRequest, len(blockNums))
+	for i, bn := range blockNums {
+		calls[i] = jsonRPCRequest{JSONRPC: "2.0", ID: base + int64(i), Method: a.blockMethod, Params: a.blockTagParams(fmt.Sprintf("0x%x", bn))}
+	}
+	results, errs, err := rpcBatchCallTo(ctx, a, &rpcProvider{url: a.alchURL, limiter: a.limiter}, calls)
+	if err != nil {
+		return nil, nil, err
+	}
+	blocks = make([]*rpcBlock, len(blockNums))
+	for i, raw := range results {
+		if errs[i] != nil {
+			continue
+		}
+		if err := json.Unmarshal(raw, &blocks[i]); err != nil {
+			errs[i] = err
+		} else if blocks[i] == nil {
+			errs[i] = errBlockNotFound
+		}
+	}
+	return blocks, errs, nil
+}
+
+// fetchBlocks fetches and caches blocks with a batch call, like fetchBlock
+// for each. Blocks whose call failed, or all of them when the batch did, go
+// through fetchBlock for its retries and fallback providers.
+func (a *Analyzer) fetchBlocks(ctx context.Context, blockNums []uint64) ([]*BlockResult, []error) {
+	results := make([]*BlockResult, len(blockNums))
+	errs := make([]error, len(blockNums))
+	var pending []int // indexes still to fetch
+	for i, bn := range blockNums {
+		if a.knownMissing(bn) {
+			errs[i] = errBlockNotFound
+		} else {
+			pending = append(pending, i)
+		}
+	}
+	if len(pending) > 1 && a.rpcBatchSize > 1 {
+		batchNums := make([]uint64, len(pending))
+		for j, i := range pending {
+			batchNums[j] = blockNums[i]
+		}
+		blocks, blockErrs, err := a.getBlocksWithTxs(ctx, batchNums)
+		if err != nil && ctx.Err() != nil {
+			for _, i := range pending {
+				errs[i] = ctx.Err()
+			}
+			return results, errs
+		}
+		if err != nil {
+			fmt.Printf("Error fetching blocks %d-%d in a batch: %s\n", batchNums[0], batchNums[len(batchNums)-1], truncateError(err.Error()))
+		} else {
+			var retry []int
+			for j, i := range pending {
+				switch blockErr := blockErrs[j]; {
+				case blockErr == errBlockNotFound:
+					a.markMissing(blockNums[i])
+					errs[i] = blockErr
+				case blockErr != nil:
+					fmt.Printf("Error fetching block %d: %s\n", blockNums[i], truncateError(blockErr.Error()))
+					retry = append(retry, i)
+				default:
+					results[i], errs[i] = a.storeBlock(blockNums[i], blocks[j])
+				}
+			}
+			pending = retry
+		}
+	}
+	for _, i := range pending {
+		results[i], errs[i] = a.fetchBlock(ctx, blockNums[i])
+	}
+	return results, errs
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestFetchBlocksBatch(t *testing.T) {
+	blockNums := []uint64{1, 2, 3, 4}
+	tests := []struct {
+		name string
+		// batch answers a batch call given the response to each of its
+		// calls, in order; nil makes it answer with a single error object
+		batch       func(responses []jsonRPCResponse[any]) []jsonRPCResponse[any]
+		wantMissing []uint64 // blocks that come back errBlockNotFound
+		wantSingle  []uint64 // blocks fetched with plain calls afterwards
+	}{
+		{
+			name:  "in order",
+			batch: func(res []jsonRPCResponse[any]) []jsonRPCResponse[any] { return res },
+		},
+		{
+			name: "out of order",
+			batch: func(res []jsonRPCResponse[any]) []jsonRPCResponse[any] {
+				slices.Reverse(res)
+				res[0], res[2] = res[2], res[0]
+				return res
+			},
+		},
+		{
+			name: "error element",
+			batch: func(res []jsonRPCResponse[any]) []jsonRPCResponse[any] {
+				res[2].Result, res[2].Error = nil, &rpcErr{Code: -32000, Message: "header not found"}
+				return res
+			},
+			wantSingle: []uint64{3},
+		},
+		{
+			name: "missing and duplicate answers",
+			batch: func(res []jsonRPCResponse[any]) []jsonRPCResponse[any] {
+				return []jsonRPCResponse[any]{res[3], res[0], res[0], res[2]}
+			},
+			wantSingle: []uint64{2},
+		},
+		{
+			name: "null element",
+			batch: func(res []jsonRPCResponse[any]) []jsonRPCResponse[any] {
+				res[1].Result = nil
+				return res
+			},
+			wantMissing: []uint64{2},
+		},
+		{
+			name:       "batches unsupported",
+			wantSingle: blockNums,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var batches int
+			var single []uint64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				w.Header().Set("Content-Type", "application/json")
+				respond := func(call jsonRPCRequest) jsonRPCResponse[any] {
+					params, _ := call.Params.([]any)
+					return jsonRPCResponse[any]{JSONRPC: "2.0", ID: call.ID, Result: testBlock(blockParam(params))}
+				}
+				if !bytes.HasPrefix(data, []byte("[")) {
+					var call jsonRPCRequest
+					json.Unmarshal(data, &call)
+					params, _ := call.Params.([]any)
+					mu.Lock()
+					single = append(single, blockParam(params))
+					mu.Unlock()
+					json.NewEncoder(w).Encode(respond(call))
+					return
+				}
+				mu.Lock()
+				batches++
+				mu.Unlock()
+				if tt.batch == nil {
+					json.NewEncoder(w).Encode(jsonRPCResponse[any]{JSONRPC: "2.0", Error: &rpcErr{Code: -32600, Message: "batch requests are not supported"}})
+					return
+				}
+				var calls []jsonRPCRequest
+				json.Unmarshal(data, &calls)
+				responses := make([]jsonRPCResponse[any], len(calls))
+				for i, call := range calls {
+					responses[i] = respond(call)
+				}
+				json.NewEncoder(w).Encode(tt.batch(responses))
+			}))
+			defer srv.Close()
+			a := newTestAnalyzer(t, srv.URL, WithRPCBatch(len(blockNums), 1), WithMaxRetries(0))
+
+			results, errs := a.fetchBlocks(t.Context(), blockNums)
+			for i, bn := range blockNums {
+				if slices.Contains(tt.wantMissing, bn) {
+					if !errors.Is(errs[i], errBlockNotFound) {
+						t.Errorf("block %d: error %v, want %v", bn, errs[i], errBlockNotFound)
+					}
+					continue
+				}
+				if errs[i] != nil {
+					t.Errorf("block %d: %v", bn, errs[i])
+					continue
+				}
+				want, _ := a.parseBlock(testBlock(bn))
+				if r := results[i]; r.BlockNum != bn || r.Tips.Cmp(want.Tips) != 0 || !r.TimeStamp.Equal(want.TimeStamp) {
+					t.Errorf("block %d: got block %d with tips %s at %v", bn, r.BlockNum, r.Tips, r.TimeStamp)
+				}
+			}
+			if batches != 1 {
+				t.Errorf("made %d batch calls, want 1", batches)
+			}
+			slices.Sort(single)
+			if !slices.Equal(single, tt.wantSingle) {
+				t.Errorf("fetched %v one at a time, want %v", single, tt.wantSingle)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Per-request deadlines. Ordinary handlers that overrun handlerTimeout get a
+// 503; streaming handlers write as they go, so they only get a context
+// deadline, streamTimeout, and so does waiting on a job. routeTimeouts
+// overrides either for a route pattern; zero disables the deadline.
+var (
+	handlerTimeout = 60 * time.Second
+	streamTimeout  = time.Hour
+	routeTimeouts  = map[string]time.Duration{
+		// Rewriting or loading a large cache takes a while
+		"/admin/vacuum": 30 * time.Minute,
+		"/admin/import": 30 * time.Minute,
+	}
+)
+
+// streamingRoutes are the patterns whose responses are written incrementally
+var streamingRoutes = map[string]bool{
+	"/events/":   true,
+	"/download/": true,
+	"/archive":   true,
+	"/live":      true,
+}
+
+// streams reports whether r is answered incrementally or only once some
+// work finishes, so a TimeoutHandler would cut it off: the streaming routes,
+// and /request?wait=true, which responds when its job is done.
+func streams(pattern string, r *http.Request) bool {
+	return streamingRoutes[pattern] || (pattern == "/request" && r.URL.Query().Get("wait") == "true")
+}
+
+// parseRouteTimeouts parses ROUTE_TIMEOUTS, a comma-separated list of
+// pattern=duration entries such as /txs=2m, into routeTimeouts.
+func parseRouteTimeouts(v string) error {
+	for _, entry := range strings.Split(v, ",") {
+		pattern, ds, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || !strings.HasPrefix(pattern, "/") {
+			return fmt.Errorf("invalid entry %q", entry)
+		}
+		d, err := time.ParseDuration(ds)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid duration in %q", entry)
+		}
+		routeTimeouts[pattern] = d
+	}
+	return nil
+}
+
+// withTimeouts applies the deadline of each request's route before handing
+// it to mux.
+func withTimeouts(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		streaming := streams(pattern, r)
+		timeout, ok := routeTimeouts[pattern]
+		if !ok {
+			timeout = handlerTimeout
+			if streaming {
+				timeout = streamTimeout
+			}
+		}
+		switch {
+		case timeout <= 0:
+			mux.ServeHTTP(w, r)
+		case streaming:
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			mux.ServeHTTP(w, r.WithContext(ctx))
+		default:
+			http.TimeoutHandler(mux, timeout, "Request timed out\n").ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithTimeouts(t *testing.T) {
+	defer func(h, s time.Duration) { handlerTimeout, streamTimeout = h, s }(handlerTimeout, streamTimeout)
+	handlerTimeout, streamTimeout = 50*time.Millisecond, 2*time.Second
+	routeTimeouts["/slow"] = 0
+	defer delete(routeTimeouts, "/slow")
+
+	// Each handler takes 200ms, or until its deadline if that comes first
+	mux := http.NewServeMux()
+	work := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+			w.Write([]byte("ok"))
+		case <-r.Context().Done():
+			http.Error(w, "Timed out", 503)
+		}
+	}
+	for _, pattern := range []string{"/request", "/status/", "/download/", "/slow"} {
+		mux.HandleFunc(pattern, work)
+	}
+	srv := httptest.NewServer(withTimeouts(mux))
+	defer srv.Close()
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{path: "/status/1", want: 503},
+		{path: "/request", want: 503},
+		{path: "/request?wait=false", want: 503},
+		{path: "/request?wait=true", want: 200},
+		{path: "/download/1", want: 200},
+		{path: "/slow", want: 200},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("GET %s = %d, want %d", tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestParseRouteTimeouts(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]time.Duration
+		wantErr bool
+	}{
+		{in: "/txs=2m", want: map[string]time.Duration{"/txs": 2 * time.Minute}},
+		{in: "/request=30m, /block/=0s", want: map[string]time.Duration{"/request": 30 * time.Minute, "/block/": 0}},
+		{in: "txs=2m", wantErr: true},
+		{in: "/txs", wantErr: true},
+		{in: "/txs=soon", wantErr: true},
+		{in: "/txs=-1s", wantErr: true},
+	}
+	for _, tt := range tests {
+		saved := routeTimeouts
+		routeTimeouts = map[string]time.Duration{}
+		err := parseRouteTimeouts(tt.in)
+		got := routeTimeouts
+		routeTimeouts = saved
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRouteTimeouts(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseRouteTimeouts(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+		for pattern, d := range tt.want {
+			if got[pattern] != d {
+				t.Errorf("parseRouteTimeouts(%q)[%s] = %v, want %v", tt.in, pattern, got[pattern], d)
+			}
+		}
+	}
+}
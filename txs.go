@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/big"
+	"regexp"
+	"sync"
+)
+
+// maxTxsPerRequest bounds the hashes accepted by a single /txs call
+const maxTxsPerRequest = 100
+
+// hashPattern matches a 32-byte hash such as a transaction hash or log topic
+var hashPattern = regexp.MustCompile(`^0x[0-9a-fA-F]{64}$`)
+
+var errTxNotMined = errors.New("transaction not found or not yet mined")
+
+type rpcTxByHash struct {
+	BlockNumber *string `json:"blockNumber"`
+}
+
+type rpcReceipt struct {
+	BlockNumber       string `json:"blockNumber"`
+	GasUsed           string `json:"gasUsed"`
+	EffectiveGasPrice string `json:"effectiveGasPrice"`
+}
+
+// TxTip is the fee breakdown of a single mined transaction
+type TxTip struct {
+	Hash              string `json:"hash"`
+	BlockNumber       uint64 `json:"blockNumber,omitempty"`
+	GasUsed           string `json:"gasUsed,omitempty"`
+	EffectiveGasPrice string `json:"effectiveGasPrice,omitempty"`
+	BaseFee           string `json:"baseFee,omitempty"`
+	TipPerGas         string `json:"tipPerGas,omitempty"`
+	Tip               string `json:"tip,omitempty"`
+	Error             string `json:"error,omitempty"`
+}
+
+// GetTxTips fetches the fee breakdown of each transaction concurrently, in
+// the order given. Per-transaction failures are reported in TxTip.Error.
+func (a *Analyzer) GetTxTips(ctx context.Context, hashes []string) []TxTip {
+	tips := make([]TxTip, len(hashes))
+	var wg sync.WaitGroup
+	for i, hash := range hashes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tip, err := a.getTxTip(ctx, hash)
+			if err != nil {
+				tips[i] = TxTip{Hash: hash, Error: truncateError(err.Error())}
+				return
+			}
+			tips[i] = *tip
+		}()
+	}
+	wg.Wait()
+	return tips
+}
+
+func (a *Analyzer) getTxTip(ctx context.Context, hash string) (*TxTip, error) {
+	var blockNum uint64
+	var gasUsedStr, priceStr, baseFeeStr string
+	err := a.db.QueryRowContext(ctx, "SELECT block_num, gas_used, effective_gas_price, base_fee FROM tx_cache WHERE hash = ?", hash).
+		Scan(&blockNum, &gasUsedStr, &priceStr, &baseFeeStr)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			a.cacheError("Cache error", err)
+		}
+		blockNum, gasUsedStr, priceStr, baseFeeStr, err = a.fetchTxFees(ctx, hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	gasUsed, err := hexToBig(gasUsedStr)
+	if err != nil {
+		return nil, err
+	}
+	price, err := hexToBig(priceStr)
+	if err != nil {
+		return nil, err
+	}
+	baseFee, err := hexToBig(baseFeeStr)
+	if err != nil {
+		return nil, err
+	}
+	perGas := tipPerGas(price, baseFee)
+	return &TxTip{
+		Hash:              hash,
+		BlockNumber:       blockNum,
+		GasUsed:           gasUsed.String(),
+		EffectiveGasPrice: price.String(),
+		BaseFee:           baseFee.String(),
+		TipPerGas:         perGas.String(),
+		Tip:               new(big.Int).Mul(perGas, gasUsed).String(),
+	}, nil
+}
+
+// fetchTxFees reads a transaction's receipt and its block's base fee over
+// RPC, caching them once the block is final.
+func (a *Analyzer) fetchTxFees(ctx context.Context, hash string) (blockNum uint64, gasUsed, price, baseFee string, err error) {
+	tx, err := rpcCall[*rpcTxByHash](ctx, a, "eth_getTransactionByHash", hash)
+	if err != nil {
+		return 0, "", "", "", err
+	}
+	if *tx == nil || (*tx).BlockNumber == nil {
+		return 0, "", "", "", errTxNotMined
+	}
+	receipt, err := rpcCall[*rpcReceipt](ctx, a, "eth_getTransactionReceipt", hash)
+	if err != nil {
+		return 0, "", "", "", err
+	}
+	if *receipt == nil {
+		return 0, "", "", "", errTxNotMined
+	}
+	blockNum, err = hexToUint64((*receipt).BlockNumber)
+	if err != nil {
+		return 0, "", "", "", err
+	}
+	header, err := rpcCall[*rpcBlockHeader](ctx, a, "eth_getBlockByNumber", (*receipt).BlockNumber, false)
+	if err != nil {
+		return 0, "", "", "", err
+	}
+	if *header == nil {
+		return 0, "", "", "", errBlockNotFound
+	}
+	gasUsed, price, baseFee = (*receipt).GasUsed, (*receipt).EffectiveGasPrice, (*header).BaseFeePerGas
+
+	// Receipts can still change with a reorg until the block is final
+	if head, err := a.HeadBlock(ctx); err == nil && blockNum+finalityDepth <= head {
+		_, err := a.db.Exec("INSERT OR REPLACE INTO tx_cache (hash, block_num, gas_used, effective_gas_price, base_fee) VALUES (?, ?, ?, ?, ?)",
+			hash, blockNum, gasUsed, price, baseFee)
+		if err != nil {
+			a.cacheError("Cache insert error", err)
+		}
+	}
+	return blockNum, gasUsed, price, baseFee, nil
+}
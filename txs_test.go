@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// testTxHash is the hash of the fixture transaction mined in block n; block
+// 0 has none
+func testTxHash(n uint64) string {
+	return fmt.Sprintf("0x%064x", n)
+}
+
+func TestHandleTxs(t *testing.T) {
+	var calls atomic.Int64
+	srv := newRPCStub(t, func(ctx context.Context, method string, params []any) (any, error) {
+		calls.Add(1)
+		if method == "eth_blockNumber" {
+			return "0x64", nil
+		}
+		if method == "eth_getBlockByNumber" {
+			return testBlock(blockParam(params)), nil
+		}
+		hash, _ := params[0].(string)
+		n, _ := new(big.Int).SetString(hash[2:], 16)
+		if n.Sign() == 0 {
+			return nil, nil
+		}
+		blockNum := fmt.Sprintf("0x%x", n)
+		if method == "eth_getTransactionByHash" {
+			return map[string]any{"blockNumber": blockNum}, nil
+		}
+		baseFee, _ := hexToBig(testBlock(n.Uint64()).BaseFeePerGas)
+		price := new(big.Int).Add(baseFee, big.NewInt(testTip))
+		return map[string]any{"blockNumber": blockNum, "gasUsed": "0x5208", "effectiveGasPrice": "0x" + price.Text(16)}, nil
+	})
+	setAnalyzer(t, newTestAnalyzer(t, srv.URL))
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleTxs(rec, httptest.NewRequest("POST", "/txs", bytes.NewBufferString(body)))
+		return rec
+	}
+
+	for _, body := range []string{`"0x1"`, `[]`, `["0x1"]`, `["` + testTxHash(1) + `", "0xzz"]`} {
+		if rec := post(body); rec.Code != 400 {
+			t.Errorf("POST /txs %s = %d, want 400", body, rec.Code)
+		}
+	}
+
+	// Block 10 is final and cached; block 90 isn't, so it's fetched again
+	wantTip := strconv.Itoa(21000 * testTip)
+	for round := range 2 {
+		calls.Store(0)
+		rec := post(`["` + testTxHash(10) + `", "` + testTxHash(0) + `", "` + testTxHash(90) + `"]`)
+		var tips []TxTip
+		if err := json.Unmarshal(rec.Body.Bytes(), &tips); rec.Code != 200 || err != nil || len(tips) != 3 {
+			t.Fatalf("POST /txs = %d %s", rec.Code, rec.Body)
+		}
+		for i, n := range []uint64{10, 90} {
+			tip := tips[2*i]
+			if tip.BlockNumber != n || tip.Tip != wantTip || tip.TipPerGas != strconv.Itoa(testTip) || tip.Error != "" {
+				t.Errorf("round %d: tx of block %d = %+v, want tip %s", round, n, tip, wantTip)
+			}
+		}
+		if tips[1].Error != errTxNotMined.Error() {
+			t.Errorf("round %d: unmined tx error = %q, want %q", round, tips[1].Error, errTxNotMined)
+		}
+		// A mined tx takes three calls, plus one for the head until it's
+		// cached. Round 1 only refetches the unmined tx and that of block 90.
+		if want := []int64{4 + 1 + 3, 1 + 3}[round]; calls.Load() != want {
+			t.Errorf("round %d: made %d RPC calls, want %d", round, calls.Load(), want)
+		}
+	}
+}